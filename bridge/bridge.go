@@ -0,0 +1,544 @@
+// Package bridge publishes chromecast events to a message bus and exposes them as typed events.
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/mediaplayer"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	"github.com/vishen/go-chromecast/cast/proto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+const defaultPollInterval = 10 * time.Minute
+
+type Option func(*Bridge)
+
+// WithRetain sets the retain flag of published state messages
+func WithRetain(retain bool) Option {
+	return func(b *Bridge) {
+		b.retain = retain
+	}
+}
+
+// WithRawPublish publishes all cast messages to <topic>/raw/<namespace>
+func WithRawPublish(publishRaw bool) Option {
+	return func(b *Bridge) {
+		b.publishRaw = publishRaw
+	}
+}
+
+// WithRecorder records all cast messages received
+func WithRecorder(recorder *Recorder) Option {
+	return func(b *Bridge) {
+		b.recorder = recorder
+	}
+}
+
+// WithChannel enables the <topic>/cast/send command, messages are sent with channel
+func WithChannel(channel *mediaplayer.Channel) Option {
+	return func(b *Bridge) {
+		b.channel = channel
+	}
+}
+
+// WithPollInterval sets the interval between two device status updates
+func WithPollInterval(interval time.Duration) Option {
+	return func(b *Bridge) {
+		b.pollInterval = interval
+	}
+}
+
+// WithPayloadFormats publishes values with each format, DefaultPayloadFormat is used if no format is given
+func WithPayloadFormats(formats ...PayloadFormat) Option {
+	return func(b *Bridge) {
+		if len(formats) > 0 {
+			b.formats = formats
+		}
+	}
+}
+
+// WithTopicFunc builds topics with f instead of appending fields to the bridge topic
+func WithTopicFunc(f TopicFunc) Option {
+	return func(b *Bridge) {
+		b.topicFunc = f
+	}
+}
+
+// WithStatePublish publishes volume and mute to device topics, enabled by default. It may be disabled when state is
+// published with another convention, like HomieDevice.
+func WithStatePublish(publish bool) Option {
+	return func(b *Bridge) {
+		b.publishState = publish
+	}
+}
+
+// WithUserProperties attaches props to published messages, with their event type. They are only sent by MQTT v5
+// publishers.
+func WithUserProperties(props map[string]string) Option {
+	return func(b *Bridge) {
+		b.userProperties = props
+	}
+}
+
+// WithLogger logs with logger, to add device fields to all lines
+func WithLogger(logger *log.Entry) Option {
+	return func(b *Bridge) {
+		b.logger = logger
+	}
+}
+
+// WithCounters counts messages and errors with counters, to keep them across bridges of a device
+func WithCounters(counters *Counters) Option {
+	return func(b *Bridge) {
+		b.counters = counters
+	}
+}
+
+// WithTraceAttributes adds attrs to spans of the bridge, to identify the device
+func WithTraceAttributes(attrs ...attribute.KeyValue) Option {
+	return func(b *Bridge) {
+		b.traceAttributes = attrs
+	}
+}
+
+// Bridge listens events of a chromecast device, publishes them to topic with Publisher and emits typed events to
+// its subscribers
+type Bridge struct {
+	player       mediaplayer.Player
+	channel      *mediaplayer.Channel
+	pub          Publisher
+	topic        string
+	retain       bool
+	publishRaw   bool
+	publishState bool
+	recorder     *Recorder
+	pollInterval time.Duration
+	formats      []PayloadFormat
+	topicFunc    TopicFunc
+	// userProperties are attached to published messages
+	userProperties map[string]string
+	logger         *log.Entry
+	// traceAttributes are added to all spans
+	traceAttributes []attribute.KeyValue
+	counters        *Counters
+
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	currentApp  *cast.Application
+	// lastContentID is the content id of the last media status
+	lastContentID string
+	// errorSessionID is the last media session stopped on an error
+	errorSessionID int
+
+	// follow receives the span of a receiver status with a new application, Run connects to its transport
+	follow chan trace.SpanContext
+}
+
+// New creates a bridge for player, player may be nil if the bridge is only fed with Handle
+func New(player mediaplayer.Player, pub Publisher, topic string, opts ...Option) *Bridge {
+	b := Bridge{
+		player:       player,
+		pub:          pub,
+		topic:        topic,
+		pollInterval: defaultPollInterval,
+		publishState: true,
+		formats:      []PayloadFormat{DefaultPayloadFormat},
+		subscribers:  make(map[chan Event]struct{}),
+		logger:       log.NewEntry(log.StandardLogger()),
+		follow:       make(chan trace.SpanContext, 1),
+		counters:     NewCounters(),
+	}
+	for _, o := range opts {
+		o(&b)
+	}
+	return &b
+}
+
+// Subscribe returns a channel of bridge events and a function to stop the subscription. Events are dropped when
+// the channel buffer is full.
+func (b *Bridge) Subscribe(bufferSize int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := make(chan Event, bufferSize)
+	b.subscribers[sub] = struct{}{}
+	return sub, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[sub]; ok {
+			delete(b.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+func (b *Bridge) emit(evt Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		select {
+		case sub <- evt:
+		default:
+			b.logger.WithField("type", evt.EventType()).Warn("bridge subscriber too slow, drop event")
+		}
+	}
+}
+
+// Run listens device events until ctx is done or the cast channel fails
+func (b *Bridge) Run(ctx context.Context) error {
+	b.player.OnMessage(b.Handle)
+
+	if sub, ok := b.pub.(Subscriber); ok {
+		if err := sub.Subscribe(b.topicOf("refresh"), b.onRefreshCommand); err != nil {
+			return err
+		}
+		defer b.unsubscribe(b.topicOf("refresh"))
+		if b.channel != nil {
+			if err := sub.Subscribe(b.topicOf("cast/send"), b.onCastSendCommand); err != nil {
+				return err
+			}
+			defer b.unsubscribe(b.topicOf("cast/send"))
+		}
+	}
+
+	// Publish state without waiting for a change on the device
+	if err := b.Refresh(ctx); err != nil {
+		b.logger.Errorf("unable to publish initial state: %v", err)
+	}
+
+	var channelDone <-chan struct{}
+	if b.channel != nil {
+		channelDone = b.channel.Done()
+	}
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.logger.Infof("stop bridge: %v", ctx.Err())
+			return nil
+		case <-channelDone:
+			return fmt.Errorf("cast channel lost: %v", b.channel.Err())
+		case <-ticker.C:
+			if err := b.Refresh(ctx); err != nil {
+				b.logger.Errorf("unable to update application: %v", err)
+			}
+		case link := <-b.follow:
+			b.connectTransport(ctx, link)
+		}
+	}
+}
+
+func (b *Bridge) onRefreshCommand(msg Message) {
+	b.logger.WithField("topic", msg.Topic).Info("refresh requested")
+	ctx, span := StartCommand(context.Background(), msg, b.traceAttributes...)
+	// GET_STATUS waits for the device reply, don't block other messages
+	go func() {
+		err := b.Refresh(ctx)
+		if err != nil {
+			b.logger.Errorf("unable to refresh state: %v", err)
+		}
+		EndSpan(span, err)
+	}()
+}
+
+// startSpan starts a span child of ctx with the trace attributes of the bridge
+func (b *Bridge) startSpan(ctx context.Context, name string,
+	opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, append(opts, trace.WithAttributes(b.traceAttributes...))...)
+}
+
+// topicOf returns the topic of field
+func (b *Bridge) topicOf(field string) string {
+	if b.topicFunc != nil {
+		return b.topicFunc(field)
+	}
+	return b.topic + "/" + field
+}
+
+// properties returns the properties of a published message of eventType
+func (b *Bridge) properties(eventType string) MessageProperties {
+	props := make(map[string]string, len(b.userProperties)+1)
+	for k, v := range b.userProperties {
+		props[k] = v
+	}
+	props["event_type"] = eventType
+	return MessageProperties{UserProperties: props}
+}
+
+// publish sends an event of eventType to topic, in a span child of ctx
+func (b *Bridge) publish(ctx context.Context, topic, eventType string, retain bool, payload []byte) error {
+	return PublishMessage(ctx, b.pub, topic, retain, payload, b.properties(eventType))
+}
+
+func (b *Bridge) unsubscribe(topics ...string) {
+	unsub, ok := b.pub.(Unsubscriber)
+	if !ok {
+		return
+	}
+	if err := unsub.Unsubscribe(topics...); err != nil {
+		b.logger.Warnf("unable to unsubscribe: %v", err)
+	}
+}
+
+// Check requests the device status and emits a ConnectionChanged event
+func (b *Bridge) Check(ctx context.Context) error {
+	err := UpdateContext(ctx, b.player)
+	status := ConnectionChanged{Connected: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	b.emit(status)
+	return err
+}
+
+// Refresh requests receiver and media status of the device and publishes them, even if they didn't change
+func (b *Bridge) Refresh(ctx context.Context) (err error) {
+	ctx, span := b.startSpan(ctx, "bridge.refresh")
+	defer func() { EndSpan(span, err) }()
+
+	if err := b.Check(ctx); err != nil {
+		return err
+	}
+	app, media, volume := b.player.Status()
+	applications := make([]cast.Application, 0, 1)
+	if app != nil {
+		applications = append(applications, *app)
+	}
+	var vol cast.Volume
+	if volume != nil {
+		vol = *volume
+	}
+	b.onReceiverStatus(ctx, applications, vol)
+	if media != nil {
+		b.emit(MediaStatusChanged{Media: []cast.Media{*media}})
+	}
+	return nil
+}
+
+// Counters returns the counters of messages and errors of the bridge
+func (b *Bridge) Counters() *Counters {
+	return b.counters
+}
+
+// SetRawPublish enables or disables the publication of raw messages while the bridge runs
+func (b *Bridge) SetRawPublish(publishRaw bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishRaw = publishRaw
+}
+
+// Handle decodes a cast message and publishes resulting events
+func (b *Bridge) Handle(msg *api.CastMessage) {
+	if b.recorder != nil {
+		b.recorder.Record(msg)
+	}
+	if msg.GetPayloadType() != api.CastMessage_STRING {
+		return
+	}
+	ctx, span := b.startSpan(context.Background(), "cast.receive", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			AttrCastNamespace.String(msg.GetNamespace()),
+			AttrCastSource.String(msg.GetSourceId()),
+			AttrCastDestination.String(msg.GetDestinationId()),
+		))
+	defer span.End()
+	b.logger.WithFields(log.Fields{
+		"namespace": msg.GetNamespace(),
+		"raw_msg":   msg.String(),
+	}).Debug("new msg")
+	rawMsg := newRawMessage(msg)
+	b.counters.addMessage(rawMsg.Time)
+	b.emit(rawMsg)
+	b.mu.Lock()
+	publishRaw := b.publishRaw
+	b.mu.Unlock()
+	if publishRaw {
+		b.onRawMessage(ctx, rawMsg)
+	}
+
+	payload := msg.GetPayloadUtf8()
+	_, decodeSpan := b.startSpan(ctx, "cast.decode")
+	var raw map[string]interface{}
+	err := json.Unmarshal([]byte(payload), &raw)
+	if err != nil {
+		b.logger.Errorf("unable parse message %v: %v", payload, err)
+	}
+	EndSpan(decodeSpan, err)
+	span.SetAttributes(castType(raw["type"]))
+	if requestID, ok := raw["requestId"].(float64); ok && requestID != 0 {
+		span.SetAttributes(AttrCastRequestID.Int(int(requestID)))
+	}
+
+	switch {
+	case raw["type"] == "MEDIA_STATUS":
+		b.onMediaStatusEvent(ctx, msg.GetNamespace(), payload)
+	case raw["type"] == "RECEIVER_STATUS":
+		b.onReceiverStatusEvent(ctx, &payload)
+	case isErrorType(raw["type"]):
+		b.onErrorEvent(ctx, msg.GetNamespace(), payload)
+	default:
+		b.logger.WithFields(log.Fields{
+			"namespace": msg.GetNamespace(),
+			"type":      raw["type"],
+		}).Infof("unmanaged even: %v", payload)
+	}
+}
+
+func (b *Bridge) onRawMessage(ctx context.Context, msg RawMessage) {
+	rawTopic := b.topicOf("raw/" + msg.Namespace)
+	content, err := json.Marshal(msg)
+	if err != nil {
+		b.logger.Errorf("unable to marshal raw message: %v", err)
+		return
+	}
+	b.logger.WithFields(log.Fields{
+		"topic": rawTopic,
+	}).Debug("publish raw message")
+	// Raw messages are events, never retain them
+	if err := b.publish(ctx, rawTopic, EventTypeRawMessage, false, content); err != nil {
+		b.logger.Errorf("unable to publish raw message: %v", err)
+	}
+}
+
+func (b *Bridge) onMediaStatusEvent(ctx context.Context, namespace, msg string) {
+	b.logger.WithField("type", "MEDIA_STATUS").Debugf("new media status event: %v", msg)
+	ctx, span := b.startSpan(ctx, "bridge.media_status")
+	defer span.End()
+
+	var response cast.MediaStatusResponse
+	if err := json.Unmarshal([]byte(msg), &response); err != nil {
+		b.logger.WithField("type", "MEDIA_STATUS").Errorf("unable to unmarshal json response: %v", err)
+		recordError(span, err)
+		return
+	}
+	// Media information is only sent when it changes
+	for _, m := range response.Status {
+		if m.Media.ContentId != "" {
+			b.mu.Lock()
+			b.lastContentID = m.Media.ContentId
+			b.mu.Unlock()
+		}
+	}
+	b.emit(MediaStatusChanged{Media: response.Status})
+	b.onMediaErrors(ctx, namespace, response.Status)
+}
+
+func (b *Bridge) onReceiverStatusEvent(ctx context.Context, msg *string) {
+	logr := b.logger.WithField("type", "RECEIVER_STATUS")
+	ctx, span := b.startSpan(ctx, "bridge.receiver_status")
+	defer span.End()
+
+	logr.WithFields(log.Fields{
+		"payload": msg,
+	}).Debug("new payload")
+
+	var response cast.ReceiverStatusResponse
+	err := json.Unmarshal([]byte(*msg), &response)
+	if err != nil {
+		logr.Errorf("unable to marshal json response: %v", err)
+		recordError(span, err)
+	}
+	if b.onReceiverStatus(ctx, response.Status.Applications, response.Status.Volume) {
+		b.followTransport(ctx, response.Status.Applications)
+	}
+}
+
+// onReceiverStatus emits receiver events and publishes volume and mute, it returns true if the running application
+// changed
+func (b *Bridge) onReceiverStatus(ctx context.Context, applications []cast.Application, volume cast.Volume) bool {
+	logr := b.logger.WithField("type", "RECEIVER_STATUS")
+
+	b.emit(ReceiverStatusChanged{Applications: applications, Volume: volume})
+	appChanged := b.updateApp(applications)
+
+	b.emit(VolumeChanged{Volume: int(100 * volume.Level), Muted: volume.Muted})
+	if !b.publishState {
+		return appChanged
+	}
+
+	for _, f := range b.formats {
+		volumeTopic := b.topicOf(f.field("volume"))
+		vol := f.FormatVolume(volume.Level)
+		logr.WithFields(log.Fields{
+			"topic":  volumeTopic,
+			"volume": string(vol),
+		}).Info("publish volume event")
+		if err := b.publish(ctx, volumeTopic, EventTypeVolume, b.retain, vol); err != nil {
+			logr.Errorf("unable to publish volume event: %v", err)
+		}
+
+		muteTopic := b.topicOf(f.field("mute"))
+		mute := f.FormatBoolean(volume.Muted)
+		logr.WithFields(log.Fields{
+			"topic": muteTopic,
+			"mute":  string(mute),
+		}).Info("publish mute event")
+		if err := b.publish(ctx, muteTopic, EventTypeMute, b.retain, mute); err != nil {
+			logr.Errorf("unable to publish mute event: %v", err)
+		}
+	}
+	return appChanged
+}
+
+// updateApp emits an AppChanged event if the running application is not the same as previous status
+func (b *Bridge) updateApp(applications []cast.Application) bool {
+	var current *cast.Application
+	for i := range applications {
+		current = &applications[i]
+	}
+
+	b.mu.Lock()
+	previous := b.currentApp
+	b.currentApp = current
+	b.mu.Unlock()
+
+	switch {
+	case previous == nil && current == nil:
+		return false
+	case previous != nil && current != nil && previous.AppId == current.AppId && previous.SessionId == current.SessionId:
+		return false
+	}
+	b.emit(AppChanged{Application: current})
+	return true
+}
+
+// followTransport asks Run to connect to the transport of the running application and request its media status.
+// Media status is only sent to senders connected to the transport, and the player only connects on update, so
+// applications launched by another sender (Spotify, YouTube, ...) would stay silent until next poll.
+func (b *Bridge) followTransport(ctx context.Context, applications []cast.Application) {
+	var current *cast.Application
+	for i := range applications {
+		current = &applications[i]
+	}
+	if b.player == nil || current == nil || current.IsIdleScreen || current.TransportId == "" {
+		return
+	}
+	logr := b.logger.WithFields(log.Fields{
+		"app_id":       current.AppId,
+		"transport_id": current.TransportId,
+	})
+	logr.Info("follow application transport")
+	// Update waits for device replies, which are delivered to Handle, don't block it. A pending request already
+	// updates the last application.
+	select {
+	case b.follow <- trace.SpanContextFromContext(ctx):
+	default:
+	}
+}
+
+// connectTransport requests the device status, the player connects to the transport of the running application
+func (b *Bridge) connectTransport(ctx context.Context, link trace.SpanContext) {
+	ctx, span := b.startSpan(ctx, "bridge.follow_transport", trace.WithLinks(trace.Link{SpanContext: link}))
+	defer span.End()
+	if err := UpdateContext(ctx, b.player); err != nil {
+		b.logger.Warnf("unable to connect to application transport: %v", err)
+		recordError(span, err)
+	}
+}
@@ -0,0 +1,129 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/mediaplayer"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"time"
+)
+
+const (
+	castReplyTimeout = 10 * time.Second
+
+	destinationReceiver  = "receiver"
+	destinationTransport = "transport"
+)
+
+type castSendRequest struct {
+	ID          string          `json:"id,omitempty"`
+	Namespace   string          `json:"namespace"`
+	Destination string          `json:"destination"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+type castSendResponse struct {
+	ID        string          `json:"id,omitempty"`
+	RequestID int             `json:"request_id,omitempty"`
+	Namespace string          `json:"namespace,omitempty"`
+	Source    string          `json:"source,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+func (b *Bridge) onCastSendCommand(msg Message) {
+	// MQTT v5 requests choose their response topic
+	responseTopic := msg.ResponseTopic
+	if responseTopic == "" {
+		responseTopic = b.topicOf("cast/response")
+	}
+	logc := b.logger.WithField("topic", msg.Topic)
+	ctx, span := StartCommand(context.Background(), msg, b.traceAttributes...)
+
+	// publishResponse ends the span of the command
+	publishResponse := func(resp castSendResponse) {
+		defer span.End()
+		if resp.Error != "" {
+			span.SetStatus(codes.Error, resp.Error)
+		}
+		content, err := json.Marshal(resp)
+		if err != nil {
+			logc.Errorf("unable to marshal cast response: %v", err)
+			return
+		}
+		props := b.properties(EventTypeCastResponse)
+		props.CorrelationData = msg.CorrelationData
+		if err := PublishMessage(ctx, b.pub, responseTopic, false, content, props); err != nil {
+			logc.Errorf("unable to publish cast response: %v", err)
+		}
+	}
+
+	var req castSendRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		logc.Errorf("invalid cast send command: %v", err)
+		publishResponse(castSendResponse{Error: fmt.Sprintf("invalid command: %v", err)})
+		return
+	}
+	logc = logc.WithFields(log.Fields{
+		"id":          req.ID,
+		"namespace":   req.Namespace,
+		"destination": req.Destination,
+	})
+
+	destination, err := resolveDestination(b.player, req.Destination)
+	if err != nil {
+		logc.Errorf("unable to send cast message: %v", err)
+		publishResponse(castSendResponse{ID: req.ID, Error: err.Error()})
+		return
+	}
+	payload, err := mediaplayer.ParseRawPayload(req.Payload)
+	if err != nil {
+		logc.Errorf("unable to send cast message: %v", err)
+		publishResponse(castSendResponse{ID: req.ID, Error: err.Error()})
+		return
+	}
+
+	logc.Info("send cast message")
+	// Wait the reply outside of the mqtt callback to not block other messages
+	go func() {
+		requestCtx, cancel := context.WithTimeout(ctx, castReplyTimeout)
+		defer cancel()
+		requestCtx, requestSpan := StartCastRequest(requestCtx,
+			AttrCastNamespace.String(req.Namespace),
+			AttrCastDestination.String(destination),
+		)
+		reply, err := b.channel.SendAndWait(requestCtx, req.Namespace, destination, payload)
+		requestSpan.SetAttributes(AttrCastRequestID.Int(payload.RequestID()))
+		EndSpan(requestSpan, err)
+		if err != nil {
+			logc.Warnf("no reply to cast message: %v", err)
+			publishResponse(castSendResponse{ID: req.ID, RequestID: payload.RequestID(), Error: err.Error()})
+			return
+		}
+		publishResponse(castSendResponse{
+			ID:        req.ID,
+			RequestID: payload.RequestID(),
+			Namespace: reply.GetNamespace(),
+			Source:    reply.GetSourceId(),
+			Payload:   json.RawMessage(reply.GetPayloadUtf8()),
+		})
+	}()
+}
+
+// resolveDestination converts destination aliases to cast destination ids
+func resolveDestination(player mediaplayer.Player, destination string) (string, error) {
+	switch destination {
+	case "", destinationReceiver:
+		return mediaplayer.DestinationReceiver, nil
+	case destinationTransport:
+		castApp, _, _ := player.Status()
+		if castApp == nil || castApp.TransportId == "" {
+			return "", fmt.Errorf("no running application with transport on device")
+		}
+		return castApp.TransportId, nil
+	default:
+		return destination, nil
+	}
+}
@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/mediaplayer"
+)
+
+// ControlRequest is a command to apply on a device
+type ControlRequest struct {
+	Action      string  `json:"action"`
+	Value       float32 `json:"value"`
+	ContentID   string  `json:"content_id,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+}
+
+// Control applies req on player
+func Control(player mediaplayer.Player, req ControlRequest) error {
+	switch req.Action {
+	case "play":
+		return player.Play()
+	case "pause":
+		return player.Pause()
+	case "stop":
+		return player.Stop()
+	case "next":
+		return player.Next()
+	case "previous":
+		return player.Previous()
+	case "seek":
+		return player.Seek(req.Value)
+	case "volume":
+		if req.Value < 0 || req.Value > 100 {
+			return fmt.Errorf("invalid volume %v, must be between 0 and 100", req.Value)
+		}
+		return player.SetVolume(req.Value / 100)
+	case "mute":
+		return player.SetMuted(true)
+	case "unmute":
+		return player.SetMuted(false)
+	case "load":
+		return player.Load(req.ContentID, req.ContentType)
+	default:
+		return fmt.Errorf("unknown action %q", req.Action)
+	}
+}
+
+// ControlContext applies req on player in a span child of ctx, the span ends on the device reply. It returns when
+// ctx is done, the request is not aborted.
+func ControlContext(ctx context.Context, player mediaplayer.Player, req ControlRequest) error {
+	_, span := StartCastRequest(ctx, AttrCastAction.String(req.Action))
+	err := callContext(ctx, func() error { return Control(player, req) })
+	EndSpan(span, err)
+	return err
+}
+
+// UpdateContext requests the device status in a span child of ctx, the span ends on the device reply. It returns
+// when ctx is done, the request is not aborted.
+func UpdateContext(ctx context.Context, player mediaplayer.Player) error {
+	_, span := StartCastRequest(ctx, AttrCastType.String("GET_STATUS"))
+	err := callContext(ctx, player.Update)
+	EndSpan(span, err)
+	return err
+}
+
+// callContext runs call until it returns or ctx is done, player calls can't be cancelled
+func callContext(ctx context.Context, call func() error) error {
+	if ctx.Done() == nil {
+		return call()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("no reply of device: %w", ctx.Err())
+	}
+}
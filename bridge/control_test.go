@@ -0,0 +1,27 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCallContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	err := callContext(ctx, func() error {
+		<-blocked
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("call without reply not stopped on timeout: %v", err)
+	}
+
+	failure := errors.New("failure")
+	if err := callContext(context.Background(), func() error { return failure }); err != failure {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package bridge
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters count cast messages and device errors. They are updated by the bridge before events are emitted, so they
+// don't miss events dropped by slow subscribers, and may be shared by successive bridges of a device.
+type Counters struct {
+	messages atomic.Uint64
+	// lastMessage is in unix nanoseconds, 0 before the first message
+	lastMessage atomic.Int64
+	// errors are *atomic.Uint64 by error type
+	errors sync.Map
+}
+
+func NewCounters() *Counters {
+	return &Counters{}
+}
+
+// Messages returns the number of cast messages received
+func (c *Counters) Messages() uint64 {
+	return c.messages.Load()
+}
+
+// LastMessage returns the time of the last cast message received, zero if none
+func (c *Counters) LastMessage() time.Time {
+	last := c.lastMessage.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// Errors returns the number of device errors by type
+func (c *Counters) Errors() map[string]uint64 {
+	errs := make(map[string]uint64)
+	c.errors.Range(func(key, value interface{}) bool {
+		errs[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return errs
+}
+
+func (c *Counters) addMessage(t time.Time) {
+	c.messages.Add(1)
+	c.lastMessage.Store(t.UnixNano())
+}
+
+func (c *Counters) addError(errorType string) {
+	counter, ok := c.errors.Load(errorType)
+	if !ok {
+		counter, _ = c.errors.LoadOrStore(errorType, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
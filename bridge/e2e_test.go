@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"context"
+	"github.com/cyrilix/chromecast2mqt/castsim"
+	"github.com/cyrilix/chromecast2mqt/mediaplayer"
+	"github.com/vishen/go-chromecast/cast"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitPublished waits for payloads of topic to end with expected
+func waitPublished(t *testing.T, pub *recordPublisher, topic string, expected ...string) {
+	t.Helper()
+	var payloads []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		payloads = pub.published(topic)
+		if len(payloads) >= len(expected) && reflect.DeepEqual(payloads[len(payloads)-len(expected):], expected) {
+			return
+		}
+	}
+	t.Fatalf("topic %v: published %v, expected %v", topic, payloads, expected)
+}
+
+func TestBridge_EndToEnd(t *testing.T) {
+	if raceEnabled {
+		// go-chromecast reads pending requests without lock, see mediaplayer tests
+		t.Skip("go-chromecast is not race free")
+	}
+
+	server := castsim.NewServer(castsim.WithDevice("Living Room TV", "uuid-1", "Chromecast"))
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start simulator: %v", err)
+	}
+	defer server.Close()
+	if err := server.SetVolume(0.5, false); err != nil {
+		t.Fatalf("unable to set volume: %v", err)
+	}
+
+	player, err := mediaplayer.Connect(mediaplayer.CachedDNSEntry{Addr: server.Addr(), Port: server.Port()})
+	if err != nil {
+		t.Fatalf("unable to connect to simulator: %v", err)
+	}
+	defer player.Close()
+
+	topics, err := ParseTopicTemplate("home/{{.Room}}/{{.Name}}")
+	if err != nil {
+		t.Fatalf("invalid topic template: %v", err)
+	}
+	topicFunc, err := topics.Func(TopicData{ID: "tv", Name: "TV", Room: "Living Room"})
+	if err != nil {
+		t.Fatalf("invalid topics: %v", err)
+	}
+	pub := recordPublisher{}
+	b := New(player, &pub, "home/living-room/tv",
+		WithTopicFunc(topicFunc),
+		WithRetain(true),
+		WithPayloadFormats(DefaultPayloadFormat, PayloadFormat{Subtopic: "v2", Boolean: BooleanTrueFalse, Volume: VolumeRatio}),
+		WithRawPublish(true),
+	)
+	events, unsubscribe := b.Subscribe(64)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("bridge failed: %v", err)
+		}
+	}()
+
+	// Initial state
+	waitPublished(t, &pub, "home/living-room/tv/volume", "50")
+	waitPublished(t, &pub, "home/living-room/tv/mute", "OFF")
+	waitPublished(t, &pub, "home/living-room/tv/v2/volume", "0.5")
+	waitPublished(t, &pub, "home/living-room/tv/v2/mute", "false")
+
+	// Change from another sender
+	if err := server.SetVolume(0.3, true); err != nil {
+		t.Fatalf("unable to set volume: %v", err)
+	}
+	waitPublished(t, &pub, "home/living-room/tv/volume", "30")
+	waitPublished(t, &pub, "home/living-room/tv/mute", "ON")
+	waitPublished(t, &pub, "home/living-room/tv/v2/mute", "true")
+
+	// Control through the player
+	if err := Control(player, ControlRequest{Action: "volume", Value: 80}); err != nil {
+		t.Fatalf("unable to set volume: %v", err)
+	}
+	waitPublished(t, &pub, "home/living-room/tv/volume", "80")
+
+	if len(pub.published("home/living-room/tv/raw/"+castsim.NamespaceReceiver)) == 0 {
+		t.Errorf("raw receiver messages not published")
+	}
+	pub.mu.Lock()
+	for _, m := range pub.messages {
+		// Raw messages are events, only state is retained
+		if raw := strings.Contains(m.topic, "/raw/"); m.retain == raw {
+			t.Errorf("message of %v has retain %v", m.topic, m.retain)
+		}
+	}
+	pub.mu.Unlock()
+
+	// Media of an application launched by another sender
+	if err := server.SetApplication(cast.Application{AppId: "CC1AD845", DisplayName: "Default Media Receiver"}); err != nil {
+		t.Fatalf("unable to start application: %v", err)
+	}
+	if err := server.SetMedia(cast.Media{PlayerState: "PLAYING",
+		Media: cast.MediaItem{ContentId: "http://media/song.mp3", Metadata: cast.MediaMetadata{Title: "Song"}}}); err != nil {
+		t.Fatalf("unable to set media: %v", err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case evt := <-events:
+			if m, ok := evt.(MediaStatusChanged); ok && len(m.Media) > 0 && m.Media[0].Media.Metadata.Title == "Song" {
+				if messages := b.Counters().Messages(); messages == 0 {
+					t.Errorf("messages not counted")
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("media status not received")
+		}
+	}
+}
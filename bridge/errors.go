@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	"strconv"
+	"time"
+)
+
+// idleReasonError is the idleReason of a MEDIA_STATUS when the media stopped on an error
+const idleReasonError = "ERROR"
+
+// castErrorMessage is a cast message reporting a failure
+type castErrorMessage struct {
+	Type              string `json:"type"`
+	RequestID         int    `json:"requestId"`
+	Reason            string `json:"reason"`
+	DetailedErrorCode int    `json:"detailedErrorCode"`
+}
+
+func isErrorType(msgType interface{}) bool {
+	switch msgType {
+	case "LOAD_FAILED", "LOAD_CANCELLED", "INVALID_REQUEST", "INVALID_PLAYER_STATE", "CLOSE":
+		return true
+	}
+	return false
+}
+
+func (b *Bridge) onErrorEvent(ctx context.Context, namespace, payload string) {
+	ctx, span := b.startSpan(ctx, "bridge.error")
+	defer span.End()
+
+	var msg castErrorMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		b.logger.WithField("namespace", namespace).Errorf("unable to unmarshal error message: %v", err)
+		recordError(span, err)
+		return
+	}
+	reason := msg.Reason
+	if reason == "" && msg.DetailedErrorCode != 0 {
+		reason = "detailed error code " + strconv.Itoa(msg.DetailedErrorCode)
+	}
+	b.onError(ctx, DeviceError{
+		Time:      time.Now(),
+		Type:      msg.Type,
+		Reason:    reason,
+		RequestID: msg.RequestID,
+		Namespace: namespace,
+		ContentID: b.contentID(),
+	})
+}
+
+// onMediaErrors publishes an error for each media session stopped on an error, status requests repeat the idle
+// reason so a session is reported once
+func (b *Bridge) onMediaErrors(ctx context.Context, namespace string, media []cast.Media) {
+	for _, m := range media {
+		if m.IdleReason != idleReasonError {
+			continue
+		}
+		b.mu.Lock()
+		reported := b.errorSessionID == m.MediaSessionId
+		b.errorSessionID = m.MediaSessionId
+		b.mu.Unlock()
+		if reported {
+			continue
+		}
+		contentID := m.Media.ContentId
+		if contentID == "" {
+			contentID = b.contentID()
+		}
+		b.onError(ctx, DeviceError{
+			Time:      time.Now(),
+			Type:      "MEDIA_STATUS",
+			Reason:    m.IdleReason,
+			Namespace: namespace,
+			ContentID: contentID,
+		})
+	}
+}
+
+// contentID returns the last content id sent by the device
+func (b *Bridge) contentID() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastContentID
+}
+
+func (b *Bridge) onError(ctx context.Context, evt DeviceError) {
+	errorTopic := b.topicOf("error")
+	logr := b.logger.WithFields(log.Fields{
+		"topic":      errorTopic,
+		"type":       evt.Type,
+		"reason":     evt.Reason,
+		"request_id": evt.RequestID,
+		"content_id": evt.ContentID,
+	})
+	logr.Warn("device error")
+	b.counters.addError(evt.Type)
+	b.emit(evt)
+
+	content, err := json.Marshal(evt)
+	if err != nil {
+		logr.Errorf("unable to marshal device error: %v", err)
+		return
+	}
+	// Errors are events, never retain them
+	if err := b.publish(ctx, errorTopic, EventTypeError, false, content); err != nil {
+		logr.Errorf("unable to publish device error: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"github.com/vishen/go-chromecast/cast"
+	"github.com/vishen/go-chromecast/cast/proto"
+	"time"
+)
+
+const (
+	EventTypeReceiverStatus = "receiver_status"
+	EventTypeMediaStatus    = "media_status"
+	EventTypeVolume         = "volume"
+	EventTypeApp            = "app"
+	EventTypeConnection     = "connection"
+	EventTypeRawMessage     = "raw_message"
+	EventTypeError          = "error"
+	// EventTypeMute and EventTypeCastResponse are only used as properties of published messages
+	EventTypeMute         = "mute"
+	EventTypeCastResponse = "cast_response"
+)
+
+// Event is emitted by the bridge to its subscribers
+type Event interface {
+	EventType() string
+}
+
+// ReceiverStatusChanged is emitted on each RECEIVER_STATUS message
+type ReceiverStatusChanged struct {
+	Applications []cast.Application `json:"applications"`
+	Volume       cast.Volume        `json:"volume"`
+}
+
+func (ReceiverStatusChanged) EventType() string { return EventTypeReceiverStatus }
+
+// VolumeChanged is emitted on each RECEIVER_STATUS message, volume is between 0 and 100
+type VolumeChanged struct {
+	Volume int  `json:"volume"`
+	Muted  bool `json:"muted"`
+}
+
+func (VolumeChanged) EventType() string { return EventTypeVolume }
+
+// AppChanged is emitted when the running application changes, Application is nil when no application runs
+type AppChanged struct {
+	Application *cast.Application `json:"application"`
+}
+
+func (AppChanged) EventType() string { return EventTypeApp }
+
+// MediaStatusChanged is emitted on each MEDIA_STATUS message
+type MediaStatusChanged struct {
+	Media []cast.Media `json:"media"`
+}
+
+func (MediaStatusChanged) EventType() string { return EventTypeMediaStatus }
+
+// ConnectionChanged is emitted after each device status check
+type ConnectionChanged struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (ConnectionChanged) EventType() string { return EventTypeConnection }
+
+// DeviceError is emitted when the device reports a failure, ContentID is the last media known when the message
+// doesn't carry it
+type DeviceError struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Reason    string    `json:"reason,omitempty"`
+	RequestID int       `json:"request_id,omitempty"`
+	Namespace string    `json:"namespace"`
+	ContentID string    `json:"content_id,omitempty"`
+}
+
+func (DeviceError) EventType() string { return EventTypeError }
+
+// RawMessage is emitted for each STRING cast message received
+type RawMessage struct {
+	Time        time.Time `json:"time"`
+	Namespace   string    `json:"namespace"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Payload     string    `json:"payload"`
+}
+
+func (RawMessage) EventType() string { return EventTypeRawMessage }
+
+func newRawMessage(msg *api.CastMessage) RawMessage {
+	return RawMessage{
+		Time:        time.Now(),
+		Namespace:   msg.GetNamespace(),
+		Source:      msg.GetSourceId(),
+		Destination: msg.GetDestinationId(),
+		Payload:     msg.GetPayloadUtf8(),
+	}
+}
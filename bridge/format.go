@@ -0,0 +1,127 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// BooleanFormat is the payload of boolean values like mute
+type BooleanFormat string
+
+const (
+	BooleanOnOff     BooleanFormat = "on_off"
+	BooleanTrueFalse BooleanFormat = "true_false"
+	BooleanOneZero   BooleanFormat = "one_zero"
+)
+
+// VolumeFormat is the payload of volume levels
+type VolumeFormat string
+
+const (
+	// VolumePercent is an integer between 0 and 100
+	VolumePercent VolumeFormat = "percent"
+	// VolumeRatio is a float between 0 and 1
+	VolumeRatio VolumeFormat = "ratio"
+	// VolumeDecibel is 20*log10(level), between minVolumeDecibel and 0
+	VolumeDecibel VolumeFormat = "db"
+)
+
+const minVolumeDecibel = -60.0
+
+// PayloadFormat is a schema of published values
+type PayloadFormat struct {
+	// Subtopic inserted between the device topic and value topic, ex: <topic>/<subtopic>/volume. Empty for the
+	// default schema.
+	Subtopic string
+	Boolean  BooleanFormat
+	Volume   VolumeFormat
+	// JSON wraps values in a json object with unit and timestamp
+	JSON bool
+}
+
+// DefaultPayloadFormat keeps the historical ON/OFF and 0-100 payloads
+var DefaultPayloadFormat = PayloadFormat{Boolean: BooleanOnOff, Volume: VolumePercent}
+
+func ParseBooleanFormat(value string) (BooleanFormat, error) {
+	switch f := BooleanFormat(value); f {
+	case BooleanOnOff, BooleanTrueFalse, BooleanOneZero:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid boolean format %q, must be on_off, true_false or one_zero", value)
+}
+
+func ParseVolumeFormat(value string) (VolumeFormat, error) {
+	switch f := VolumeFormat(value); f {
+	case VolumePercent, VolumeRatio, VolumeDecibel:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid volume format %q, must be percent, ratio or db", value)
+}
+
+type wrappedValue struct {
+	Value     interface{} `json:"value"`
+	Unit      string      `json:"unit,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// field returns the topic field of value name
+func (f PayloadFormat) field(name string) string {
+	if f.Subtopic == "" {
+		return name
+	}
+	return f.Subtopic + "/" + name
+}
+
+// FormatBoolean encodes value
+func (f PayloadFormat) FormatBoolean(value bool) []byte {
+	var v interface{}
+	switch f.Boolean {
+	case BooleanTrueFalse:
+		v = value
+	case BooleanOneZero:
+		v = 0
+		if value {
+			v = 1
+		}
+	default:
+		v = "OFF"
+		if value {
+			v = "ON"
+		}
+	}
+	return f.encode(v, "")
+}
+
+// FormatVolume encodes level, between 0 and 1
+func (f PayloadFormat) FormatVolume(level float32) []byte {
+	switch f.Volume {
+	case VolumeRatio:
+		return f.encode(math.Round(float64(level)*1000)/1000, "")
+	case VolumeDecibel:
+		db := minVolumeDecibel
+		if level > 0 {
+			db = math.Max(minVolumeDecibel, 20*math.Log10(float64(level)))
+		}
+		return f.encode(math.Round(db*10)/10, "dB")
+	default:
+		return f.encode(int(100*level), "%")
+	}
+}
+
+func (f PayloadFormat) encode(value interface{}, unit string) []byte {
+	if !f.JSON {
+		switch v := value.(type) {
+		case string:
+			return []byte(v)
+		case float64:
+			return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			return []byte(fmt.Sprint(v))
+		}
+	}
+	content, _ := json.Marshal(wrappedValue{Value: value, Unit: unit, Timestamp: time.Now()})
+	return content
+}
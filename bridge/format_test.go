@@ -0,0 +1,98 @@
+package bridge
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPayloadFormat_FormatBoolean(t *testing.T) {
+	tests := []struct {
+		format  BooleanFormat
+		on, off string
+	}{
+		{BooleanOnOff, "ON", "OFF"},
+		{"", "ON", "OFF"},
+		{BooleanTrueFalse, "true", "false"},
+		{BooleanOneZero, "1", "0"},
+	}
+	for _, tt := range tests {
+		f := PayloadFormat{Boolean: tt.format}
+		if v := string(f.FormatBoolean(true)); v != tt.on {
+			t.Errorf("format %q: true formatted as %q", tt.format, v)
+		}
+		if v := string(f.FormatBoolean(false)); v != tt.off {
+			t.Errorf("format %q: false formatted as %q", tt.format, v)
+		}
+	}
+}
+
+func TestPayloadFormat_FormatVolume(t *testing.T) {
+	tests := []struct {
+		format   VolumeFormat
+		level    float32
+		expected string
+	}{
+		{VolumePercent, 0.42, "42"},
+		{"", 1, "100"},
+		{VolumeRatio, 0.4567, "0.457"},
+		{VolumeRatio, 0, "0"},
+		{VolumeDecibel, 1, "0"},
+		{VolumeDecibel, 0.5, "-6"},
+		{VolumeDecibel, 0, "-60"},
+		{VolumeDecibel, 0.0001, "-60"},
+	}
+	for _, tt := range tests {
+		f := PayloadFormat{Volume: tt.format}
+		if v := string(f.FormatVolume(tt.level)); v != tt.expected {
+			t.Errorf("format %q: volume %v formatted as %q, expected %q", tt.format, tt.level, v, tt.expected)
+		}
+	}
+}
+
+func TestPayloadFormat_JSON(t *testing.T) {
+	f := PayloadFormat{Boolean: BooleanTrueFalse, Volume: VolumeDecibel, JSON: true}
+
+	var volume wrappedValue
+	if err := json.Unmarshal(f.FormatVolume(0.5), &volume); err != nil {
+		t.Fatalf("invalid json volume: %v", err)
+	}
+	if volume.Value != -6.0 || volume.Unit != "dB" || volume.Timestamp.IsZero() {
+		t.Errorf("unexpected json volume %+v", volume)
+	}
+
+	var mute wrappedValue
+	if err := json.Unmarshal(f.FormatBoolean(true), &mute); err != nil {
+		t.Fatalf("invalid json mute: %v", err)
+	}
+	if mute.Value != true || mute.Unit != "" {
+		t.Errorf("unexpected json mute %+v", mute)
+	}
+}
+
+func TestPayloadFormat_Field(t *testing.T) {
+	if field := DefaultPayloadFormat.field("volume"); field != "volume" {
+		t.Errorf("default field %q", field)
+	}
+	if field := (PayloadFormat{Subtopic: "json"}).field("volume"); field != "json/volume" {
+		t.Errorf("subtopic field %q", field)
+	}
+}
+
+func TestParseFormats(t *testing.T) {
+	for _, v := range []string{"on_off", "true_false", "one_zero"} {
+		if f, err := ParseBooleanFormat(v); err != nil || string(f) != v {
+			t.Errorf("boolean format %q parsed as %q: %v", v, f, err)
+		}
+	}
+	if _, err := ParseBooleanFormat("yes_no"); err == nil {
+		t.Errorf("invalid boolean format accepted")
+	}
+	for _, v := range []string{"percent", "ratio", "db"} {
+		if f, err := ParseVolumeFormat(v); err != nil || string(f) != v {
+			t.Errorf("volume format %q parsed as %q: %v", v, f, err)
+		}
+	}
+	if _, err := ParseVolumeFormat("dbm"); err == nil {
+		t.Errorf("invalid volume format accepted")
+	}
+}
@@ -0,0 +1,345 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/mediaplayer"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	HomieVersion = "4.0"
+	// DefaultHomieBase is the base topic of Homie devices
+	DefaultHomieBase = "homie"
+)
+
+// HomieState is the lifecycle of a Homie device
+type HomieState string
+
+const (
+	HomieInit         HomieState = "init"
+	HomieReady        HomieState = "ready"
+	HomieDisconnected HomieState = "disconnected"
+	HomieLost         HomieState = "lost"
+)
+
+type homieProperty struct {
+	id       string
+	name     string
+	datatype string
+	format   string
+	unit     string
+	// retained is false for commands
+	retained bool
+	// set converts a value of the <property>/set topic to a control request, nil if the property isn't settable
+	set func(value string) (ControlRequest, error)
+}
+
+type homieNode struct {
+	id         string
+	name       string
+	typ        string
+	properties []homieProperty
+}
+
+var homieNodes = []homieNode{
+	{
+		id:   "receiver",
+		name: "Receiver",
+		typ:  "Chromecast receiver",
+		properties: []homieProperty{
+			{id: "volume", name: "Volume", datatype: "integer", format: "0:100", unit: "%", retained: true,
+				set: func(value string) (ControlRequest, error) {
+					v, err := strconv.Atoi(value)
+					if err != nil {
+						return ControlRequest{}, fmt.Errorf("invalid integer %q", value)
+					}
+					return ControlRequest{Action: "volume", Value: float32(v)}, nil
+				}},
+			{id: "mute", name: "Mute", datatype: "boolean", retained: true,
+				set: func(value string) (ControlRequest, error) {
+					switch value {
+					case "true":
+						return ControlRequest{Action: "mute"}, nil
+					case "false":
+						return ControlRequest{Action: "unmute"}, nil
+					}
+					return ControlRequest{}, fmt.Errorf("invalid boolean %q", value)
+				}},
+		},
+	},
+	{
+		id:   "media",
+		name: "Media",
+		typ:  "Media session",
+		properties: []homieProperty{
+			{id: "state", name: "Player state", datatype: "enum", format: "IDLE,BUFFERING,PLAYING,PAUSED", retained: true},
+			{id: "title", name: "Title", datatype: "string", retained: true},
+			{id: "artist", name: "Artist", datatype: "string", retained: true},
+			{id: "content-id", name: "Content", datatype: "string", retained: true,
+				set: func(value string) (ControlRequest, error) {
+					return ControlRequest{Action: "load", ContentID: value}, nil
+				}},
+			{id: "position", name: "Position", datatype: "float", unit: "s", retained: true,
+				set: func(value string) (ControlRequest, error) {
+					v, err := strconv.ParseFloat(value, 32)
+					if err != nil {
+						return ControlRequest{}, fmt.Errorf("invalid float %q", value)
+					}
+					return ControlRequest{Action: "seek", Value: float32(v)}, nil
+				}},
+			{id: "duration", name: "Duration", datatype: "float", unit: "s", retained: true},
+			{id: "command", name: "Command", datatype: "enum", format: "play,pause,stop,next,previous",
+				set: func(value string) (ControlRequest, error) {
+					switch value {
+					case "play", "pause", "stop", "next", "previous":
+						return ControlRequest{Action: value}, nil
+					}
+					return ControlRequest{}, fmt.Errorf("invalid command %q", value)
+				}},
+		},
+	},
+	{
+		id:   "app",
+		name: "Application",
+		typ:  "Cast application",
+		properties: []homieProperty{
+			{id: "id", name: "Application id", datatype: "string", retained: true},
+			{id: "name", name: "Application name", datatype: "string", retained: true},
+			{id: "status", name: "Status", datatype: "string", retained: true},
+		},
+	},
+}
+
+var invalidHomieChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// HomieID converts name to a valid Homie id, lower case letters, digits and '-'
+func HomieID(name string) string {
+	return strings.Trim(invalidHomieChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// HomieDevice publishes a chromecast following the Homie 4 convention under <base>/<id>, settable properties are
+// applied to the player
+type HomieDevice struct {
+	pub    Publisher
+	topic  string
+	logger *log.Entry
+
+	mu     sync.Mutex
+	player mediaplayer.Player
+	// state is the last published $state, empty before the first one
+	state HomieState
+}
+
+// NewHomieDevice creates the Homie device id, see HomieID, logger adds device fields to logs
+func NewHomieDevice(pub Publisher, base, id string, logger *log.Entry) *HomieDevice {
+	return &HomieDevice{
+		pub:    pub,
+		topic:  base + "/" + id,
+		logger: logger,
+	}
+}
+
+// HomieStateTopic returns the $state topic of the Homie device id, the last will of the mqtt connection should
+// publish HomieLost on it
+func HomieStateTopic(base, id string) string {
+	return base + "/" + id + "/$state"
+}
+
+func (h *HomieDevice) publish(topic string, retain bool, value string) {
+	if err := h.pub.Publish(h.topic+"/"+topic, retain, []byte(value)); err != nil {
+		h.logger.WithFields(log.Fields{
+			"topic": h.topic + "/" + topic,
+		}).Errorf("unable to publish homie message: %v", err)
+	}
+}
+
+// SetState publishes the $state attribute if it changed
+func (h *HomieDevice) SetState(state HomieState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == state {
+		return
+	}
+	h.state = state
+	h.logger.WithFields(log.Fields{
+		"topic": h.topic,
+		"state": state,
+	}).Info("homie device state")
+	h.publish("$state", true, string(state))
+}
+
+// PublishState publishes again the current $state, the broker may have replaced it with the last will after a
+// connection loss
+func (h *HomieDevice) PublishState() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == "" {
+		return
+	}
+	h.publish("$state", true, string(h.state))
+}
+
+// PublishLost publishes lost as $state without changing the current state, as the last will of the connection would
+// have done. It is used after a reconnection for devices without will, PublishState then restores the current state.
+func (h *HomieDevice) PublishLost() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == "" || h.state == HomieLost {
+		return
+	}
+	h.publish("$state", true, string(HomieLost))
+}
+
+func (h *HomieDevice) publishAttributes(name string) {
+	h.publish("$homie", true, HomieVersion)
+	h.publish("$name", true, name)
+	h.publish("$extensions", true, "")
+	nodes := make([]string, 0, len(homieNodes))
+	for _, n := range homieNodes {
+		nodes = append(nodes, n.id)
+	}
+	h.publish("$nodes", true, strings.Join(nodes, ","))
+
+	for _, n := range homieNodes {
+		h.publish(n.id+"/$name", true, n.name)
+		h.publish(n.id+"/$type", true, n.typ)
+		properties := make([]string, 0, len(n.properties))
+		for _, p := range n.properties {
+			properties = append(properties, p.id)
+		}
+		h.publish(n.id+"/$properties", true, strings.Join(properties, ","))
+
+		for _, p := range n.properties {
+			topic := n.id + "/" + p.id
+			h.publish(topic+"/$name", true, p.name)
+			h.publish(topic+"/$datatype", true, p.datatype)
+			if p.format != "" {
+				h.publish(topic+"/$format", true, p.format)
+			}
+			if p.unit != "" {
+				h.publish(topic+"/$unit", true, p.unit)
+			}
+			if p.set != nil {
+				h.publish(topic+"/$settable", true, "true")
+			}
+			if !p.retained {
+				h.publish(topic+"/$retained", true, "false")
+			}
+		}
+	}
+}
+
+// Run publishes the description of device name and values of player events until ctx is done or events is closed.
+// $state is init during description, then follows ConnectionChanged events.
+func (h *HomieDevice) Run(ctx context.Context, name string, player mediaplayer.Player, events <-chan Event) error {
+	h.mu.Lock()
+	h.player = player
+	h.mu.Unlock()
+
+	h.SetState(HomieInit)
+	h.publishAttributes(name)
+
+	if sub, ok := h.pub.(Subscriber); ok {
+		topics := make([]string, 0)
+		for _, n := range homieNodes {
+			for _, p := range n.properties {
+				if p.set == nil {
+					continue
+				}
+				topic := h.topic + "/" + n.id + "/" + p.id + "/set"
+				if err := sub.Subscribe(topic, h.onSet(p)); err != nil {
+					return err
+				}
+				topics = append(topics, topic)
+			}
+		}
+		defer h.unsubscribe(topics...)
+	}
+	h.SetState(HomieReady)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case evt, ok := <-events:
+			if !ok {
+				return nil
+			}
+			h.onEvent(evt)
+		}
+	}
+}
+
+func (h *HomieDevice) unsubscribe(topics ...string) {
+	unsub, ok := h.pub.(Unsubscriber)
+	if !ok {
+		return
+	}
+	if err := unsub.Unsubscribe(topics...); err != nil {
+		h.logger.Warnf("unable to unsubscribe: %v", err)
+	}
+}
+
+func (h *HomieDevice) onSet(p homieProperty) MessageHandler {
+	return func(msg Message) {
+		logh := h.logger.WithFields(log.Fields{
+			"topic": msg.Topic,
+			"value": string(msg.Payload),
+		})
+		ctx, span := StartCommand(context.Background(), msg)
+		req, err := p.set(string(msg.Payload))
+		if err != nil {
+			logh.Errorf("invalid homie property value: %v", err)
+			EndSpan(span, err)
+			return
+		}
+		h.mu.Lock()
+		player := h.player
+		h.mu.Unlock()
+		err = ControlContext(ctx, player, req)
+		EndSpan(span, err)
+		if err != nil {
+			logh.Errorf("unable to set homie property: %v", err)
+			return
+		}
+		logh.Info("homie property set")
+	}
+}
+
+func (h *HomieDevice) onEvent(evt Event) {
+	switch e := evt.(type) {
+	case ConnectionChanged:
+		if e.Connected {
+			h.SetState(HomieReady)
+		} else {
+			h.SetState(HomieLost)
+		}
+	case ReceiverStatusChanged:
+		h.publish("receiver/volume", true, strconv.Itoa(int(100*e.Volume.Level)))
+		h.publish("receiver/mute", true, strconv.FormatBool(e.Volume.Muted))
+		var id, name, status string
+		for _, app := range e.Applications {
+			id, name, status = app.AppId, app.DisplayName, app.StatusText
+		}
+		h.publish("app/id", true, id)
+		h.publish("app/name", true, name)
+		h.publish("app/status", true, status)
+	case MediaStatusChanged:
+		for _, m := range e.Media {
+			h.publish("media/state", true, m.PlayerState)
+			h.publish("media/position", true, strconv.FormatFloat(float64(m.CurrentTime), 'f', -1, 32))
+			// Media information is only sent when it changes
+			if m.Media.ContentId != "" {
+				h.publish("media/title", true, m.Media.Metadata.Title)
+				h.publish("media/artist", true, m.Media.Metadata.Artist)
+				h.publish("media/content-id", true, m.Media.ContentId)
+				h.publish("media/duration", true, strconv.FormatFloat(float64(m.Media.Duration), 'f', -1, 32))
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package bridge
+
+import (
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"testing"
+)
+
+func TestHomieDevice_SetState(t *testing.T) {
+	pub := recordPublisher{}
+	h := NewHomieDevice(&pub, DefaultHomieBase, "living-room", log.NewEntry(log.StandardLogger()))
+
+	h.PublishState()
+	h.SetState(HomieInit)
+	h.SetState(HomieReady)
+	// Status checks of a connected device
+	h.onEvent(ConnectionChanged{Connected: true})
+	h.onEvent(ConnectionChanged{Connected: true})
+	h.onEvent(ConnectionChanged{Connected: false})
+	h.PublishState()
+
+	topic := HomieStateTopic(DefaultHomieBase, "living-room")
+	expected := []string{"init", "ready", "lost", "lost"}
+	if states := pub.published(topic); !reflect.DeepEqual(states, expected) {
+		t.Errorf("published states %v, expected %v", states, expected)
+	}
+}
+
+func TestHomieDevice_PublishLost(t *testing.T) {
+	pub := recordPublisher{}
+	h := NewHomieDevice(&pub, DefaultHomieBase, "kitchen", log.NewEntry(log.StandardLogger()))
+
+	// Nothing announced yet
+	h.PublishLost()
+	h.SetState(HomieReady)
+	// Reconnection to the broker of a device without will
+	h.PublishLost()
+	h.PublishState()
+	h.SetState(HomieLost)
+	h.PublishLost()
+
+	topic := HomieStateTopic(DefaultHomieBase, "kitchen")
+	expected := []string{"ready", "lost", "ready", "lost"}
+	if states := pub.published(topic); !reflect.DeepEqual(states, expected) {
+		t.Errorf("published states %v, expected %v", states, expected)
+	}
+}
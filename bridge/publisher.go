@@ -0,0 +1,249 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/mqtt5"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// subscriptionTimeout is the max duration waiting for a subscription or unsubscription acknowledgement
+const subscriptionTimeout = 5 * time.Second
+
+// Publisher sends bridge messages to a message bus
+type Publisher interface {
+	Publish(topic string, retain bool, payload []byte) error
+}
+
+// Message is received on a subscribed topic
+type Message struct {
+	Topic   string
+	Payload []byte
+	// ResponseTopic and CorrelationData are set by MQTT v5 requests expecting a response
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// MessageHandler receives messages of a subscribed topic
+type MessageHandler func(msg Message)
+
+// MessageProperties are metadata of a published message, only sent by MQTT v5 publishers
+type MessageProperties struct {
+	UserProperties  map[string]string `json:"user_properties,omitempty"`
+	CorrelationData []byte            `json:"correlation_data,omitempty"`
+}
+
+// PropertiesPublisher is implemented by publishers able to send message properties
+type PropertiesPublisher interface {
+	PublishProperties(ctx context.Context, topic string, retain bool, payload []byte, props MessageProperties) error
+}
+
+// publishWithProperties publishes with props if pub supports them, props are dropped otherwise
+func publishWithProperties(ctx context.Context, pub Publisher, topic string, retain bool, payload []byte,
+	props MessageProperties) error {
+	switch p := pub.(type) {
+	case PropertiesPublisher:
+		return p.PublishProperties(ctx, topic, retain, payload, props)
+	case ContextPublisher:
+		return p.PublishContext(ctx, topic, retain, payload)
+	default:
+		return pub.Publish(topic, retain, payload)
+	}
+}
+
+// Subscriber is implemented by publishers able to receive commands, the bridge subscribes its command topics on
+// Run when its publisher implements it
+type Subscriber interface {
+	Subscribe(topic string, handler MessageHandler) error
+}
+
+// Unsubscriber is implemented by subscribers able to stop a subscription, the bridge unsubscribes its command
+// topics when Run returns
+type Unsubscriber interface {
+	Unsubscribe(topics ...string) error
+}
+
+type MqttPublisher struct {
+	client MQTT.Client
+	qos    byte
+
+	mu   sync.Mutex
+	subs map[string]MessageHandler
+}
+
+func NewMqttPublisher(client MQTT.Client, qos byte) *MqttPublisher {
+	return &MqttPublisher{client: client, qos: qos, subs: make(map[string]MessageHandler)}
+}
+
+func (p *MqttPublisher) Publish(topic string, retain bool, payload []byte) error {
+	token := p.client.Publish(topic, p.qos, retain, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// PublishContext publishes the message and waits for its acknowledgement until ctx is done
+func (p *MqttPublisher) PublishContext(ctx context.Context, topic string, retain bool, payload []byte) error {
+	token := p.client.Publish(topic, p.qos, retain, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("unable to publish to topic %v: %v", topic, ctx.Err())
+	}
+}
+
+// IsConnected returns true if the connection to the broker is established
+func (p *MqttPublisher) IsConnected() bool {
+	return p.client.IsConnectionOpen()
+}
+
+func (p *MqttPublisher) Subscribe(topic string, handler MessageHandler) error {
+	p.mu.Lock()
+	p.subs[topic] = handler
+	p.mu.Unlock()
+	return p.subscribe(topic, handler)
+}
+
+func (p *MqttPublisher) subscribe(topic string, handler MessageHandler) error {
+	token := p.client.Subscribe(topic, p.qos, func(_ MQTT.Client, message MQTT.Message) {
+		handler(Message{Topic: message.Topic(), Payload: message.Payload()})
+	})
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to subscribe to topic %v: %v", topic, token.Error())
+	}
+	return nil
+}
+
+// Resubscribe sends all subscriptions again, paho doesn't restore them when the broker didn't keep the session
+func (p *MqttPublisher) Resubscribe() error {
+	p.mu.Lock()
+	subs := make(map[string]MessageHandler, len(p.subs))
+	for topic, handler := range p.subs {
+		subs[topic] = handler
+	}
+	p.mu.Unlock()
+
+	for topic, handler := range subs {
+		if err := p.subscribe(topic, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *MqttPublisher) Unsubscribe(topics ...string) error {
+	p.mu.Lock()
+	for _, topic := range topics {
+		delete(p.subs, topic)
+	}
+	p.mu.Unlock()
+
+	token := p.client.Unsubscribe(topics...)
+	if !token.WaitTimeout(subscriptionTimeout) {
+		return fmt.Errorf("unable to unsubscribe from topics %v: timeout", topics)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("unable to unsubscribe from topics %v: %v", topics, token.Error())
+	}
+	return nil
+}
+
+// Mqtt5Publisher publishes with an MQTT v5 client, message properties are sent as user properties and correlation
+// data
+type Mqtt5Publisher struct {
+	client        *mqtt5.Client
+	qos           byte
+	messageExpiry time.Duration
+}
+
+// NewMqtt5Publisher creates a publisher, messageExpiry is set on messages not retained if not 0
+func NewMqtt5Publisher(client *mqtt5.Client, qos byte, messageExpiry time.Duration) *Mqtt5Publisher {
+	return &Mqtt5Publisher{client: client, qos: qos, messageExpiry: messageExpiry}
+}
+
+func (p *Mqtt5Publisher) Publish(topic string, retain bool, payload []byte) error {
+	return p.PublishContext(context.Background(), topic, retain, payload)
+}
+
+func (p *Mqtt5Publisher) PublishContext(ctx context.Context, topic string, retain bool, payload []byte) error {
+	return p.PublishProperties(ctx, topic, retain, payload, MessageProperties{})
+}
+
+func (p *Mqtt5Publisher) PublishProperties(ctx context.Context, topic string, retain bool, payload []byte,
+	props MessageProperties) error {
+	properties := mqtt5.Properties{CorrelationData: props.CorrelationData}
+	if !retain {
+		properties.MessageExpiry = p.messageExpiry
+	}
+	keys := make([]string, 0, len(props.UserProperties))
+	for k := range props.UserProperties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		properties.UserProperties = append(properties.UserProperties, mqtt5.UserProperty{Key: k, Value: props.UserProperties[k]})
+	}
+	err := p.client.Publish(ctx, &mqtt5.Publish{
+		Topic:      topic,
+		Payload:    payload,
+		QoS:        p.qos,
+		Retain:     retain,
+		Properties: &properties,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish to topic %v: %v", topic, err)
+	}
+	return nil
+}
+
+// IsConnected returns true if the connection to the broker is established
+func (p *Mqtt5Publisher) IsConnected() bool {
+	return p.client.IsConnected()
+}
+
+func (p *Mqtt5Publisher) Subscribe(topic string, handler MessageHandler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), subscriptionTimeout)
+	defer cancel()
+	err := p.client.Subscribe(ctx, topic, p.qos, func(msg *mqtt5.Publish) {
+		m := Message{Topic: msg.Topic, Payload: msg.Payload}
+		if msg.Properties != nil {
+			m.ResponseTopic = msg.Properties.ResponseTopic
+			m.CorrelationData = msg.Properties.CorrelationData
+		}
+		handler(m)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to topic %v: %v", topic, err)
+	}
+	return nil
+}
+
+func (p *Mqtt5Publisher) Unsubscribe(topics ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), subscriptionTimeout)
+	defer cancel()
+	if err := p.client.Unsubscribe(ctx, topics...); err != nil {
+		return fmt.Errorf("unable to unsubscribe from topics %v: %v", topics, err)
+	}
+	return nil
+}
+
+// WriterPublisher writes messages to out instead of a message bus, one line per message
+type WriterPublisher struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewWriterPublisher(out io.Writer) *WriterPublisher {
+	return &WriterPublisher{out: out}
+}
+
+func (p *WriterPublisher) Publish(topic string, retain bool, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.out, "%s retain=%v %s\n", topic, retain, payload)
+	return err
+}
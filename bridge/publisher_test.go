@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"sync"
+)
+
+// published is a message recorded by recordPublisher
+type published struct {
+	topic   string
+	retain  bool
+	payload string
+}
+
+// recordPublisher records published messages
+type recordPublisher struct {
+	mu       sync.Mutex
+	messages []published
+}
+
+func (p *recordPublisher) Publish(topic string, retain bool, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, published{topic: topic, retain: retain, payload: string(payload)})
+	return nil
+}
+
+// published returns the payloads published to topic
+func (p *recordPublisher) published(topic string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payloads := make([]string, 0)
+	for _, m := range p.messages {
+		if m.topic == topic {
+			payloads = append(payloads, m.payload)
+		}
+	}
+	return payloads
+}
@@ -0,0 +1,286 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueSize      = 256
+	defaultPublishTimeout = 5 * time.Second
+)
+
+// OverflowPolicy selects the message removed when a message is published on a full queue
+type OverflowPolicy int
+
+const (
+	// DropOldest removes the oldest queued message
+	DropOldest OverflowPolicy = iota
+	// CoalesceByTopic removes the oldest queued message of the same topic, or the oldest message if none
+	CoalesceByTopic
+)
+
+// ParseOverflowPolicy converts a flag value to OverflowPolicy
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch value {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "coalesce":
+		return CoalesceByTopic, nil
+	default:
+		return DropOldest, fmt.Errorf("invalid overflow policy %q, must be drop-oldest or coalesce", value)
+	}
+}
+
+// ContextPublisher is implemented by publishers able to abort a publish
+type ContextPublisher interface {
+	PublishContext(ctx context.Context, topic string, retain bool, payload []byte) error
+}
+
+type QueueOption func(*QueuedPublisher)
+
+// WithQueueSize sets the max number of messages waiting to be published
+func WithQueueSize(size int) QueueOption {
+	return func(q *QueuedPublisher) {
+		q.size = size
+	}
+}
+
+// WithPublishTimeout sets the max duration of a single publish
+func WithPublishTimeout(timeout time.Duration) QueueOption {
+	return func(q *QueuedPublisher) {
+		q.timeout = timeout
+	}
+}
+
+// WithOverflowPolicy sets the behaviour on full queue
+func WithOverflowPolicy(policy OverflowPolicy) QueueOption {
+	return func(q *QueuedPublisher) {
+		q.policy = policy
+	}
+}
+
+// QueueStats are counters of a QueuedPublisher
+type QueueStats struct {
+	Depth     int    `json:"depth"`
+	Capacity  int    `json:"capacity"`
+	Published uint64 `json:"published"`
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+	Failed    uint64 `json:"failed"`
+}
+
+type queuedMessage struct {
+	topic   string
+	retain  bool
+	payload []byte
+	props   MessageProperties
+	// span is the context of the publishing span, queued is the time the message was queued
+	span   trace.SpanContext
+	queued time.Time
+}
+
+// QueuedPublisher is a non-blocking Publisher, messages are queued and sent by Run so that a slow broker doesn't
+// stall the processing of cast messages
+type QueuedPublisher struct {
+	pub     Publisher
+	size    int
+	timeout time.Duration
+	policy  OverflowPolicy
+
+	mu     sync.Mutex
+	queue  []queuedMessage
+	notify chan struct{}
+	stats  QueueStats
+}
+
+func NewQueuedPublisher(pub Publisher, opts ...QueueOption) *QueuedPublisher {
+	q := QueuedPublisher{
+		pub:     pub,
+		size:    defaultQueueSize,
+		timeout: defaultPublishTimeout,
+		policy:  DropOldest,
+		notify:  make(chan struct{}, 1),
+	}
+	for _, o := range opts {
+		o(&q)
+	}
+	if q.size < 1 {
+		q.size = 1
+	}
+	q.queue = make([]queuedMessage, 0, q.size)
+	return &q
+}
+
+// Publish queues the message, it never blocks
+func (q *QueuedPublisher) Publish(topic string, retain bool, payload []byte) error {
+	return q.PublishProperties(context.Background(), topic, retain, payload, MessageProperties{})
+}
+
+// PublishProperties queues the message with its properties, it never blocks. The span of ctx is the parent of the
+// span of the actual publish.
+func (q *QueuedPublisher) PublishProperties(ctx context.Context, topic string, retain bool, payload []byte,
+	props MessageProperties) error {
+	q.mu.Lock()
+	msg := queuedMessage{
+		topic:   topic,
+		retain:  retain,
+		payload: payload,
+		props:   props,
+		span:    trace.SpanContextFromContext(ctx),
+		queued:  time.Now(),
+	}
+	if len(q.queue) >= q.size {
+		q.overflow(msg)
+	} else {
+		q.queue = append(q.queue, msg)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// overflow adds msg on a full queue, mu must be held
+func (q *QueuedPublisher) overflow(msg queuedMessage) {
+	if q.policy == CoalesceByTopic {
+		for i := range q.queue {
+			if q.queue[i].topic == msg.topic {
+				// Keep order of messages of a topic, the newest must be published last
+				q.queue = append(append(q.queue[:i], q.queue[i+1:]...), msg)
+				q.stats.Coalesced += 1
+				return
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"topic": q.queue[0].topic,
+	}).Warn("publish queue full, drop oldest message")
+	q.queue = append(q.queue[1:], msg)
+	q.stats.Dropped += 1
+}
+
+// Reconfigure applies opts to a running queue, oldest messages are dropped if the new size is smaller than depth
+func (q *QueuedPublisher) Reconfigure(opts ...QueueOption) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, o := range opts {
+		o(q)
+	}
+	if q.size < 1 {
+		q.size = 1
+	}
+	if dropped := len(q.queue) - q.size; dropped > 0 {
+		log.WithField("count", dropped).Warn("publish queue resized, drop oldest messages")
+		q.queue = q.queue[dropped:]
+		q.stats.Dropped += uint64(dropped)
+	}
+}
+
+// Subscribe delegates to the wrapped publisher
+func (q *QueuedPublisher) Subscribe(topic string, handler MessageHandler) error {
+	sub, ok := q.pub.(Subscriber)
+	if !ok {
+		return fmt.Errorf("publisher doesn't support subscriptions")
+	}
+	return sub.Subscribe(topic, handler)
+}
+
+// Unsubscribe delegates to the wrapped publisher
+func (q *QueuedPublisher) Unsubscribe(topics ...string) error {
+	unsub, ok := q.pub.(Unsubscriber)
+	if !ok {
+		return fmt.Errorf("publisher doesn't support subscriptions")
+	}
+	return unsub.Unsubscribe(topics...)
+}
+
+// Stats returns a snapshot of queue counters
+func (q *QueuedPublisher) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Depth = len(q.queue)
+	stats.Capacity = q.size
+	return stats
+}
+
+// Run publishes queued messages until ctx is done, messages left in queue are published by Flush. A publish in
+// progress when ctx is done is not aborted, it is bounded by the publish timeout.
+func (q *QueuedPublisher) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		msg, timeout, ok := q.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+			case <-q.notify:
+			}
+			continue
+		}
+		q.send(context.Background(), msg, timeout)
+	}
+}
+
+// Flush publishes pending messages until the queue is empty or ctx is done, it is used on shutdown when Run is
+// stopped
+func (q *QueuedPublisher) Flush(ctx context.Context) {
+	for ctx.Err() == nil {
+		msg, timeout, ok := q.pop()
+		if !ok {
+			return
+		}
+		q.send(ctx, msg, timeout)
+	}
+}
+
+// pop returns the oldest message and the publish timeout, which may be changed by Reconfigure
+func (q *QueuedPublisher) pop() (queuedMessage, time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) == 0 {
+		return queuedMessage{}, 0, false
+	}
+	msg := q.queue[0]
+	q.queue[0] = queuedMessage{}
+	q.queue = q.queue[1:]
+	return msg, q.timeout, true
+}
+
+func (q *QueuedPublisher) send(ctx context.Context, msg queuedMessage, timeout time.Duration) {
+	publishCtx, cancel := context.WithTimeout(ctx, timeout)
+	var span trace.Span
+	// Only traced messages are sent in a span, to not start a trace for each heartbeat
+	if msg.span.IsValid() {
+		publishCtx, span = tracer.Start(trace.ContextWithSpanContext(publishCtx, msg.span), "mqtt.send",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String("mqtt"),
+				semconv.MessagingDestinationKey.String(msg.topic),
+				AttrQueueWait.Int64(time.Since(msg.queued).Milliseconds()),
+			))
+	}
+	err := publishWithProperties(publishCtx, q.pub, msg.topic, msg.retain, msg.payload, msg.props)
+	cancel()
+	if span != nil {
+		EndSpan(span, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		q.stats.Failed += 1
+		log.WithFields(log.Fields{
+			"topic": msg.topic,
+		}).Errorf("unable to publish message: %v", err)
+		return
+	}
+	q.stats.Published += 1
+}
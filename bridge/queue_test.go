@@ -0,0 +1,206 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queued returns topic=payload of published messages in order
+func (p *recordPublisher) queued() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	values := make([]string, 0, len(p.messages))
+	for _, m := range p.messages {
+		values = append(values, m.topic+"="+m.payload)
+	}
+	return values
+}
+
+func TestQueuedPublisher_Overflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   OverflowPolicy
+		expected []string
+		stats    QueueStats
+	}{
+		{
+			name:     "drop oldest",
+			policy:   DropOldest,
+			expected: []string{"state=IDLE", "volume=20", "state=PLAYING"},
+			stats:    QueueStats{Capacity: 3, Published: 3, Dropped: 2},
+		},
+		{
+			name:   "coalesce",
+			policy: CoalesceByTopic,
+			// Last value of a topic is published after other pending values
+			expected: []string{"mute=ON", "volume=20", "state=PLAYING"},
+			stats:    QueueStats{Capacity: 3, Published: 3, Coalesced: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := recordPublisher{}
+			q := NewQueuedPublisher(&pub, WithQueueSize(3), WithOverflowPolicy(tt.policy))
+			for _, m := range [][2]string{
+				{"mute", "ON"}, {"volume", "10"}, {"state", "IDLE"}, {"volume", "20"}, {"state", "PLAYING"},
+			} {
+				_ = q.Publish(m[0], true, []byte(m[1]))
+			}
+			if depth := q.Stats().Depth; depth != 3 {
+				t.Errorf("queue depth %d", depth)
+			}
+			q.Flush(context.Background())
+
+			if values := pub.queued(); !reflect.DeepEqual(values, tt.expected) {
+				t.Errorf("published %v, expected %v", values, tt.expected)
+			}
+			if stats := q.Stats(); stats != tt.stats {
+				t.Errorf("stats %+v, expected %+v", stats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestQueuedPublisher_CoalesceOtherTopic(t *testing.T) {
+	pub := recordPublisher{}
+	q := NewQueuedPublisher(&pub, WithQueueSize(3), WithOverflowPolicy(CoalesceByTopic))
+	for _, m := range [][2]string{{"volume", "10"}, {"mute", "ON"}, {"state", "IDLE"}, {"title", "Song"}} {
+		_ = q.Publish(m[0], true, []byte(m[1]))
+	}
+	q.Flush(context.Background())
+
+	// No pending value of the topic, the oldest message is dropped
+	expected := []string{"mute=ON", "state=IDLE", "title=Song"}
+	if values := pub.queued(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("published %v, expected %v", values, expected)
+	}
+	if stats := q.Stats(); stats.Dropped != 1 || stats.Coalesced != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestQueuedPublisher_Reconfigure(t *testing.T) {
+	pub := recordPublisher{}
+	q := NewQueuedPublisher(&pub, WithQueueSize(4))
+	for _, v := range []string{"1", "2", "3", "4"} {
+		_ = q.Publish("volume", true, []byte(v))
+	}
+	q.Reconfigure(WithQueueSize(2))
+	q.Flush(context.Background())
+
+	if values := pub.queued(); !reflect.DeepEqual(values, []string{"volume=3", "volume=4"}) {
+		t.Errorf("published %v", values)
+	}
+	if stats := q.Stats(); stats.Dropped != 2 || stats.Capacity != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// failPublisher fails all publishes
+type failPublisher struct{}
+
+func (failPublisher) Publish(string, bool, []byte) error {
+	return errors.New("broker unavailable")
+}
+
+func TestQueuedPublisher_Failed(t *testing.T) {
+	q := NewQueuedPublisher(failPublisher{})
+	_ = q.Publish("volume", true, []byte("10"))
+	q.Flush(context.Background())
+	if stats := q.Stats(); stats.Failed != 1 || stats.Published != 0 || stats.Depth != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestQueuedPublisher_Run(t *testing.T) {
+	pub := recordPublisher{}
+	q := NewQueuedPublisher(&pub)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx)
+	}()
+
+	_ = q.Publish("volume", true, []byte("10"))
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Stats().Published != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run not stopped")
+	}
+
+	// Messages queued after stop are left to Flush
+	_ = q.Publish("volume", true, []byte("20"))
+	if values := pub.queued(); !reflect.DeepEqual(values, []string{"volume=10"}) {
+		t.Errorf("published %v", values)
+	}
+	q.Flush(context.Background())
+	if values := pub.queued(); !reflect.DeepEqual(values, []string{"volume=10", "volume=20"}) {
+		t.Errorf("published %v", values)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	if p, err := ParseOverflowPolicy("drop-oldest"); err != nil || p != DropOldest {
+		t.Errorf("drop-oldest parsed as %v: %v", p, err)
+	}
+	if p, err := ParseOverflowPolicy("coalesce"); err != nil || p != CoalesceByTopic {
+		t.Errorf("coalesce parsed as %v: %v", p, err)
+	}
+	if _, err := ParseOverflowPolicy("drop-newest"); err == nil {
+		t.Errorf("invalid policy accepted")
+	}
+}
+
+// slowPublisher publishes in 1ms
+type slowPublisher struct {
+	recordPublisher
+}
+
+func (p *slowPublisher) Publish(topic string, retain bool, payload []byte) error {
+	time.Sleep(time.Millisecond)
+	return p.recordPublisher.Publish(topic, retain, payload)
+}
+
+func TestQueuedPublisher_ReconfigureWhileRunning(t *testing.T) {
+	q := NewQueuedPublisher(&slowPublisher{}, WithQueueSize(1000))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	// Run with -race, options are changed on SIGHUP while messages are published
+	stop := make(chan struct{})
+	reconfigured := make(chan struct{})
+	go func() {
+		defer close(reconfigured)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			q.Reconfigure(WithPublishTimeout(time.Duration(i)*time.Second), WithQueueSize(1000))
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		_ = q.Publish("cast/message", false, []byte("1"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Stats().Published != 200 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-reconfigured
+	if stats := q.Stats(); stats.Published != 200 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast/proto"
+	"os"
+	"sync"
+	"time"
+)
+
+const maxRecordLineSize = 1024 * 1024
+
+// recordedMessage is the json line format of a cast message in a record file
+type recordedMessage struct {
+	Time          time.Time `json:"time"`
+	Namespace     string    `json:"namespace"`
+	Source        string    `json:"source"`
+	Destination   string    `json:"destination"`
+	PayloadType   string    `json:"payload_type"`
+	Payload       string    `json:"payload,omitempty"`
+	PayloadBinary []byte    `json:"payload_binary,omitempty"`
+}
+
+func (m *recordedMessage) castMessage() *api.CastMessage {
+	payloadType := api.CastMessage_STRING
+	if m.PayloadType == api.CastMessage_BINARY.String() {
+		payloadType = api.CastMessage_BINARY
+	}
+	msg := api.CastMessage{
+		ProtocolVersion: api.CastMessage_CASTV2_1_0.Enum(),
+		SourceId:        &m.Source,
+		DestinationId:   &m.Destination,
+		Namespace:       &m.Namespace,
+		PayloadType:     payloadType.Enum(),
+	}
+	if payloadType == api.CastMessage_BINARY {
+		msg.PayloadBinary = m.PayloadBinary
+	} else {
+		msg.PayloadUtf8 = &m.Payload
+	}
+	return &msg
+}
+
+// Recorder writes cast messages to a json lines file
+type Recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open record file %v", path)
+	}
+	return &Recorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *Recorder) Record(msg *api.CastMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.enc.Encode(recordedMessage{
+		Time:          time.Now(),
+		Namespace:     msg.GetNamespace(),
+		Source:        msg.GetSourceId(),
+		Destination:   msg.GetDestinationId(),
+		PayloadType:   msg.GetPayloadType().String(),
+		Payload:       msg.GetPayloadUtf8(),
+		PayloadBinary: msg.GetPayloadBinary(),
+	})
+	if err != nil {
+		log.Errorf("unable to record cast message: %v", err)
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// ReplayFile feeds handle with messages of a record file, speed 1 replays in real time and 0 as fast as possible
+func ReplayFile(path string, speed float64, handle func(msg *api.CastMessage)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open record file %v", path)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordLineSize)
+	var previous time.Time
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		var msg recordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return errors.Wrapf(err, "invalid record at line %d", line)
+		}
+		if speed > 0 && !previous.IsZero() && msg.Time.After(previous) {
+			time.Sleep(time.Duration(float64(msg.Time.Sub(previous)) / speed))
+		}
+		previous = msg.Time
+		handle(msg.castMessage())
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "unable to read record file after line %d", line)
+	}
+	log.Infof("%d messages replayed", line)
+	return nil
+}
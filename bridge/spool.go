@@ -0,0 +1,375 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	spoolFileName        = "spool.jsonl"
+	defaultRetryInterval = 10 * time.Second
+)
+
+// ConnectionChecker is implemented by publishers knowing the state of their connection
+type ConnectionChecker interface {
+	IsConnected() bool
+}
+
+// SpoolStats are counters of a SpoolPublisher
+type SpoolStats struct {
+	Size     int64  `json:"size"`
+	Pending  int    `json:"pending"`
+	Spooled  uint64 `json:"spooled"`
+	Dropped  uint64 `json:"dropped"`
+	Replayed uint64 `json:"replayed"`
+}
+
+type spooledMessage struct {
+	Time       time.Time          `json:"time"`
+	Topic      string             `json:"topic"`
+	Payload    []byte             `json:"payload"`
+	Properties *MessageProperties `json:"properties,omitempty"`
+}
+
+func (m spooledMessage) properties() MessageProperties {
+	if m.Properties == nil {
+		return MessageProperties{}
+	}
+	return *m.Properties
+}
+
+type SpoolOption func(*SpoolPublisher)
+
+// WithReplayTimeout sets the max duration of each publish of Flush
+func WithReplayTimeout(timeout time.Duration) SpoolOption {
+	return func(s *SpoolPublisher) {
+		s.timeout = timeout
+	}
+}
+
+// SpoolPublisher keeps messages published while the bus is disconnected. Events are appended to a bounded file and
+// replayed in order by Flush, retained messages are coalesced by topic so only their latest value is sent.
+// WithRetryInterval sets the interval between two Flush of Run while the bus is connected
+func WithRetryInterval(interval time.Duration) SpoolOption {
+	return func(s *SpoolPublisher) {
+		s.interval = interval
+	}
+}
+
+type SpoolPublisher struct {
+	pub      Publisher
+	path     string
+	maxSize  int64
+	timeout  time.Duration
+	interval time.Duration
+
+	// flushMu prevents concurrent replays, mu is released during publishes of Flush
+	flushMu  sync.Mutex
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	retained map[string]spooledMessage
+	order    []string
+	stats    SpoolStats
+}
+
+// NewSpoolPublisher opens the spool file in dir, messages left by a previous run are kept for the next Flush
+func NewSpoolPublisher(pub Publisher, dir string, maxSize int64, opts ...SpoolOption) (*SpoolPublisher, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "unable to create spool directory %v", dir)
+	}
+	path := filepath.Join(dir, spoolFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open spool file %v", path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "unable to read spool file %v", path)
+	}
+	if info.Size() > 0 {
+		log.WithFields(log.Fields{
+			"file": path,
+			"size": info.Size(),
+		}).Info("spool contains messages of previous run")
+	}
+	s := SpoolPublisher{
+		pub:      pub,
+		path:     path,
+		maxSize:  maxSize,
+		timeout:  defaultPublishTimeout,
+		interval: defaultRetryInterval,
+		file:     f,
+		size:     info.Size(),
+		retained: make(map[string]spooledMessage),
+	}
+	for _, o := range opts {
+		o(&s)
+	}
+	return &s, nil
+}
+
+func (s *SpoolPublisher) Publish(topic string, retain bool, payload []byte) error {
+	return s.PublishContext(context.Background(), topic, retain, payload)
+}
+
+func (s *SpoolPublisher) PublishContext(ctx context.Context, topic string, retain bool, payload []byte) error {
+	return s.PublishProperties(ctx, topic, retain, payload, MessageProperties{})
+}
+
+// PublishProperties publishes directly if the bus is connected and nothing is pending, otherwise the message is
+// spooled
+func (s *SpoolPublisher) PublishProperties(ctx context.Context, topic string, retain bool, payload []byte,
+	props MessageProperties) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := spooledMessage{Time: time.Now(), Topic: topic, Payload: payload}
+	if props.UserProperties != nil || props.CorrelationData != nil {
+		msg.Properties = &props
+	}
+	if s.connected() && s.size == 0 && len(s.retained) == 0 {
+		err := s.publish(ctx, msg, retain)
+		if err == nil {
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"topic": topic,
+		}).Warnf("unable to publish, spool message: %v", err)
+	}
+	return s.spool(msg, retain)
+}
+
+// pending returns true if messages wait for a Flush
+func (s *SpoolPublisher) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size > 0 || len(s.retained) > 0
+}
+
+// Run flushes the spool periodically while the bus is connected, so messages spooled after a failed publish don't
+// wait for the next reconnection
+func (s *SpoolPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.connected() || !s.pending() {
+				continue
+			}
+			if err := s.Flush(ctx); err != nil && ctx.Err() == nil {
+				log.Warnf("unable to replay spooled messages, retry in %v: %v", s.interval, err)
+			}
+		}
+	}
+}
+
+func (s *SpoolPublisher) connected() bool {
+	if c, ok := s.pub.(ConnectionChecker); ok {
+		return c.IsConnected()
+	}
+	return true
+}
+
+func (s *SpoolPublisher) publish(ctx context.Context, msg spooledMessage, retain bool) error {
+	return publishWithProperties(ctx, s.pub, msg.Topic, retain, msg.Payload, msg.properties())
+}
+
+// spool keeps a message for next Flush, mu must be held
+func (s *SpoolPublisher) spool(msg spooledMessage, retain bool) error {
+	if retain {
+		if _, ok := s.retained[msg.Topic]; !ok {
+			s.order = append(s.order, msg.Topic)
+		}
+		s.retained[msg.Topic] = msg
+		return nil
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrapf(err, "unable to marshal message for topic %v", msg.Topic)
+	}
+	line = append(line, '\n')
+	if s.size+int64(len(line)) > s.maxSize {
+		s.stats.Dropped += 1
+		return errors.Errorf("spool full, drop message for topic %v", msg.Topic)
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "unable to write spool file %v", s.path)
+	}
+	s.stats.Spooled += 1
+	return nil
+}
+
+// Flush publishes spooled events in order, then the latest value of each retained topic. Messages not published
+// are kept for the next Flush. The spool isn't locked during publishes, messages spooled meanwhile are replayed
+// after.
+func (s *SpoolPublisher) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		messages, err := s.read()
+		retained := make([]spooledMessage, 0, len(s.order))
+		for _, topic := range s.order {
+			retained = append(retained, s.retained[topic])
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 && len(retained) == 0 {
+			return nil
+		}
+		if len(messages) > 0 {
+			log.WithField("count", len(messages)).Info("replay spooled messages")
+		}
+		if err := s.replay(ctx, messages, retained); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// replay publishes messages then retained, published messages are removed from the spool
+func (s *SpoolPublisher) replay(ctx context.Context, messages, retained []spooledMessage) error {
+	for i, msg := range messages {
+		if err := s.publishTimeout(ctx, msg, false); err != nil {
+			if errDrop := s.drop(i); errDrop != nil {
+				log.Errorf("unable to rewrite spool: %v", errDrop)
+			}
+			return errors.Wrapf(err, "unable to replay message for topic %v", msg.Topic)
+		}
+	}
+	if err := s.drop(len(messages)); err != nil {
+		return err
+	}
+
+	for _, msg := range retained {
+		if err := s.publishTimeout(ctx, msg, true); err != nil {
+			return errors.Wrapf(err, "unable to replay retained message for topic %v", msg.Topic)
+		}
+		s.mu.Lock()
+		// A newer value may have been spooled during the publish
+		if latest, ok := s.retained[msg.Topic]; ok && latest.Time.Equal(msg.Time) {
+			delete(s.retained, msg.Topic)
+			for i, topic := range s.order {
+				if topic == msg.Topic {
+					s.order = append(s.order[:i], s.order[i+1:]...)
+					break
+				}
+			}
+			s.stats.Replayed += 1
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *SpoolPublisher) publishTimeout(ctx context.Context, msg spooledMessage, retain bool) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.publish(ctx, msg, retain)
+}
+
+// drop removes the count first events of the spool, events spooled since they were read are kept
+func (s *SpoolPublisher) drop(count int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages, err := s.read()
+	if err != nil {
+		return err
+	}
+	if count > len(messages) {
+		count = len(messages)
+	}
+	s.stats.Replayed += uint64(count)
+	return s.rewrite(messages[count:])
+}
+
+func (s *SpoolPublisher) read() ([]spooledMessage, error) {
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return nil, errors.Wrapf(err, "unable to read spool file %v", s.path)
+	}
+	messages := make([]spooledMessage, 0)
+	scanner := bufio.NewScanner(s.file)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxSize)+1)
+	for scanner.Scan() {
+		var msg spooledMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			// A line may be truncated if the process was killed during a write
+			log.Warnf("ignore invalid spooled message: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, errors.Wrapf(scanner.Err(), "unable to read spool file %v", s.path)
+}
+
+// rewrite replaces spool content with messages
+func (s *SpoolPublisher) rewrite(messages []spooledMessage) error {
+	if err := s.file.Truncate(0); err != nil {
+		return errors.Wrapf(err, "unable to truncate spool file %v", s.path)
+	}
+	s.size = 0
+	for _, msg := range messages {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return errors.Wrapf(err, "unable to marshal message for topic %v", msg.Topic)
+		}
+		n, err := s.file.Write(append(line, '\n'))
+		s.size += int64(n)
+		if err != nil {
+			return errors.Wrapf(err, "unable to write spool file %v", s.path)
+		}
+	}
+	return nil
+}
+
+// Subscribe delegates to the wrapped publisher
+func (s *SpoolPublisher) Subscribe(topic string, handler MessageHandler) error {
+	sub, ok := s.pub.(Subscriber)
+	if !ok {
+		return errors.New("publisher doesn't support subscriptions")
+	}
+	return sub.Subscribe(topic, handler)
+}
+
+// Unsubscribe delegates to the wrapped publisher
+func (s *SpoolPublisher) Unsubscribe(topics ...string) error {
+	unsub, ok := s.pub.(Unsubscriber)
+	if !ok {
+		return errors.New("publisher doesn't support subscriptions")
+	}
+	return unsub.Unsubscribe(topics...)
+}
+
+// Stats returns a snapshot of spool counters
+func (s *SpoolPublisher) Stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Size = s.size
+	stats.Pending = len(s.retained)
+	return stats
+}
+
+func (s *SpoolPublisher) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// busPublisher records messages published while connected, publishes fail after failAfter messages if not negative
+type busPublisher struct {
+	recordPublisher
+
+	mu        sync.Mutex
+	connected bool
+	failAfter int
+}
+
+func newBusPublisher(connected bool) *busPublisher {
+	return &busPublisher{connected: connected, failAfter: -1}
+}
+
+func (p *busPublisher) IsConnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected
+}
+
+func (p *busPublisher) setConnected(connected bool, failAfter int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected = connected
+	p.failAfter = failAfter
+}
+
+func (p *busPublisher) Publish(topic string, retain bool, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected || p.failAfter == 0 {
+		return errors.New("not connected")
+	}
+	if p.failAfter > 0 {
+		p.failAfter--
+	}
+	return p.recordPublisher.Publish(topic, retain, payload)
+}
+
+func TestSpoolPublisher_Replay(t *testing.T) {
+	bus := newBusPublisher(false)
+	s, err := NewSpoolPublisher(bus, t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("unable to create spool: %v", err)
+	}
+	defer s.Close()
+
+	_ = s.Publish("volume", true, []byte("10"))
+	_ = s.Publish("cast/message", false, []byte("1"))
+	_ = s.Publish("mute", true, []byte("ON"))
+	_ = s.Publish("volume", true, []byte("20"))
+	_ = s.Publish("cast/message", false, []byte("2"))
+	if stats := s.Stats(); stats.Spooled != 2 || stats.Pending != 2 || stats.Size == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	bus.setConnected(true, -1)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+	// Events in order, then latest value of retained topics
+	expected := []string{"cast/message=1", "cast/message=2", "volume=20", "mute=ON"}
+	if values := bus.queued(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("replayed %v, expected %v", values, expected)
+	}
+	if stats := s.Stats(); stats.Replayed != 4 || stats.Pending != 0 || stats.Size != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Nothing pending, messages are published directly
+	_ = s.Publish("volume", true, []byte("30"))
+	if values := bus.published("volume"); !reflect.DeepEqual(values, []string{"20", "30"}) {
+		t.Errorf("published volumes %v", values)
+	}
+}
+
+func TestSpoolPublisher_ReplayFailure(t *testing.T) {
+	bus := newBusPublisher(false)
+	s, err := NewSpoolPublisher(bus, t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("unable to create spool: %v", err)
+	}
+	defer s.Close()
+
+	for _, v := range []string{"1", "2", "3"} {
+		_ = s.Publish("cast/message", false, []byte(v))
+	}
+	_ = s.Publish("volume", true, []byte("10"))
+
+	bus.setConnected(true, 1)
+	if err := s.Flush(context.Background()); err == nil {
+		t.Errorf("replay failure not reported")
+	}
+	if stats := s.Stats(); stats.Replayed != 1 || stats.Pending != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// Messages published while replaying are spooled after pending ones
+	_ = s.Publish("cast/message", false, []byte("4"))
+
+	bus.setConnected(true, -1)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+	expected := []string{"cast/message=1", "cast/message=2", "cast/message=3", "cast/message=4", "volume=10"}
+	if values := bus.queued(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("replayed %v, expected %v", values, expected)
+	}
+}
+
+func TestSpoolPublisher_Restart(t *testing.T) {
+	dir := t.TempDir()
+	bus := newBusPublisher(false)
+	s, err := NewSpoolPublisher(bus, dir, 1024*1024)
+	if err != nil {
+		t.Fatalf("unable to create spool: %v", err)
+	}
+	_ = s.PublishProperties(context.Background(), "cast/message", false, []byte("1"),
+		MessageProperties{UserProperties: map[string]string{"device": "tv"}})
+	_ = s.Publish("cast/message", false, []byte("2"))
+	if err := s.Close(); err != nil {
+		t.Fatalf("unable to close spool: %v", err)
+	}
+
+	bus.setConnected(true, -1)
+	s, err = NewSpoolPublisher(bus, dir, 1024*1024)
+	if err != nil {
+		t.Fatalf("unable to reopen spool: %v", err)
+	}
+	defer s.Close()
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+	if values := bus.published("cast/message"); !reflect.DeepEqual(values, []string{"1", "2"}) {
+		t.Errorf("replayed %v", values)
+	}
+}
+
+func TestSpoolPublisher_Full(t *testing.T) {
+	s, err := NewSpoolPublisher(newBusPublisher(false), t.TempDir(), 100)
+	if err != nil {
+		t.Fatalf("unable to create spool: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Publish("cast/message", false, []byte("1")); err != nil {
+		t.Errorf("unable to spool message: %v", err)
+	}
+	if err := s.Publish("cast/message", false, []byte("2")); err == nil {
+		t.Errorf("message spooled in full spool")
+	}
+	// Retained values are kept in memory
+	if err := s.Publish("volume", true, []byte("10")); err != nil {
+		t.Errorf("unable to spool retained message: %v", err)
+	}
+	if stats := s.Stats(); stats.Spooled != 1 || stats.Dropped != 1 || stats.Size > 100 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSpoolPublisher_RunWhileConnected(t *testing.T) {
+	bus := newBusPublisher(true)
+	s, err := NewSpoolPublisher(bus, t.TempDir(), 1024*1024, WithRetryInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unable to create spool: %v", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	// A single publish fails, the connection stays up
+	bus.setConnected(true, 0)
+	_ = s.Publish("cast/message", false, []byte("1"))
+	_ = s.Publish("volume", true, []byte("10"))
+	bus.setConnected(true, -1)
+	_ = s.Publish("cast/message", false, []byte("2"))
+
+	waitPublished(t, &bus.recordPublisher, "volume", "10")
+	waitPublished(t, &bus.recordPublisher, "cast/message", "1", "2")
+	if stats := s.Stats(); stats.Size != 0 || stats.Pending != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,134 @@
+package bridge
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// TopicFunc returns the topic of a field, ex: volume, mute or cast/send
+type TopicFunc func(field string) string
+
+// TopicData are the placeholders of a topic template
+type TopicData struct {
+	// ID is the name of the device in configuration
+	ID string
+	// Name is the cast name of the device
+	Name    string
+	UUID    string
+	Model   string
+	Room    string
+	Address string
+	// Field is the value published or subscribed, ex: volume
+	Field string
+}
+
+// TopicTemplate builds device topics with text/template placeholders, ex: home/{{.Room}}/{{.Name}}/{{.Field}}.
+// Placeholders are normalized to be valid topic levels, except Field. If the template doesn't use Field, it is
+// appended as last topic level.
+type TopicTemplate struct {
+	text     string
+	tmpl     *template.Template
+	perField bool
+}
+
+// CollisionField is the field of the topics compared to detect devices publishing to the same topics
+const CollisionField = "volume"
+
+var invalidTopicChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// ParseTopicTemplate parses and checks a topic template
+func ParseTopicTemplate(text string) (*TopicTemplate, error) {
+	tmpl, err := template.New("topic").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic template %q: %v", text, err)
+	}
+	t := TopicTemplate{
+		text:     text,
+		tmpl:     tmpl,
+		perField: strings.Contains(text, ".Field"),
+	}
+	sample := TopicData{ID: "id", Name: "name", UUID: "uuid", Model: "model", Room: "room", Address: "address"}
+	topic, err := t.render(sample, "field")
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return nil, fmt.Errorf("invalid topic template %q: topic can't contain wildcards", text)
+	}
+	return &t, nil
+}
+
+// Uses returns true if the template uses placeholder, ex: Name
+func (t *TopicTemplate) Uses(placeholder string) bool {
+	return strings.Contains(t.text, "."+placeholder)
+}
+
+func (t *TopicTemplate) render(data TopicData, field string) (string, error) {
+	data.Field = field
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to render topic template %q: %v", t.text, err)
+	}
+	if t.perField {
+		return buf.String(), nil
+	}
+	return buf.String() + "/" + field, nil
+}
+
+// fallback returns the topic of field when the template can't be rendered: the static levels of the template
+// followed by the device id
+func (t *TopicTemplate) fallback(data TopicData, field string) string {
+	static := t.text
+	if i := strings.Index(static, "{{"); i >= 0 {
+		static = static[:i]
+	}
+	levels := make([]string, 0, 3)
+	if static = strings.Trim(static, "/"); static != "" {
+		levels = append(levels, static)
+	}
+	return strings.Join(append(levels, data.ID, field), "/")
+}
+
+// Func returns the topics of a device, placeholders are normalized to lower case with '-' as separator. It fails if
+// a topic level is empty, ex: a name without ascii letter or digit. If the template can't be rendered for a field,
+// the error is logged and the topic falls back to the static levels of the template followed by the device id.
+func (t *TopicTemplate) Func(data TopicData) (TopicFunc, error) {
+	id := data.ID
+	data = TopicData{
+		ID:      normalizeTopicLevel(data.ID),
+		Name:    normalizeTopicLevel(data.Name),
+		UUID:    normalizeTopicLevel(data.UUID),
+		Model:   normalizeTopicLevel(data.Model),
+		Room:    normalizeTopicLevel(data.Room),
+		Address: normalizeTopicLevel(data.Address),
+	}
+	topic, err := t.render(data, CollisionField)
+	if err != nil {
+		return nil, err
+	}
+	for _, level := range strings.Split(topic, "/") {
+		if level == "" {
+			return nil, fmt.Errorf("topic %q of device %q has an empty level, a placeholder has no ascii letter or digit",
+				topic, id)
+		}
+	}
+	return func(field string) string {
+		topic, err := t.render(data, field)
+		if err != nil {
+			topic = t.fallback(data, field)
+			log.WithFields(log.Fields{
+				"device": data.ID,
+				"topic":  topic,
+			}).Errorf("unable to build topic, use static topic: %v", err)
+		}
+		return topic
+	}, nil
+}
+
+func normalizeTopicLevel(value string) string {
+	return strings.Trim(invalidTopicChars.ReplaceAllString(strings.ToLower(value), "-"), "-")
+}
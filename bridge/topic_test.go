@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"testing"
+)
+
+func TestTopicTemplate_Func(t *testing.T) {
+	tmpl, err := ParseTopicTemplate("home/{{.Room}}/{{.Name}}")
+	if err != nil {
+		t.Fatalf("unable to parse template: %v", err)
+	}
+	tests := []struct {
+		name     string
+		data     TopicData
+		expected string
+	}{
+		{"non ascii", TopicData{ID: "salon", Name: "Télé du Salon", Room: "Séjour"}, "home/s-jour/t-l-du-salon/volume"},
+		{"slash", TopicData{ID: "kitchen", Name: "Kitchen/Speaker", Room: "Kitchen"}, "home/kitchen/kitchen-speaker/volume"},
+		{"wildcards", TopicData{ID: "tv", Name: "TV +#1", Room: "Living Room"}, "home/living-room/tv-1/volume"},
+		{"only wildcards", TopicData{ID: "tv", Name: "+/#", Room: "Living Room"}, ""},
+		{"cyrillic", TopicData{ID: "lounge", Name: "Гостиная", Room: "Living Room"}, ""},
+		{"empty room", TopicData{ID: "tv", Name: "TV"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topics, err := tmpl.Func(tt.data)
+			if tt.expected == "" {
+				if err == nil {
+					t.Errorf("empty level accepted, topic %q", topics("volume"))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to build topics: %v", err)
+			}
+			if topic := topics("volume"); topic != tt.expected {
+				t.Errorf("topic %q, expected %q", topic, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTopicTemplate_FuncFallback(t *testing.T) {
+	// Topic of volume renders, other fields fail on index out of range
+	tmpl, err := ParseTopicTemplate(`home/devices/{{if eq .Field "volume" "field"}}{{.Room}}{{else}}{{index .Name 99}}{{end}}`)
+	if err != nil {
+		t.Fatalf("unable to parse template: %v", err)
+	}
+	topics, err := tmpl.Func(TopicData{ID: "Living_Room", Name: "TV", Room: "Kitchen"})
+	if err != nil {
+		t.Fatalf("unable to build topics: %v", err)
+	}
+	if topic := topics("mute"); topic != "home/devices/living_room/mute" {
+		t.Errorf("unexpected fallback topic %q", topic)
+	}
+}
+
+func TestParseTopicTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		data     TopicData
+		field    string
+		expected string
+	}{
+		{"chromecast/tv", TopicData{ID: "tv"}, "volume", "chromecast/tv/volume"},
+		{"home/{{.Room}}/{{.Name}}", TopicData{Room: "Living Room", Name: "Salon TV"}, "mute",
+			"home/living-room/salon-tv/mute"},
+		{"{{.Model}}/{{.UUID}}/{{.Field}}/state", TopicData{Model: "Chromecast Ultra", UUID: "AB12"}, "cast/send",
+			"chromecast-ultra/ab12/cast/send/state"},
+		{"cast/{{.ID}}", TopicData{ID: "Kitchen_1"}, "volume", "cast/kitchen_1/volume"},
+		{"cast/{{.Address}}", TopicData{Address: "192.168.1.10"}, "volume", "cast/192-168-1-10/volume"},
+		// Wildcards are removed from placeholders
+		{"cast/{{.Name}}", TopicData{Name: "a/+/#"}, "volume", "cast/a/volume"},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseTopicTemplate(tt.template)
+		if err != nil {
+			t.Errorf("unable to parse %q: %v", tt.template, err)
+			continue
+		}
+		topics, err := tmpl.Func(tt.data)
+		if err != nil {
+			t.Errorf("template %q: unable to build topics: %v", tt.template, err)
+			continue
+		}
+		if topic := topics(tt.field); topic != tt.expected {
+			t.Errorf("template %q: topic %q, expected %q", tt.template, topic, tt.expected)
+		}
+	}
+
+	for _, invalid := range []string{
+		"cast/{{.Name",
+		"cast/{{.Unknown}}",
+		"cast/+/{{.Name}}",
+		"cast/#",
+	} {
+		if _, err := ParseTopicTemplate(invalid); err == nil {
+			t.Errorf("invalid template %q accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package bridge
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes of cast spans
+const (
+	AttrDeviceName      = attribute.Key("device.name")
+	AttrDeviceUUID      = attribute.Key("device.uuid")
+	AttrCastNamespace   = attribute.Key("cast.namespace")
+	AttrCastSource      = attribute.Key("cast.source")
+	AttrCastDestination = attribute.Key("cast.destination")
+	AttrCastType        = attribute.Key("cast.type")
+	AttrCastRequestID   = attribute.Key("cast.request_id")
+	AttrCastAction      = attribute.Key("cast.action")
+	AttrEventType       = attribute.Key("bridge.event_type")
+	AttrMqttRetain      = attribute.Key("mqtt.retain")
+	// AttrQueueWait is the duration in milliseconds a message waited in the publish queue
+	AttrQueueWait = attribute.Key("bridge.queue_wait_ms")
+)
+
+// tracer creates spans of cast messages and commands with the global provider, spans are dropped until a provider
+// is registered
+var tracer = otel.Tracer("github.com/cyrilix/chromecast2mqt/bridge")
+
+// StartCommand starts the span of an MQTT command received on msg.Topic, it must be ended once the command is
+// applied
+func StartCommand(ctx context.Context, msg Message, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "mqtt.command", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		semconv.MessagingSystemKey.String("mqtt"),
+		semconv.MessagingDestinationKey.String(msg.Topic),
+		semconv.MessagingDestinationKindTopic,
+		semconv.MessagingOperationProcess,
+		semconv.MessagingMessagePayloadSizeBytesKey.Int(len(msg.Payload)),
+	), trace.WithAttributes(attrs...))
+}
+
+// StartCastRequest starts the span of a request sent to a device, it must be ended on the reply
+func StartCastRequest(ctx context.Context, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "cast.request", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends span, with an error status if err is not nil
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		recordError(span, err)
+	}
+	span.End()
+}
+
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// PublishMessage publishes with props if pub supports them, in a span child of ctx
+func PublishMessage(ctx context.Context, pub Publisher, topic string, retain bool, payload []byte,
+	props MessageProperties) error {
+	ctx, span := tracer.Start(ctx, "mqtt.publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		semconv.MessagingSystemKey.String("mqtt"),
+		semconv.MessagingDestinationKey.String(topic),
+		semconv.MessagingDestinationKindTopic,
+		semconv.MessagingMessagePayloadSizeBytesKey.Int(len(payload)),
+		AttrMqttRetain.Bool(retain),
+	))
+	if eventType, ok := props.UserProperties["event_type"]; ok {
+		span.SetAttributes(AttrEventType.String(eventType))
+	}
+	err := publishWithProperties(ctx, pub, topic, retain, payload, props)
+	EndSpan(span, err)
+	return err
+}
+
+// castType returns the attribute of the type of a decoded cast message
+func castType(msgType interface{}) attribute.KeyValue {
+	s, _ := msgType.(string)
+	return AttrCastType.String(s)
+}
@@ -0,0 +1,498 @@
+// Package castsim implements a fake cast receiver speaking the Cast v2 protocol, to run the bridge without a real
+// device.
+package castsim
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"github.com/grandcat/zeroconf"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	"github.com/vishen/go-chromecast/cast/proto"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	NamespaceConnection = "urn:x-cast:com.google.cast.tp.connection"
+	NamespaceHeartbeat  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	NamespaceReceiver   = "urn:x-cast:com.google.cast.receiver"
+	NamespaceMedia      = "urn:x-cast:com.google.cast.media"
+
+	receiverID         = "receiver-0"
+	broadcastID        = "*"
+	defaultMediaAppID  = "CC1AD845"
+	defaultTransportID = "web-1"
+
+	maxMessageSize = 64 * 1024
+)
+
+type Option func(*Server)
+
+// WithAddress sets the listen address, default to a random port on localhost
+func WithAddress(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithDevice sets the identity advertised by the simulator
+func WithDevice(name, uuid, model string) Option {
+	return func(s *Server) {
+		s.name = name
+		s.uuid = uuid
+		s.model = model
+	}
+}
+
+// WithMdns advertises the simulator as a _googlecast._tcp service so that it can be discovered
+func WithMdns(enabled bool) Option {
+	return func(s *Server) {
+		s.mdns = enabled
+	}
+}
+
+// Server is a fake cast receiver, it answers GET_STATUS, LAUNCH, STOP, LOAD, PLAY, PAUSE, SEEK, SET_VOLUME and PING
+// requests and broadcasts status changes to all connected senders.
+type Server struct {
+	addr  string
+	name  string
+	uuid  string
+	model string
+	mdns  bool
+
+	listener net.Listener
+	zeroconf *zeroconf.Server
+
+	mu             sync.Mutex
+	conns          map[*senderConn]struct{}
+	volume         cast.Volume
+	application    *cast.Application
+	media          *cast.Media
+	mediaSessionID int
+}
+
+func NewServer(opts ...Option) *Server {
+	s := Server{
+		addr:   "127.0.0.1:0",
+		name:   "Simulator",
+		uuid:   "00000000-0000-0000-0000-000000000000",
+		model:  "Chromecast",
+		conns:  make(map[*senderConn]struct{}),
+		volume: cast.Volume{Level: 0.5},
+	}
+	for _, o := range opts {
+		o(&s)
+	}
+	return &s
+}
+
+// Start listens for cast connections, call Close to stop the server
+func (s *Server) Start() error {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		return err
+	}
+	s.listener, err = tls.Listen("tcp", s.addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return errors.Wrapf(err, "unable to listen on %v", s.addr)
+	}
+
+	if s.mdns {
+		s.zeroconf, err = zeroconf.Register(s.name, "_googlecast._tcp", "local.", s.Port(), []string{
+			"id=" + s.uuid,
+			"fn=" + s.name,
+			"md=" + s.model,
+		}, nil)
+		if err != nil {
+			_ = s.listener.Close()
+			return errors.Wrap(err, "unable to register mdns service")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"addr": s.listener.Addr().String(),
+		"name": s.name,
+	}).Info("cast simulator started")
+	go s.accept()
+	return nil
+}
+
+// Addr returns the ip address the server listens on
+func (s *Server) Addr() string {
+	host, _, _ := net.SplitHostPort(s.listener.Addr().String())
+	return host
+}
+
+// Port returns the tcp port the server listens on
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+func (s *Server) Close() error {
+	if s.zeroconf != nil {
+		s.zeroconf.Shutdown()
+	}
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		_ = c.conn.Close()
+	}
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			log.Debugf("cast simulator stops accepting connections: %v", err)
+			return
+		}
+		c := &senderConn{conn: conn, server: s}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go c.serve()
+	}
+}
+
+// SetVolume changes the device volume and broadcasts a RECEIVER_STATUS
+func (s *Server) SetVolume(level float32, muted bool) error {
+	s.mu.Lock()
+	s.volume = cast.Volume{Level: level, Muted: muted}
+	s.mu.Unlock()
+	return s.Broadcast(NamespaceReceiver, s.receiverStatus(0))
+}
+
+// SetApplication starts an application on the device, as if launched by another sender, and broadcasts a
+// RECEIVER_STATUS
+func (s *Server) SetApplication(app cast.Application) error {
+	s.mu.Lock()
+	if app.TransportId == "" {
+		app.TransportId = defaultTransportID
+	}
+	if app.SessionId == "" {
+		app.SessionId = app.TransportId
+	}
+	s.application = &app
+	s.media = nil
+	s.mu.Unlock()
+	return s.Broadcast(NamespaceReceiver, s.receiverStatus(0))
+}
+
+// SetMedia changes the playing media and broadcasts a MEDIA_STATUS, an application must be running
+func (s *Server) SetMedia(media cast.Media) error {
+	s.mu.Lock()
+	if s.application == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("no running application")
+	}
+	if media.MediaSessionId == 0 {
+		s.mediaSessionID += 1
+		media.MediaSessionId = s.mediaSessionID
+	}
+	s.media = &media
+	s.mu.Unlock()
+	return s.Broadcast(NamespaceMedia, s.mediaStatus(0))
+}
+
+// Broadcast sends payload from the device to all connected senders
+func (s *Server) Broadcast(namespace string, payload interface{}) error {
+	s.mu.Lock()
+	source := receiverID
+	if namespace != NamespaceReceiver && namespace != NamespaceHeartbeat && s.application != nil {
+		source = s.application.TransportId
+	}
+	conns := make([]*senderConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		if err := c.send(namespace, source, broadcastID, payload); err != nil {
+			log.Warnf("unable to broadcast message to %v: %v", c.conn.RemoteAddr(), err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) receiverStatus(requestID int) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := cast.ReceiverStatusResponse{
+		PayloadHeader: cast.PayloadHeader{Type: "RECEIVER_STATUS", RequestId: requestID},
+	}
+	response.Status.Applications = make([]cast.Application, 0, 1)
+	if s.application != nil {
+		response.Status.Applications = append(response.Status.Applications, *s.application)
+	}
+	response.Status.Volume = s.volume
+	return response
+}
+
+func (s *Server) mediaStatus(requestID int) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := cast.MediaStatusResponse{
+		PayloadHeader: cast.PayloadHeader{Type: "MEDIA_STATUS", RequestId: requestID},
+		Status:        make([]cast.Media, 0, 1),
+	}
+	if s.media != nil {
+		media := *s.media
+		media.Volume = s.volume
+		response.Status = append(response.Status, media)
+	}
+	return response
+}
+
+func (s *Server) removeConn(c *senderConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// handle processes a request from a sender and returns the reply to send back, if any
+func (s *Server) handle(msg *api.CastMessage) (interface{}, bool) {
+	var request struct {
+		Type           string          `json:"type"`
+		RequestID      int             `json:"requestId"`
+		AppID          string          `json:"appId"`
+		Volume         json.RawMessage `json:"volume"`
+		Media          cast.MediaItem  `json:"media"`
+		CurrentTime    float32         `json:"currentTime"`
+		RelativeTime   float32         `json:"relativeTime"`
+		MediaSessionID int             `json:"mediaSessionId"`
+	}
+	if err := json.Unmarshal([]byte(msg.GetPayloadUtf8()), &request); err != nil {
+		log.Warnf("cast simulator received invalid payload %v: %v", msg.GetPayloadUtf8(), err)
+		return nil, false
+	}
+
+	switch msg.GetNamespace() {
+	case NamespaceHeartbeat:
+		if request.Type == "PING" {
+			return cast.PongHeader, true
+		}
+	case NamespaceReceiver:
+		switch request.Type {
+		case "GET_STATUS":
+			return s.receiverStatus(request.RequestID), true
+		case "LAUNCH":
+			s.mu.Lock()
+			s.application = &cast.Application{
+				AppId:       request.AppID,
+				DisplayName: request.AppID,
+				SessionId:   defaultTransportID,
+				TransportId: defaultTransportID,
+			}
+			s.media = nil
+			s.mu.Unlock()
+			go s.Broadcast(NamespaceReceiver, s.receiverStatus(0))
+			return s.receiverStatus(request.RequestID), true
+		case "STOP":
+			s.mu.Lock()
+			s.application = nil
+			s.media = nil
+			s.mu.Unlock()
+			go s.Broadcast(NamespaceReceiver, s.receiverStatus(0))
+			return s.receiverStatus(request.RequestID), true
+		case "SET_VOLUME":
+			s.setVolume(request.Volume)
+			go s.Broadcast(NamespaceReceiver, s.receiverStatus(0))
+			return s.receiverStatus(request.RequestID), true
+		}
+	case NamespaceMedia:
+		switch request.Type {
+		case "GET_STATUS":
+			return s.mediaStatus(request.RequestID), true
+		case "LOAD":
+			s.mu.Lock()
+			if s.application == nil {
+				s.application = &cast.Application{
+					AppId:       defaultMediaAppID,
+					DisplayName: "Default Media Receiver",
+					SessionId:   defaultTransportID,
+					TransportId: defaultTransportID,
+				}
+			}
+			s.mediaSessionID += 1
+			s.media = &cast.Media{
+				MediaSessionId: s.mediaSessionID,
+				PlayerState:    "PLAYING",
+				CurrentTime:    request.CurrentTime,
+				Media:          request.Media,
+			}
+			s.mu.Unlock()
+			return s.mediaStatus(request.RequestID), true
+		case "PLAY", "PAUSE", "STOP", "SEEK":
+			s.updateMedia(request.Type, request.CurrentTime, request.RelativeTime)
+			return s.mediaStatus(request.RequestID), true
+		}
+	}
+	log.WithFields(log.Fields{
+		"namespace": msg.GetNamespace(),
+		"type":      request.Type,
+	}).Debug("cast simulator ignores message")
+	return nil, false
+}
+
+func (s *Server) setVolume(content json.RawMessage) {
+	var volume map[string]interface{}
+	if err := json.Unmarshal(content, &volume); err != nil {
+		log.Warnf("cast simulator received invalid volume %s: %v", content, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Senders only set the changed field
+	if level, ok := volume["level"].(float64); ok {
+		s.volume.Level = float32(level)
+	}
+	if muted, ok := volume["muted"].(bool); ok {
+		s.volume.Muted = muted
+	}
+}
+
+func (s *Server) updateMedia(command string, currentTime, relativeTime float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.media == nil {
+		return
+	}
+	switch command {
+	case "PLAY":
+		s.media.PlayerState = "PLAYING"
+	case "PAUSE":
+		s.media.PlayerState = "PAUSED"
+	case "STOP":
+		s.media.PlayerState = "IDLE"
+		s.media.IdleReason = "CANCELLED"
+	case "SEEK":
+		if relativeTime != 0 {
+			s.media.CurrentTime += relativeTime
+		} else {
+			s.media.CurrentTime = currentTime
+		}
+	}
+}
+
+// senderConn is a connection from a sender to the simulator
+type senderConn struct {
+	conn   net.Conn
+	server *Server
+	mu     sync.Mutex
+}
+
+func (c *senderConn) serve() {
+	defer c.server.removeConn(c)
+	defer c.conn.Close()
+
+	logc := log.WithField("remote", c.conn.RemoteAddr().String())
+	logc.Debug("cast simulator new connection")
+	for {
+		var length uint32
+		if err := binary.Read(c.conn, binary.BigEndian, &length); err != nil {
+			if err != io.EOF {
+				logc.Debugf("cast simulator unable to read message length: %v", err)
+			}
+			return
+		}
+		if length == 0 || length > maxMessageSize {
+			logc.Warnf("cast simulator received invalid message length %d", length)
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, data); err != nil {
+			logc.Debugf("cast simulator unable to read message: %v", err)
+			return
+		}
+		var msg api.CastMessage
+		if err := proto.Unmarshal(data, &msg); err != nil {
+			logc.Warnf("cast simulator unable to unmarshal message: %v", err)
+			continue
+		}
+		if msg.GetPayloadType() != api.CastMessage_STRING {
+			continue
+		}
+
+		reply, ok := c.server.handle(&msg)
+		if !ok {
+			continue
+		}
+		if err := c.send(msg.GetNamespace(), msg.GetDestinationId(), msg.GetSourceId(), reply); err != nil {
+			logc.Warnf("cast simulator unable to reply: %v", err)
+			return
+		}
+	}
+}
+
+func (c *senderConn) send(namespace, source, destination string, payload interface{}) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal payload")
+	}
+	payloadUtf8 := string(content)
+	msg := api.CastMessage{
+		ProtocolVersion: api.CastMessage_CASTV2_1_0.Enum(),
+		SourceId:        &source,
+		DestinationId:   &destination,
+		Namespace:       &namespace,
+		PayloadType:     api.CastMessage_STRING.Enum(),
+		PayloadUtf8:     &payloadUtf8,
+	}
+	data, err := proto.Marshal(&msg)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal cast message")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := binary.Write(c.conn, binary.BigEndian, uint32(len(data))); err != nil {
+		return errors.Wrap(err, "unable to write message length")
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		return errors.Wrap(err, "unable to write message")
+	}
+	return nil
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "unable to generate key")
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "castsim"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "unable to create certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
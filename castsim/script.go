@@ -0,0 +1,90 @@
+package castsim
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	"os"
+	"time"
+)
+
+// Step is a scripted event emitted by the simulator, only one of Volume, Application, Media or Payload should be set
+type Step struct {
+	// Delay since previous step, as a go duration string
+	After string `json:"after,omitempty"`
+
+	Volume      *cast.Volume      `json:"volume,omitempty"`
+	Application *cast.Application `json:"application,omitempty"`
+	Media       *cast.Media       `json:"media,omitempty"`
+
+	// Raw payload broadcast as is on Namespace
+	Namespace string          `json:"namespace,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// LoadScript reads steps from a json lines file
+func LoadScript(path string) ([]Step, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open script %v", path)
+	}
+	defer f.Close()
+
+	steps := make([]Step, 0)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var step Step
+		if err := json.Unmarshal(scanner.Bytes(), &step); err != nil {
+			return nil, errors.Wrapf(err, "invalid step at line %d", line)
+		}
+		if step.After != "" {
+			if _, err := time.ParseDuration(step.After); err != nil {
+				return nil, errors.Wrapf(err, "invalid delay at line %d", line)
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps, scanner.Err()
+}
+
+// Play emits steps in order, it returns when all steps are emitted or ctx is done
+func (s *Server) Play(ctx context.Context, steps []Step) error {
+	for i, step := range steps {
+		if step.After != "" {
+			delay, err := time.ParseDuration(step.After)
+			if err != nil {
+				return errors.Wrapf(err, "invalid delay for step %d", i)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		log.WithField("step", i).Debug("cast simulator plays step")
+		var err error
+		switch {
+		case step.Volume != nil:
+			err = s.SetVolume(step.Volume.Level, step.Volume.Muted)
+		case step.Application != nil:
+			err = s.SetApplication(*step.Application)
+		case step.Media != nil:
+			err = s.SetMedia(*step.Media)
+		case step.Payload != nil:
+			err = s.Broadcast(step.Namespace, step.Payload)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to play step %d", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/cyrilix/chromecast2mqt/config"
+	"github.com/cyrilix/chromecast2mqt/mediaplayer"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	castdns "github.com/vishen/go-chromecast/dns"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// deviceFlags holds the device selection parameters shared by all subcommands
+type deviceFlags struct {
+	address    string
+	port       int
+	name       string
+	uuid       string
+	device     string
+	iface      string
+	dnsTimeout time.Duration
+}
+
+func (d *deviceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&d.address, "chromecast-addr", "", "Chromecast device ip address, if not set, discover from network")
+	fs.IntVar(&d.port, "chromecast-port", -1, "Chromecast device ip port, if not set, discover from network")
+	fs.StringVar(&d.name, "chromecast-name", "", "Name of the chromecast device to discover, if not set, use first device found")
+	fs.StringVar(&d.uuid, "chromecast-uuid", "", "Uuid of the chromecast device to discover, if not set, use first device found")
+	fs.StringVar(&d.device, "chromecast-device", "", "Type of the chromecast device to discover (ex: \"Google Home Mini\"), if not set, use first device found")
+	fs.StringVar(&d.iface, "iface", "", "Network interface to use for discovery, if not set, use all interfaces")
+	fs.DurationVar(&d.dnsTimeout, "dns-timeout", 10*time.Second, "Timeout of the device discovery")
+}
+
+// config converts flags to a device configuration without name
+func (d *deviceFlags) config() config.Device {
+	dev := config.Device{
+		Address:    d.address,
+		CastName:   d.name,
+		UUID:       d.uuid,
+		Model:      d.device,
+		Iface:      d.iface,
+		DnsTimeout: d.dnsTimeout,
+	}
+	if d.address != "" && d.port > 0 {
+		dev.Port = d.port
+	}
+	return dev
+}
+
+func (d *deviceFlags) options() []mediaplayer.ApplicationOption {
+	return deviceOptions(d.config())
+}
+
+func deviceOptions(d config.Device) []mediaplayer.ApplicationOption {
+	options := []mediaplayer.ApplicationOption{
+		mediaplayer.WithDnsTimeout(d.DnsTimeout),
+	}
+	if d.Address != "" {
+		options = append(options, mediaplayer.WithAddress(d.Address))
+		port := d.Port
+		if port <= 0 {
+			// Address set but not port => use default port
+			port = defaultChromecastPort
+		}
+		options = append(options, mediaplayer.WithPort(port))
+	}
+	if d.CastName != "" {
+		options = append(options, mediaplayer.WithDeviceName(d.CastName))
+	}
+	if d.UUID != "" {
+		options = append(options, mediaplayer.WithDeviceUuid(d.UUID))
+	}
+	if d.Model != "" {
+		options = append(options, mediaplayer.WithDevice(d.Model))
+	}
+	if d.Iface != "" {
+		options = append(options, mediaplayer.WithIface(d.Iface))
+	}
+	return options
+}
+
+func (d *deviceFlags) connect() (mediaplayer.Player, castdns.CastDNSEntry) {
+	logd := log.WithFields(log.Fields{
+		"address": d.address,
+		"port":    d.port,
+		"name":    d.name,
+		"uuid":    d.uuid,
+	})
+	entry, err := mediaplayer.FindDevice(d.options()...)
+	if err != nil {
+		logd.Fatalf("unable to find chromecast device: %v", err)
+	}
+	player, err := mediaplayer.Connect(entry, d.options()...)
+	if err != nil {
+		logd.Fatalf("unable to connect to chromecast application: %v", err)
+	}
+	return player, entry
+}
+
+func discover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	var iface, format string
+	var timeout time.Duration
+	fs.StringVar(&iface, "iface", "", "Network interface to use for discovery, if not set, use all interfaces")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "Discovery duration")
+	fs.StringVar(&format, "format", formatTable, "Output format: table or json")
+	debug := fs.Bool("debug", false, "Display debug logs")
+	_ = fs.Parse(args)
+	initLogs(*debug, os.Stderr)
+
+	entries, err := mediaplayer.DiscoverDevices(iface, timeout)
+	if err != nil {
+		log.Fatalf("unable to discover devices: %v", err)
+	}
+
+	if format == formatJSON {
+		printJSON(entries)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDEVICE\tADDRESS\tPORT\tUUID\tSTATUS")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", e.DeviceName, e.Device, e.GetAddr(), e.Port, e.UUID, e.Status)
+	}
+	_ = w.Flush()
+}
+
+type statusOutput struct {
+	Application *cast.Application `json:"application,omitempty"`
+	Media       *cast.Media       `json:"media,omitempty"`
+	Volume      *cast.Volume      `json:"volume,omitempty"`
+}
+
+func status(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	var device deviceFlags
+	var format string
+	device.register(fs)
+	fs.StringVar(&format, "format", formatTable, "Output format: table or json")
+	debug := fs.Bool("debug", false, "Display debug logs")
+	_ = fs.Parse(args)
+	initLogs(*debug, os.Stderr)
+
+	player, _ := device.connect()
+	defer player.Close()
+
+	castApp, media, volume := player.Status()
+	if format == formatJSON {
+		printJSON(statusOutput{Application: castApp, Media: media, Volume: volume})
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if castApp != nil {
+		fmt.Fprintf(w, "Application:\t%s (%s)\n", castApp.DisplayName, castApp.AppId)
+		fmt.Fprintf(w, "Status:\t%s\n", castApp.StatusText)
+	} else {
+		fmt.Fprintln(w, "Application:\tnone")
+	}
+	if media != nil {
+		fmt.Fprintf(w, "Player state:\t%s\n", media.PlayerState)
+		fmt.Fprintf(w, "Title:\t%s\n", media.Media.Metadata.Title)
+		fmt.Fprintf(w, "Artist:\t%s\n", media.Media.Metadata.Artist)
+		fmt.Fprintf(w, "Content:\t%s\n", media.Media.ContentId)
+		fmt.Fprintf(w, "Time:\t%.0fs / %.0fs\n", media.CurrentTime, media.Media.Duration)
+	}
+	if volume != nil {
+		fmt.Fprintf(w, "Volume:\t%d\n", int(100*volume.Level))
+		fmt.Fprintf(w, "Muted:\t%v\n", volume.Muted)
+	}
+	_ = w.Flush()
+}
+
+func controlCommand(args []string) {
+	fs := flag.NewFlagSet("control", flag.ExitOnError)
+	var device deviceFlags
+	var contentType string
+	device.register(fs)
+	fs.StringVar(&contentType, "content-type", "", "Content type of the media to load, if not set, guessed from url")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s control [flags] <play|pause|stop|next|previous|mute|unmute|volume <0-100>|seek <seconds>|load <url>>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	debug := fs.Bool("debug", false, "Display debug logs")
+	_ = fs.Parse(args)
+	initLogs(*debug, os.Stderr)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	req := bridge.ControlRequest{Action: fs.Arg(0), ContentType: contentType}
+	switch req.Action {
+	case "volume", "seek":
+		if fs.NArg() < 2 {
+			log.Fatalf("missing value for action %q", req.Action)
+		}
+		value, err := strconv.ParseFloat(fs.Arg(1), 32)
+		if err != nil {
+			log.Fatalf("invalid value %q for action %q: %v", fs.Arg(1), req.Action, err)
+		}
+		req.Value = float32(value)
+	case "load":
+		if fs.NArg() < 2 {
+			log.Fatalf("missing url for action %q", req.Action)
+		}
+		req.ContentID = fs.Arg(1)
+	}
+
+	player, _ := device.connect()
+	defer player.Close()
+
+	if err := bridge.Control(player, req); err != nil {
+		log.Fatalf("unable to apply %v: %v", req.Action, err)
+	}
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatalf("unable to encode json output: %v", err)
+	}
+}
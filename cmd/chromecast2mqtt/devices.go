@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/cyrilix/chromecast2mqt/config"
+	"github.com/cyrilix/chromecast2mqt/mediaplayer"
+	log "github.com/sirupsen/logrus"
+	castdns "github.com/vishen/go-chromecast/dns"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const reconnectDelay = 30 * time.Second
+
+// deviceSettings are the options of a device worker coming from the global configuration
+type deviceSettings struct {
+	// topic template
+	topic   string
+	retain  bool
+	formats []bridge.PayloadFormat
+	// homieBase is the base topic of the homie device, empty if homie schema isn't used
+	homieBase string
+}
+
+func newDeviceSettings(cfg *config.Config, dev config.Device) deviceSettings {
+	settings := deviceSettings{
+		topic:   cfg.DeviceTopic(dev),
+		retain:  cfg.Mqtt.Retain,
+		formats: cfg.PayloadFormats(),
+	}
+	if cfg.Topics.Schema == config.SchemaHomie {
+		settings.homieBase = cfg.Topics.HomieBase
+	}
+	return settings
+}
+
+// deviceWorker runs the bridge of a configured device, it retries to connect until its context is done
+type deviceWorker struct {
+	cfg      config.Device
+	settings deviceSettings
+	pub      bridge.Publisher
+	hub      *eventHub
+	state    *deviceState
+	homie    *bridge.HomieDevice
+	// counters are kept by deviceWorkers across restarts of the device
+	counters *bridge.Counters
+	// claims are the topics used by all devices, shared by deviceWorkers
+	claims *topicClaims
+
+	mu     sync.Mutex
+	player mediaplayer.Player
+	bridge *bridge.Bridge
+	// debug enables cast debug logs and raw messages publication
+	debug  bool
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newDeviceWorker(cfg config.Device, settings deviceSettings, pub bridge.Publisher, hub *eventHub) *deviceWorker {
+	w := deviceWorker{
+		cfg:      cfg,
+		settings: settings,
+		pub:      pub,
+		hub:      hub,
+		state:    newDeviceState(cfg.Name),
+		done:     make(chan struct{}),
+	}
+	if settings.homieBase != "" {
+		w.homie = bridge.NewHomieDevice(pub, settings.homieBase, bridge.HomieID(cfg.Name), log.WithField("device", cfg.Name))
+	}
+	return &w
+}
+
+func (w *deviceWorker) run(ctx context.Context) {
+	defer close(w.done)
+	if w.homie != nil {
+		defer w.homie.SetState(bridge.HomieDisconnected)
+	}
+	logw := log.WithFields(log.Fields{
+		"device": w.cfg.Name,
+		"topic":  w.settings.topic,
+	})
+	for {
+		err := w.runBridge(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logw.Errorf("device bridge stopped, retry in %v: %v", reconnectDelay, err)
+		w.hub.publish(w.cfg.Name, bridge.ConnectionChanged{Connected: false, Error: err.Error()})
+		if w.homie != nil {
+			w.homie.SetState(bridge.HomieLost)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (w *deviceWorker) runBridge(ctx context.Context) error {
+	options := deviceOptions(w.cfg)
+	entry, err := mediaplayer.FindDeviceContext(ctx, options...)
+	if err != nil {
+		return fmt.Errorf("unable to find chromecast device: %w", err)
+	}
+	player, err := mediaplayer.ConnectContext(ctx, entry, options...)
+	if err != nil {
+		return fmt.Errorf("unable to connect to chromecast application: %w", err)
+	}
+	defer player.Close()
+	channel, err := mediaplayer.NewChannel(entry.GetAddr(), entry.GetPort())
+	if err != nil {
+		return fmt.Errorf("unable to open cast channel: %w", err)
+	}
+	defer channel.Close()
+
+	logger := log.WithFields(log.Fields{
+		"device":         w.cfg.Name,
+		"device_uuid":    entry.GetUUID(),
+		"device_address": net.JoinHostPort(entry.GetAddr(), strconv.Itoa(entry.GetPort())),
+	})
+	bridgeOptions := []bridge.Option{
+		bridge.WithLogger(logger),
+		bridge.WithRetain(w.settings.retain),
+		bridge.WithRawPublish(w.cfg.PublishRaw),
+		bridge.WithChannel(channel),
+		bridge.WithPollInterval(w.cfg.PollInterval),
+		bridge.WithPayloadFormats(w.settings.formats...),
+		bridge.WithStatePublish(w.homie == nil),
+		bridge.WithUserProperties(map[string]string{
+			"device":      w.cfg.Name,
+			"device_uuid": entry.GetUUID(),
+		}),
+		bridge.WithCounters(w.counters),
+		bridge.WithTraceAttributes(
+			bridge.AttrDeviceName.String(w.cfg.Name),
+			bridge.AttrDeviceUUID.String(entry.GetUUID()),
+		),
+	}
+	if w.cfg.Record != "" {
+		rec, err := bridge.NewRecorder(w.cfg.Record)
+		if err != nil {
+			return fmt.Errorf("unable to record cast messages: %w", err)
+		}
+		defer rec.Close()
+		bridgeOptions = append(bridgeOptions, bridge.WithRecorder(rec))
+	}
+	topics, err := bridge.ParseTopicTemplate(w.settings.topic)
+	if err != nil {
+		return err
+	}
+	data := w.topicData(entry)
+	topicFunc, err := topics.Func(data)
+	if err != nil {
+		return err
+	}
+	release, err := w.claims.claim(topicFunc(bridge.CollisionField), w.cfg.Name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	bridgeOptions = append(bridgeOptions, bridge.WithTopicFunc(topicFunc))
+	b := bridge.New(player, w.pub, w.settings.topic, bridgeOptions...)
+
+	w.state.setEntry(entry)
+	events, unsubscribe := b.Subscribe(256)
+	defer unsubscribe()
+	go w.hub.forward(w.cfg.Name, events)
+
+	if w.homie != nil {
+		homieDone := make(chan struct{})
+		// Wait the end of the homie device after unsubscription so its state isn't published after lost
+		defer func() { <-homieDone }()
+		homieEvents, unsubscribeHomie := b.Subscribe(256)
+		defer unsubscribeHomie()
+		go func() {
+			defer close(homieDone)
+			if err := w.homie.Run(ctx, data.Name, player, homieEvents); err != nil {
+				logger.Errorf("unable to run homie device: %v", err)
+			}
+		}()
+	}
+
+	w.mu.Lock()
+	w.player, w.bridge = player, b
+	if w.debug {
+		w.applyDebug(player, b, true)
+	}
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.player, w.bridge = nil, nil
+		w.mu.Unlock()
+	}()
+
+	return b.Run(ctx)
+}
+
+func (w *deviceWorker) topicData(entry castdns.CastDNSEntry) bridge.TopicData {
+	data := bridge.TopicData{
+		ID:      w.cfg.Name,
+		Name:    entry.GetName(),
+		UUID:    entry.GetUUID(),
+		Model:   w.cfg.Model,
+		Room:    w.cfg.Room,
+		Address: entry.GetAddr(),
+	}
+	if e, ok := entry.(castdns.CastEntry); ok {
+		data.Model = e.Device
+	}
+	if data.Name == "" {
+		// Device set by address isn't discovered
+		data.Name = w.cfg.Name
+	}
+	return data
+}
+
+// view returns the state of the device for the web ui and its recent messages
+func (w *deviceWorker) view() (deviceView, []messageView) {
+	device, messages := w.state.view()
+	device.Messages = w.counters.Messages()
+	device.LastMessage = w.counters.LastMessage()
+	if errs := w.counters.Errors(); len(errs) > 0 {
+		device.Errors = errs
+	}
+	return device, messages
+}
+
+// sameConfig returns true if the worker runs with this configuration
+func (w *deviceWorker) sameConfig(cfg config.Device, settings deviceSettings) bool {
+	return w.cfg == cfg && reflect.DeepEqual(w.settings, settings)
+}
+
+// connected returns the player and bridge of the device, nil if the device is not connected
+func (w *deviceWorker) connected() (mediaplayer.Player, *bridge.Bridge) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.player, w.bridge
+}
+
+// setDebug enables cast debug logs and raw messages publication of the device, now and after reconnections
+func (w *deviceWorker) setDebug(debug bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.debug = debug
+	if w.player != nil {
+		w.applyDebug(w.player, w.bridge, debug)
+	}
+}
+
+func (w *deviceWorker) applyDebug(player mediaplayer.Player, b *bridge.Bridge, debug bool) {
+	player.SetDebug(debug)
+	b.SetRawPublish(w.cfg.PublishRaw || debug)
+}
+
+func (w *deviceWorker) check(ctx context.Context) error {
+	_, b := w.connected()
+	if b == nil {
+		return fmt.Errorf("device not connected")
+	}
+	return b.Check(ctx)
+}
+
+func (w *deviceWorker) refresh(ctx context.Context) error {
+	_, b := w.connected()
+	if b == nil {
+		return fmt.Errorf("device not connected")
+	}
+	return b.Refresh(ctx)
+}
+
+// topicClaims detects devices publishing to the same topics, ex: discovered devices with the same normalized name
+type topicClaims struct {
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+func newTopicClaims() *topicClaims {
+	return &topicClaims{owners: make(map[string]string)}
+}
+
+// claim reserves topic for device, it fails if another device uses it. The returned func releases the topic.
+func (c *topicClaims) claim(topic, device string) (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if owner, ok := c.owners[topic]; ok && owner != device {
+		return nil, fmt.Errorf("topic %q is already used by device %q", topic, owner)
+	}
+	c.owners[topic] = device
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.owners[topic] == device {
+			delete(c.owners, topic)
+		}
+	}, nil
+}
+
+// deviceWorkers indexes running workers by device name
+type deviceWorkers struct {
+	mu    sync.Mutex
+	items map[string]*deviceWorker
+	debug bool
+	// counters of each device since start, workers of a device share them
+	counters map[string]*bridge.Counters
+	claims   *topicClaims
+}
+
+func newDeviceWorkers() *deviceWorkers {
+	return &deviceWorkers{
+		items:    make(map[string]*deviceWorker),
+		counters: make(map[string]*bridge.Counters),
+		claims:   newTopicClaims(),
+	}
+}
+
+func (d *deviceWorkers) start(ctx context.Context, w *deviceWorker) {
+	ctx, w.cancel = context.WithCancel(ctx)
+
+	d.mu.Lock()
+	d.items[w.cfg.Name] = w
+	w.debug = d.debug
+	if _, ok := d.counters[w.cfg.Name]; !ok {
+		d.counters[w.cfg.Name] = bridge.NewCounters()
+	}
+	w.counters = d.counters[w.cfg.Name]
+	w.claims = d.claims
+	d.mu.Unlock()
+
+	go w.run(ctx)
+}
+
+// stop cancels the worker of device name and waits for its end
+func (d *deviceWorkers) stop(name string) {
+	d.mu.Lock()
+	w, ok := d.items[name]
+	delete(d.items, name)
+	d.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	w.cancel()
+	<-w.done
+}
+
+// get returns the worker of device name, name may be empty if only one device is configured
+func (d *deviceWorkers) get(name string) (*deviceWorker, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if name == "" {
+		if len(d.items) != 1 {
+			return nil, fmt.Errorf("device is mandatory when several devices are configured")
+		}
+		for _, w := range d.items {
+			return w, nil
+		}
+	}
+	w, ok := d.items[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown device %q", name)
+	}
+	return w, nil
+}
+
+// list returns workers sorted by device name
+func (d *deviceWorkers) list() []*deviceWorker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	workers := make([]*deviceWorker, 0, len(d.items))
+	for _, w := range d.items {
+		workers = append(workers, w)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].cfg.Name < workers[j].cfg.Name
+	})
+	return workers
+}
+
+func (d *deviceWorkers) onEvent(evt event) {
+	w, err := d.get(evt.Device)
+	if err != nil {
+		return
+	}
+	w.state.onEvent(evt)
+}
+
+// setDebug toggles debug of all devices, including devices started later
+func (d *deviceWorkers) setDebug(debug bool) {
+	d.mu.Lock()
+	d.debug = debug
+	d.mu.Unlock()
+	for _, w := range d.list() {
+		w.setDebug(debug)
+	}
+}
+
+// publishHomieLost sets $state of homie devices to lost after a connection loss, except the device of the last will
+// which was already set by the broker. refresh restores their state.
+func (d *deviceWorkers) publishHomieLost(will *mqttWill) {
+	for _, w := range d.list() {
+		if w.homie == nil || (will != nil && will.device == w.cfg.Name) {
+			continue
+		}
+		w.homie.PublishLost()
+	}
+}
+
+// refresh publishes state of all connected devices
+func (d *deviceWorkers) refresh(ctx context.Context) {
+	for _, w := range d.list() {
+		if w.homie != nil {
+			w.homie.PublishState()
+		}
+		if _, b := w.connected(); b == nil {
+			continue
+		}
+		if err := w.refresh(ctx); err != nil {
+			log.WithField("device", w.cfg.Name).Errorf("unable to refresh state: %v", err)
+		}
+	}
+}
+
+// wait returns when all workers are stopped
+func (d *deviceWorkers) wait() {
+	for _, w := range d.list() {
+		<-w.done
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/cyrilix/chromecast2mqt/config"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...". commit and
+// buildDate default to the vcs information embedded by go build.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type bridgeInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	BuildDate string    `json:"build_date,omitempty"`
+	GoVersion string    `json:"go_version"`
+	Hostname  string    `json:"hostname"`
+	Devices   []string  `json:"devices"`
+	StartTime time.Time `json:"start_time"`
+}
+
+type deviceHeartbeat struct {
+	Connected bool              `json:"connected"`
+	Messages  uint64            `json:"messages"`
+	Errors    map[string]uint64 `json:"errors,omitempty"`
+	// SinceLastMessage is in seconds, omitted before the first message
+	SinceLastMessage *float64 `json:"since_last_message,omitempty"`
+}
+
+type heartbeat struct {
+	Time time.Time `json:"time"`
+	// Uptime is in seconds
+	Uptime    float64                    `json:"uptime"`
+	Published uint64                     `json:"published"`
+	Dropped   uint64                     `json:"dropped"`
+	Failed    uint64                     `json:"failed"`
+	Devices   map[string]deviceHeartbeat `json:"devices"`
+}
+
+func newBridgeInfo(start time.Time) bridgeInfo {
+	info := bridgeInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		StartTime: start,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range build.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("unable to read hostname: %v", err)
+	}
+	info.Hostname = hostname
+	return info
+}
+
+// bridgeStatus publishes the retained <base>/bridge/info and periodic <base>/bridge/heartbeat
+type bridgeStatus struct {
+	pub     bridge.Publisher
+	queue   *bridge.QueuedPublisher
+	workers *deviceWorkers
+
+	mu       sync.Mutex
+	base     string
+	info     bridgeInfo
+	interval time.Duration
+	reset    chan time.Duration
+}
+
+func newBridgeStatus(queue *bridge.QueuedPublisher, workers *deviceWorkers, start time.Time) *bridgeStatus {
+	return &bridgeStatus{
+		pub:     queue,
+		queue:   queue,
+		workers: workers,
+		info:    newBridgeInfo(start),
+		reset:   make(chan time.Duration, 1),
+	}
+}
+
+// configure applies devices, base topic and heartbeat interval of cfg, then publishes info
+func (s *bridgeStatus) configure(cfg *config.Config) {
+	devices := make([]string, 0, len(cfg.Devices))
+	for _, dev := range cfg.Devices {
+		devices = append(devices, dev.Name)
+	}
+
+	s.mu.Lock()
+	s.base = cfg.Topics.Prefix
+	s.info.Devices = devices
+	changed := s.interval != cfg.Publish.HeartbeatInterval
+	s.interval = cfg.Publish.HeartbeatInterval
+	s.mu.Unlock()
+
+	if changed {
+		// Only the last interval matters
+		select {
+		case <-s.reset:
+		default:
+		}
+		s.reset <- cfg.Publish.HeartbeatInterval
+	}
+	s.publishInfo()
+}
+
+// publishInfo publishes bridge info, retained
+func (s *bridgeStatus) publishInfo() {
+	s.mu.Lock()
+	topic := s.base + "/bridge/info"
+	content, err := json.Marshal(s.info)
+	s.mu.Unlock()
+	if err != nil {
+		log.Errorf("unable to marshal bridge info: %v", err)
+		return
+	}
+	log.WithField("topic", topic).Info("publish bridge info")
+	if err := s.pub.Publish(topic, true, content); err != nil {
+		log.WithField("topic", topic).Errorf("unable to publish bridge info: %v", err)
+	}
+}
+
+func (s *bridgeStatus) heartbeat(now time.Time) heartbeat {
+	s.mu.Lock()
+	start := s.info.StartTime
+	s.mu.Unlock()
+
+	stats := s.queue.Stats()
+	hb := heartbeat{
+		Time:      now,
+		Uptime:    now.Sub(start).Seconds(),
+		Published: stats.Published,
+		Dropped:   stats.Dropped,
+		Failed:    stats.Failed,
+		Devices:   make(map[string]deviceHeartbeat),
+	}
+	for _, w := range s.workers.list() {
+		device, _ := w.view()
+		dh := deviceHeartbeat{Connected: device.Connected, Messages: device.Messages, Errors: device.Errors}
+		if !device.LastMessage.IsZero() {
+			since := now.Sub(device.LastMessage).Seconds()
+			dh.SinceLastMessage = &since
+		}
+		hb.Devices[w.cfg.Name] = dh
+	}
+	return hb
+}
+
+func (s *bridgeStatus) publishHeartbeat() {
+	s.mu.Lock()
+	topic := s.base + "/bridge/heartbeat"
+	s.mu.Unlock()
+	content, err := json.Marshal(s.heartbeat(time.Now()))
+	if err != nil {
+		log.Errorf("unable to marshal heartbeat: %v", err)
+		return
+	}
+	log.WithField("topic", topic).Debug("publish heartbeat")
+	if err := s.pub.Publish(topic, false, content); err != nil {
+		log.WithField("topic", topic).Errorf("unable to publish heartbeat: %v", err)
+	}
+}
+
+// run publishes heartbeats until ctx is done, configure must be called before
+func (s *bridgeStatus) run(ctx context.Context) {
+	ticker := time.NewTicker(<-s.reset)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case interval := <-s.reset:
+			ticker.Reset(interval)
+		case <-ticker.C:
+			s.publishHeartbeat()
+		}
+	}
+}
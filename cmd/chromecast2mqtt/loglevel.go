@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultDebugWindow = 15 * time.Minute
+
+// logLevelRequest is the payload of <base>/bridge/log_level/set and /api/log_level, a plain level is also accepted
+type logLevelRequest struct {
+	Level string `json:"level"`
+	// Duration of debug, as a go duration string
+	Duration string `json:"duration,omitempty"`
+}
+
+type logLevelStatus struct {
+	Level      string     `json:"level"`
+	Configured string     `json:"configured"`
+	DebugUntil *time.Time `json:"debug_until,omitempty"`
+}
+
+// logLevel changes the log level at runtime. Debug and trace levels also enable cast debug logs and raw messages
+// publication of all devices, until the end of a time window where the configured level is restored.
+type logLevel struct {
+	pub     bridge.Publisher
+	workers *deviceWorkers
+
+	mu         sync.Mutex
+	base       string
+	configured log.Level
+	timer      *time.Timer
+	debugUntil time.Time
+	// windowID identifies the running debug window, a timer may fire after its replacement
+	windowID int
+}
+
+func newLogLevel(pub bridge.Publisher, workers *deviceWorkers, configured log.Level) *logLevel {
+	return &logLevel{pub: pub, workers: workers, configured: configured}
+}
+
+// configure changes the level of configuration, it is applied unless a debug window is running
+func (l *logLevel) configure(level log.Level) {
+	l.mu.Lock()
+	l.configured = level
+	if l.timer == nil {
+		log.SetLevel(level)
+	}
+	l.mu.Unlock()
+	l.publishStatus()
+}
+
+// start subscribes the set topic of base, the previous one is unsubscribed
+func (l *logLevel) start(base string) error {
+	sub, ok := l.pub.(bridge.Subscriber)
+	if !ok {
+		return fmt.Errorf("publisher doesn't support subscriptions")
+	}
+
+	l.mu.Lock()
+	previous := l.base
+	l.base = base
+	l.mu.Unlock()
+
+	if previous == base {
+		return nil
+	}
+	if previous != "" {
+		if unsub, ok := l.pub.(bridge.Unsubscriber); ok {
+			if err := unsub.Unsubscribe(previous + "/bridge/log_level/set"); err != nil {
+				log.Warnf("unable to unsubscribe: %v", err)
+			}
+		}
+	}
+	l.publishStatus()
+	return sub.Subscribe(base+"/bridge/log_level/set", l.onSet)
+}
+
+func (l *logLevel) onSet(msg bridge.Message) {
+	logr := log.WithField("topic", msg.Topic)
+	req, err := parseLogLevelRequest(msg.Payload)
+	if err != nil {
+		logr.Errorf("invalid log level request: %v", err)
+		return
+	}
+	if err := l.set(req); err != nil {
+		logr.Errorf("unable to change log level: %v", err)
+	}
+}
+
+func parseLogLevelRequest(payload []byte) (logLevelRequest, error) {
+	payload = bytes.TrimSpace(payload)
+	if !bytes.HasPrefix(payload, []byte("{")) {
+		return logLevelRequest{Level: string(payload)}, nil
+	}
+	var req logLevelRequest
+	err := json.Unmarshal(payload, &req)
+	return req, err
+}
+
+// set changes the log level, debug is enabled for the duration of req
+func (l *logLevel) set(req logLevelRequest) error {
+	level, err := log.ParseLevel(req.Level)
+	if err != nil {
+		return err
+	}
+	window := defaultDebugWindow
+	if req.Duration != "" {
+		if window, err = time.ParseDuration(req.Duration); err != nil {
+			return fmt.Errorf("invalid duration: %w", err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("duration must be positive")
+		}
+	}
+	debug := level >= log.DebugLevel
+
+	l.mu.Lock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.debugUntil = time.Time{}
+	if debug {
+		l.debugUntil = time.Now().Add(window)
+		l.windowID += 1
+		id := l.windowID
+		l.timer = time.AfterFunc(window, func() { l.reset(id) })
+	}
+	log.SetLevel(level)
+	l.mu.Unlock()
+
+	fields := log.Fields{"log_level": level}
+	if debug {
+		fields["duration"] = window
+	}
+	log.WithFields(fields).Warn("log level changed")
+	l.workers.setDebug(debug)
+	l.publishStatus()
+	return nil
+}
+
+// reset restores the configured level at the end of a debug window
+func (l *logLevel) reset(id int) {
+	l.mu.Lock()
+	if l.windowID != id || l.timer == nil {
+		// Replaced by a new level
+		l.mu.Unlock()
+		return
+	}
+	l.timer = nil
+	l.debugUntil = time.Time{}
+	level := l.configured
+	log.SetLevel(level)
+	l.mu.Unlock()
+
+	log.WithField("log_level", level).Warn("end of debug, restore log level")
+	l.workers.setDebug(false)
+	l.publishStatus()
+}
+
+func (l *logLevel) status() logLevelStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := logLevelStatus{
+		Level:      log.GetLevel().String(),
+		Configured: l.configured.String(),
+	}
+	if !l.debugUntil.IsZero() {
+		until := l.debugUntil
+		status.DebugUntil = &until
+	}
+	return status
+}
+
+// publishStatus publishes the current level, retained, on <base>/bridge/log_level
+func (l *logLevel) publishStatus() {
+	l.mu.Lock()
+	base := l.base
+	l.mu.Unlock()
+	if base == "" {
+		return
+	}
+	content, err := json.Marshal(l.status())
+	if err != nil {
+		log.Errorf("unable to marshal log level: %v", err)
+		return
+	}
+	if err := l.pub.Publish(base+"/bridge/log_level", true, content); err != nil {
+		log.Errorf("unable to publish log level: %v", err)
+	}
+}
+
+// handler serves the current level on GET and changes it on POST
+func (l *logLevel) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !checkWriteRequest(w, r) {
+				return
+			}
+			var req logLevelRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := l.set(req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, l.status())
+	})
+}
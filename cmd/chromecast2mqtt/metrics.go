@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"net/http"
+	"sort"
+)
+
+// metricsHandler exposes bridge counters with prometheus text format, spool may be nil
+func metricsHandler(queue *bridge.QueuedPublisher, spool *bridge.SpoolPublisher, workers *deviceWorkers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		stats := queue.Stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetric(w, "chromecast2mqtt_publish_queue_depth", "gauge", "Messages waiting to be published", float64(stats.Depth))
+		writeMetric(w, "chromecast2mqtt_publish_queue_capacity", "gauge", "Max messages waiting to be published", float64(stats.Capacity))
+		writeMetric(w, "chromecast2mqtt_published_total", "counter", "Messages published", float64(stats.Published))
+		writeMetric(w, "chromecast2mqtt_publish_dropped_total", "counter", "Messages dropped on full queue", float64(stats.Dropped))
+		writeMetric(w, "chromecast2mqtt_publish_coalesced_total", "counter", "Messages replaced by a newer message of the same topic on full queue", float64(stats.Coalesced))
+		writeMetric(w, "chromecast2mqtt_publish_failed_total", "counter", "Messages not published because of an error or timeout", float64(stats.Failed))
+		writeDeviceErrors(w, workers)
+		if spool == nil {
+			return
+		}
+		spoolStats := spool.Stats()
+		writeMetric(w, "chromecast2mqtt_spool_size_bytes", "gauge", "Size of the spool file", float64(spoolStats.Size))
+		writeMetric(w, "chromecast2mqtt_spool_retained_pending", "gauge", "Retained topics waiting for reconnection", float64(spoolStats.Pending))
+		writeMetric(w, "chromecast2mqtt_spooled_total", "counter", "Events written to the spool", float64(spoolStats.Spooled))
+		writeMetric(w, "chromecast2mqtt_spool_dropped_total", "counter", "Events dropped on full spool", float64(spoolStats.Dropped))
+		writeMetric(w, "chromecast2mqtt_spool_replayed_total", "counter", "Spooled messages published after reconnection", float64(spoolStats.Replayed))
+	})
+}
+
+func writeMetric(w http.ResponseWriter, name, metricType, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, value)
+}
+
+// writeDeviceErrors writes the errors reported by devices, labeled by device and error type
+func writeDeviceErrors(w http.ResponseWriter, workers *deviceWorkers) {
+	const name = "chromecast2mqtt_device_errors_total"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, "Errors reported by devices", name)
+	for _, worker := range workers.list() {
+		device, _ := worker.view()
+		types := make([]string, 0, len(device.Errors))
+		for t := range device.Errors {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			fmt.Fprintf(w, "%s{device=%q,type=%q} %v\n", name, worker.cfg.Name, t, device.Errors[t])
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/cyrilix/chromecast2mqt/config"
+	"github.com/cyrilix/chromecast2mqt/mqtt5"
+	"github.com/cyrilix/mqtt-tools/mqttTooling"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// mqttWill is the retained message published by the broker when the connection is lost
+type mqttWill struct {
+	// device is the name of the device of the will
+	device  string
+	topic   string
+	payload string
+	qos     byte
+}
+
+// homieWill returns the will setting $state of the homie device to lost, nil if homie schema isn't used. A connection
+// has a single will, only the first device gets it, others are set to lost on reconnection by
+// deviceWorkers.publishHomieLost.
+func homieWill(cfg *config.Config) *mqttWill {
+	if cfg.Topics.Schema != config.SchemaHomie || len(cfg.Devices) == 0 {
+		return nil
+	}
+	if len(cfg.Devices) > 1 {
+		log.WithFields(log.Fields{
+			"device": cfg.Devices[0].Name,
+		}).Warn("mqtt last will only sets homie state of the first device to lost")
+	}
+	return &mqttWill{
+		device:  cfg.Devices[0].Name,
+		topic:   bridge.HomieStateTopic(cfg.Topics.HomieBase, bridge.HomieID(cfg.Devices[0].Name)),
+		payload: string(bridge.HomieLost),
+		qos:     byte(cfg.Mqtt.Qos),
+	}
+}
+
+// newMqttPublisher connects to the broker with the protocol version of cfg, will may be nil. The returned function
+// closes the connection.
+func newMqttPublisher(cfg config.Mqtt, will *mqttWill, onConnect func()) (bridge.Publisher, func(), error) {
+	params := mqttParameters(cfg)
+	if cfg.Version != 5 {
+		client, err := connectMqtt(params, will, onConnect)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bridge.NewMqttPublisher(client, byte(cfg.Qos)), func() { client.Disconnect(50) }, nil
+	}
+	client, err := connectMqtt5(params, cfg.SessionExpiry, will, onConnect)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bridge.NewMqtt5Publisher(client, byte(cfg.Qos), cfg.MessageExpiry), client.Disconnect, nil
+}
+
+// connectMqtt connects like mqttTooling.Connect, onConnect is called after the first connection and each reconnection
+func connectMqtt(params *mqttTooling.MqttCliParameters, will *mqttWill, onConnect func()) (MQTT.Client, error) {
+	opts := MQTT.NewClientOptions().AddBroker(params.Broker)
+	opts.SetUsername(params.Username)
+	opts.SetPassword(params.Password)
+	opts.SetClientID(params.ClientId)
+	opts.SetAutoReconnect(true)
+	opts.SetCleanSession(params.Clean)
+	if will != nil {
+		opts.SetWill(will.topic, will.payload, will.qos, true)
+	}
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		log.WithFields(log.Fields{
+			"broker": params.Broker,
+		}).Warnf("mqtt connection lost: %v", err)
+	})
+	opts.SetOnConnectHandler(func(_ MQTT.Client) {
+		log.WithFields(log.Fields{
+			"broker": params.Broker,
+		}).Info("mqtt connected")
+		if onConnect != nil {
+			onConnect()
+		}
+	})
+	if params.HasTLSConfig() {
+		tlsConfig, err := params.TLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure tls parameters: %v", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client := MQTT.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("unable to connect to mqtt bus: %v", token.Error())
+	}
+	return client, nil
+}
+
+// connectMqtt5 connects with MQTT v5, onConnect is called after the first connection and each reconnection
+func connectMqtt5(params *mqttTooling.MqttCliParameters, sessionExpiry time.Duration, will *mqttWill,
+	onConnect func()) (*mqtt5.Client, error) {
+	opts := mqtt5.ClientOptions{
+		Broker:        params.Broker,
+		ClientID:      params.ClientId,
+		Username:      params.Username,
+		Password:      params.Password,
+		CleanStart:    params.Clean,
+		SessionExpiry: sessionExpiry,
+		OnConnect: func() {
+			log.WithFields(log.Fields{
+				"broker": params.Broker,
+			}).Info("mqtt v5 connected")
+			if onConnect != nil {
+				onConnect()
+			}
+		},
+		OnConnectionLost: func(err error) {
+			log.WithFields(log.Fields{
+				"broker": params.Broker,
+			}).Warnf("mqtt connection lost: %v", err)
+		},
+	}
+	if params.HasTLSConfig() {
+		tlsConfig, err := params.TLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure tls parameters: %v", err)
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	if will != nil {
+		opts.Will = &mqtt5.Publish{Topic: will.topic, Payload: []byte(will.payload), QoS: will.qos, Retain: true}
+	}
+
+	client := mqtt5.NewClient(opts)
+	if err := client.Connect(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to connect to mqtt bus: %v", err)
+	}
+	return client, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/cyrilix/mqtt-tools/mqttTooling"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+func replay(args []string) {
+	var topic, file string
+	var speed float64
+	var debug, toStdout, publishRaw bool
+
+	flag.StringVar(&file, "file", "", "Record file to replay")
+	flag.StringVar(&topic, "topic", "", "The topic name to publish")
+	flag.Float64Var(&speed, "speed", 1, "Replay speed factor, 1 for real time, 0 to replay as fast as possible")
+	flag.BoolVar(&toStdout, "stdout", false, "Print messages to publish on stdout instead of mqtt bus")
+	flag.BoolVar(&publishRaw, "publish-raw", false, "Publish all cast messages to <topic>/raw/<namespace>")
+	flag.BoolVar(&debug, "debug", false, "Display debug logs")
+	parameters := mqttTooling.MqttCliParameters{
+		ClientId: defaultClientId + "-replay",
+	}
+
+	mqttTooling.InitMqttFlagSet(&parameters)
+	_ = flag.CommandLine.Parse(args)
+	initLogs(debug, os.Stderr)
+
+	if file == "" {
+		log.Fatal("file is mandatory")
+	}
+	if topic == "" {
+		log.Fatal("topic is mandatory")
+	}
+
+	var pub bridge.Publisher
+	if toStdout {
+		pub = bridge.NewWriterPublisher(os.Stdout)
+	} else {
+		client, err := mqttTooling.Connect(&parameters)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"broker": parameters.Broker,
+			}).Fatalf("unable to connect to mqtt bus: %v", err)
+		}
+		defer client.Disconnect(50)
+		pub = bridge.NewMqttPublisher(client, byte(parameters.Qos))
+	}
+
+	b := bridge.New(nil, pub, topic,
+		bridge.WithRetain(parameters.Retain),
+		bridge.WithRawPublish(publishRaw),
+	)
+	if err := bridge.ReplayFile(file, speed, b.Handle); err != nil {
+		log.Errorf("unable to replay %v: %v", file, err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rpcTimeout = 30 * time.Second
+	// rpcMaxPending is the max number of requests waiting for a device
+	rpcMaxPending = 16
+)
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcDeviceError    = -32000
+)
+
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Client string          `json:"client"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  *rpcError       `json:"error,omitempty"`
+}
+
+// rpcParams are the parameters of all methods, device may be omitted when a single device is bridged
+type rpcParams struct {
+	Device      string   `json:"device"`
+	Volume      *float32 `json:"volume"`
+	Muted       *bool    `json:"muted"`
+	Position    float32  `json:"position"`
+	URL         string   `json:"url"`
+	ContentType string   `json:"content_type"`
+}
+
+// deviceStatus is the result of device methods, read from the device after the call
+type deviceStatus struct {
+	Device      string            `json:"device"`
+	Application *cast.Application `json:"application,omitempty"`
+	Media       *cast.Media       `json:"media,omitempty"`
+	Volume      int               `json:"volume"`
+	Muted       bool              `json:"muted"`
+}
+
+// rpcServer answers requests of <base>/rpc/request on <base>/rpc/response/<client>, or on the response topic of
+// MQTT v5 requests. Requests of a device are processed in order.
+type rpcServer struct {
+	pub     bridge.Publisher
+	workers *deviceWorkers
+
+	mu   sync.Mutex
+	base string
+	// queues are the pending requests by device name
+	queues map[string]chan func()
+}
+
+func newRpcServer(pub bridge.Publisher, workers *deviceWorkers) *rpcServer {
+	return &rpcServer{pub: pub, workers: workers, queues: make(map[string]chan func())}
+}
+
+// validClient returns false if client can't be used as a topic level
+func validClient(client string) bool {
+	return !strings.ContainsAny(client, "/+#\x00")
+}
+
+// start subscribes the request topic of base, the previous one is unsubscribed
+func (s *rpcServer) start(base string) error {
+	sub, ok := s.pub.(bridge.Subscriber)
+	if !ok {
+		return fmt.Errorf("publisher doesn't support subscriptions")
+	}
+
+	s.mu.Lock()
+	previous := s.base
+	s.base = base
+	s.mu.Unlock()
+
+	if previous == base {
+		return nil
+	}
+	if previous != "" {
+		if unsub, ok := s.pub.(bridge.Unsubscriber); ok {
+			if err := unsub.Unsubscribe(previous + "/rpc/request"); err != nil {
+				log.Warnf("unable to unsubscribe: %v", err)
+			}
+		}
+	}
+	log.WithField("topic", base+"/rpc/request").Info("listen rpc requests")
+	return sub.Subscribe(base+"/rpc/request", s.onRequest)
+}
+
+func (s *rpcServer) onRequest(msg bridge.Message) {
+	ctx, span := bridge.StartCommand(context.Background(), msg, semconv.RPCSystemKey.String("jsonrpc"))
+	var req rpcRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		log.WithField("topic", msg.Topic).Errorf("invalid rpc request: %v", err)
+		s.reply(ctx, msg, req, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+		bridge.EndSpan(span, err)
+		return
+	}
+	span.SetAttributes(semconv.RPCMethodKey.String(req.Method))
+	if len(req.ID) > 0 {
+		span.SetAttributes(semconv.RPCJsonrpcRequestIDKey.String(string(req.ID)))
+	}
+	if !validClient(req.Client) {
+		err := fmt.Errorf("invalid client %q, it must not contain /, +, # or NUL", req.Client)
+		log.WithField("topic", msg.Topic).Errorf("invalid rpc request: %v", err)
+		// Only the response topic of the request can be used
+		req.Client = ""
+		s.reply(ctx, msg, req, rpcResponse{ID: req.ID, Error: &rpcError{Code: rpcInvalidRequest, Message: err.Error()}})
+		bridge.EndSpan(span, err)
+		return
+	}
+
+	handle := func() {
+		defer span.End()
+		result, err := s.call(ctx, req)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Message)
+		}
+		s.reply(ctx, msg, req, rpcResponse{ID: req.ID, Result: result, Error: err})
+	}
+	device, ok := s.device(req)
+	if !ok {
+		// The request is answered without waiting for a device
+		handle()
+		return
+	}
+	if !s.enqueue(device, handle) {
+		err := fmt.Errorf("too many pending requests for device %v", device)
+		log.WithField("topic", msg.Topic).Warnf("drop rpc request: %v", err)
+		s.reply(ctx, msg, req, rpcResponse{ID: req.ID, Error: &rpcError{Code: rpcDeviceError, Message: err.Error()}})
+		bridge.EndSpan(span, err)
+	}
+}
+
+// device returns the name of the device of req, false if the request doesn't reach a device
+func (s *rpcServer) device(req rpcRequest) (string, bool) {
+	if req.Method == "listDevices" {
+		return "", false
+	}
+	var params rpcParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return "", false
+		}
+	}
+	worker, err := s.workers.get(params.Device)
+	if err != nil {
+		return "", false
+	}
+	return worker.cfg.Name, true
+}
+
+// enqueue runs handle after the pending requests of device, devices may be slow to answer so they don't block
+// other messages. It returns false if too many requests are pending.
+func (s *rpcServer) enqueue(device string, handle func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue, ok := s.queues[device]
+	if !ok {
+		queue = make(chan func(), rpcMaxPending)
+		s.queues[device] = queue
+		go func() {
+			for h := range queue {
+				h()
+			}
+		}()
+	}
+
+	// mu is held so that forget doesn't close the queue
+	select {
+	case queue <- handle:
+		return true
+	default:
+		return false
+	}
+}
+
+// forget stops the queue of a removed device, pending requests are still answered
+func (s *rpcServer) forget(device string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if queue, ok := s.queues[device]; ok {
+		close(queue)
+		delete(s.queues, device)
+	}
+}
+
+func (s *rpcServer) reply(ctx context.Context, msg bridge.Message, req rpcRequest, resp rpcResponse) {
+	logr := log.WithFields(log.Fields{
+		"client": req.Client,
+		"method": req.Method,
+	})
+	topic := msg.ResponseTopic
+	if topic == "" {
+		if req.Client == "" || !validClient(req.Client) {
+			logr.Warn("rpc request without valid client nor response topic, drop response")
+			return
+		}
+		s.mu.Lock()
+		topic = s.base + "/rpc/response/" + req.Client
+		s.mu.Unlock()
+	}
+	content, err := json.Marshal(resp)
+	if err != nil {
+		logr.Errorf("unable to marshal rpc response: %v", err)
+		return
+	}
+	err = bridge.PublishMessage(ctx, s.pub, topic, false, content, bridge.MessageProperties{
+		CorrelationData: msg.CorrelationData,
+	})
+	if err != nil {
+		logr.Errorf("unable to publish rpc response: %v", err)
+	}
+}
+
+func (s *rpcServer) call(ctx context.Context, req rpcRequest) (interface{}, *rpcError) {
+	logr := log.WithFields(log.Fields{
+		"client": req.Client,
+		"method": req.Method,
+	})
+	if req.Method == "" {
+		return nil, &rpcError{Code: rpcInvalidRequest, Message: "method is mandatory"}
+	}
+	var params rpcParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+	}
+	logr.WithField("device", params.Device).Info("rpc request")
+
+	if req.Method == "listDevices" {
+		devices := make([]deviceView, 0)
+		for _, w := range s.workers.list() {
+			device, _ := w.view()
+			devices = append(devices, device)
+		}
+		return devices, nil
+	}
+
+	control, rpcErr := controlRequest(req.Method, params)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	worker, err := s.workers.get(params.Device)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	trace.SpanFromContext(ctx).SetAttributes(bridge.AttrDeviceName.String(worker.cfg.Name))
+	player, _ := worker.connected()
+	if player == nil {
+		return nil, &rpcError{Code: rpcDeviceError, Message: "device not connected"}
+	}
+
+	// The device may never reply, the request must not block the next ones
+	deviceCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	switch {
+	case req.Method == "refresh":
+		err = worker.refresh(deviceCtx)
+	case control != nil:
+		if err = bridge.ControlContext(deviceCtx, player, *control); err == nil {
+			err = bridge.UpdateContext(deviceCtx, player)
+		}
+	default:
+		err = bridge.UpdateContext(deviceCtx, player)
+	}
+	if err != nil {
+		logr.Errorf("rpc request failed: %v", err)
+		return nil, &rpcError{Code: rpcDeviceError, Message: err.Error()}
+	}
+
+	app, media, volume := player.Status()
+	status := deviceStatus{Device: worker.cfg.Name, Application: app, Media: media}
+	if volume != nil {
+		status.Volume = int(100 * volume.Level)
+		status.Muted = volume.Muted
+	}
+	return status, nil
+}
+
+// controlRequest converts a command method to a control request, nil for getStatus and refresh
+func controlRequest(method string, params rpcParams) (*bridge.ControlRequest, *rpcError) {
+	switch method {
+	case "getStatus", "refresh":
+		return nil, nil
+	case "setVolume":
+		if params.Volume == nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "volume is mandatory"}
+		}
+		return &bridge.ControlRequest{Action: "volume", Value: *params.Volume}, nil
+	case "setMuted":
+		if params.Muted == nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "muted is mandatory"}
+		}
+		if *params.Muted {
+			return &bridge.ControlRequest{Action: "mute"}, nil
+		}
+		return &bridge.ControlRequest{Action: "unmute"}, nil
+	case "play", "pause", "stop", "next", "previous":
+		return &bridge.ControlRequest{Action: method}, nil
+	case "seek":
+		return &bridge.ControlRequest{Action: "seek", Value: params.Position}, nil
+	case "load":
+		if params.URL == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "url is mandatory"}
+		}
+		return &bridge.ControlRequest{Action: "load", ContentID: params.URL, ContentType: params.ContentType}, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %q", method)}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRpcServer_Forget(t *testing.T) {
+	s := newRpcServer(nil, newDeviceWorkers())
+	handled := make(chan struct{})
+	if !s.enqueue("tv", func() { close(handled) }) {
+		t.Fatal("request not queued")
+	}
+	s.forget("tv")
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("pending request of removed device not answered")
+	}
+	if _, ok := s.queues["tv"]; ok {
+		t.Error("queue of removed device not stopped")
+	}
+	// A request for a device added again gets a new queue
+	handled = make(chan struct{})
+	if !s.enqueue("tv", func() { close(handled) }) {
+		t.Fatal("request not queued")
+	}
+	<-handled
+}
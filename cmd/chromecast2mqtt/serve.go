@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/cyrilix/chromecast2mqt/config"
+	"github.com/cyrilix/chromecast2mqt/tracing"
+	"github.com/cyrilix/mqtt-tools/mqttTooling"
+	"github.com/hellofresh/health-go/v4"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	legacyDeviceName     = "default"
+	defaultTopicTemplate = "chromecast/{{.Name}}"
+)
+
+func serve(args []string) {
+	var configFile, topic string
+	var device deviceFlags
+	var recordFile string
+	var debug, publishRaw bool
+	var queueSize int
+	var publishTimeout time.Duration
+	var queuePolicy string
+	var spoolDir string
+	var spoolMaxSize int64
+	var booleanFormat, volumeFormat string
+	var jsonPayload bool
+	var schema, homieBase string
+	var mqttVersion int
+	var pollInterval time.Duration
+	var sessionExpiry, messageExpiry time.Duration
+	var logFormat string
+	var heartbeatInterval time.Duration
+	var traceExporter, traceEndpoint string
+
+	flag.StringVar(&configFile, "config", os.Getenv("CHROMECAST2MQTT_CONFIG"), "Yaml config file, use CHROMECAST2MQTT_CONFIG env if arg not set. Other flags are ignored when set")
+	flag.StringVar(&topic, "topic", defaultTopicTemplate, "Topic template of published values, placeholders: {{.Name}}, {{.UUID}}, {{.Model}}, {{.Address}} and {{.Field}}")
+	device.register(flag.CommandLine)
+	flag.BoolVar(&debug, "debug", false, "Display debug logs")
+	flag.StringVar(&logFormat, "log-format", config.LogFormatText, "Format of log lines: text or json")
+	flag.BoolVar(&publishRaw, "publish-raw", false, "Publish all cast messages to <topic>/raw/<namespace>")
+	flag.StringVar(&recordFile, "record", "", "Append all received cast messages to this file as json lines, for later replay")
+	flag.IntVar(&queueSize, "queue-size", 256, "Max number of messages waiting to be published")
+	flag.DurationVar(&publishTimeout, "publish-timeout", 5*time.Second, "Max duration of a single mqtt publish")
+	flag.StringVar(&queuePolicy, "queue-policy", "drop-oldest", "Behaviour when publish queue is full: drop-oldest or coalesce")
+	flag.StringVar(&spoolDir, "spool-dir", "", "Directory of the file keeping events published while mqtt is disconnected, disabled if empty")
+	flag.Int64Var(&spoolMaxSize, "spool-max-size", 10*1024*1024, "Max size in bytes of the spool file")
+	flag.StringVar(&booleanFormat, "boolean-format", string(bridge.BooleanOnOff), "Format of boolean values: on_off, true_false or one_zero")
+	flag.StringVar(&volumeFormat, "volume-format", string(bridge.VolumePercent), "Format of volume: percent (0-100), ratio (0-1) or db")
+	flag.BoolVar(&jsonPayload, "json-payload", false, "Wrap published values in json with unit and timestamp")
+	flag.StringVar(&schema, "schema", config.SchemaDefault, "Schema of published values: default or homie (Homie 4 convention)")
+	flag.StringVar(&homieBase, "homie-base", bridge.DefaultHomieBase, "Base topic of homie devices")
+	flag.DurationVar(&pollInterval, "poll-interval", config.DefaultPollInterval, "Interval between two publications of device state")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", config.DefaultHeartbeat, "Interval between two publications of <prefix>/bridge/heartbeat")
+	flag.StringVar(&traceExporter, "trace-exporter", tracing.ExporterNone, "Exporter of spans of cast messages and mqtt commands: none, stdout or otlp")
+	flag.StringVar(&traceEndpoint, "trace-endpoint", tracing.DefaultEndpoint, "Traces url of the OTLP/HTTP collector")
+	flag.IntVar(&mqttVersion, "mqtt-version", 3, "Mqtt protocol version: 3 (3.1.1) or 5")
+	flag.DurationVar(&sessionExpiry, "mqtt-session-expiry", 0, "Duration the broker keeps the session after disconnection, mqtt v5 only")
+	flag.DurationVar(&messageExpiry, "mqtt-message-expiry", 0, "Lifetime of events not retained, mqtt v5 only")
+	parameters := mqttTooling.MqttCliParameters{
+		ClientId: defaultClientId,
+	}
+
+	mqttTooling.InitMqttFlagSet(&parameters)
+	_ = flag.CommandLine.Parse(args)
+	initLogs(debug, os.Stdout)
+
+	if configFile != "" {
+		cfg, err := config.Load(configFile)
+		if err != nil {
+			log.Fatalf("invalid config file %v:\n%v", configFile, err)
+		}
+		runServe(cfg, configFile)
+		return
+	}
+
+	cfg := config.Default()
+	cfg.Mqtt = config.Mqtt{
+		Broker:   parameters.Broker,
+		Username: parameters.Username,
+		Password: parameters.Password,
+		ClientId: parameters.ClientId,
+		Qos:      parameters.Qos,
+		Retain:   parameters.Retain,
+		Clean:    parameters.Clean,
+		CAFile:   parameters.CAFile,
+		CertFile: parameters.CertFile,
+		KeyFile:  parameters.KeyFile,
+
+		Version:       mqttVersion,
+		SessionExpiry: sessionExpiry,
+		MessageExpiry: messageExpiry,
+	}
+	dev := device.config()
+	dev.Name = legacyDeviceName
+	dev.Topic = topic
+	dev.PublishRaw = publishRaw
+	dev.Record = recordFile
+	dev.PollInterval = pollInterval
+	cfg.Devices = []config.Device{dev}
+	cfg.Publish = config.Publish{
+		QueueSize:    queueSize,
+		Timeout:      publishTimeout,
+		QueuePolicy:  queuePolicy,
+		SpoolDir:     spoolDir,
+		SpoolMaxSize: spoolMaxSize,
+
+		HeartbeatInterval: heartbeatInterval,
+	}
+	cfg.Payload.Boolean = booleanFormat
+	cfg.Payload.Volume = volumeFormat
+	cfg.Payload.JSON = jsonPayload
+	cfg.Topics.Schema = schema
+	cfg.Topics.HomieBase = homieBase
+	if debug {
+		cfg.Log.Level = "debug"
+	}
+	cfg.Log.Format = logFormat
+	cfg.Tracing = config.Tracing{Exporter: traceExporter, Endpoint: traceEndpoint}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid parameters:\n%v", err)
+	}
+	runServe(&cfg, "")
+}
+
+func mqttParameters(cfg config.Mqtt) *mqttTooling.MqttCliParameters {
+	return &mqttTooling.MqttCliParameters{
+		Broker:   cfg.Broker,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		CAFile:   cfg.CAFile,
+		CertFile: cfg.CertFile,
+		KeyFile:  cfg.KeyFile,
+		ClientId: cfg.ClientId,
+		Qos:      cfg.Qos,
+		Retain:   cfg.Retain,
+		Clean:    cfg.Clean,
+	}
+}
+
+// runServe runs the bridge of all devices, configFile is reloaded on SIGHUP if not empty
+func runServe(cfg *config.Config, configFile string) {
+	start := time.Now()
+	level, _ := log.ParseLevel(cfg.Log.Level)
+	log.SetLevel(level)
+	setLogFormat(cfg.Log.Format)
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing.Exporter, cfg.Tracing.Endpoint, version)
+	if err != nil {
+		log.Fatalf("unable to init tracing: %v", err)
+	}
+	defer func() {
+		// Export spans of last messages
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Publish.Timeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("unable to stop tracing: %v", err)
+		}
+	}()
+
+	connected := make(chan struct{}, 1)
+	will := homieWill(cfg)
+	mqttPub, disconnect, err := newMqttPublisher(cfg.Mqtt, will, func() {
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"broker": cfg.Mqtt.Broker,
+		}).Fatalf("unable to connect to mqtt bus: %v", err)
+	}
+	defer func() {
+		log.Infof("disconnect mqtt connection")
+		disconnect()
+	}()
+
+	pub := mqttPub
+	var spool *bridge.SpoolPublisher
+	if cfg.Publish.SpoolDir != "" {
+		spool, err = bridge.NewSpoolPublisher(pub, cfg.Publish.SpoolDir, cfg.Publish.SpoolMaxSize,
+			bridge.WithReplayTimeout(cfg.Publish.Timeout))
+		if err != nil {
+			log.Fatalf("unable to init spool: %v", err)
+		}
+		defer spool.Close()
+		pub = spool
+	}
+	policy, _ := bridge.ParseOverflowPolicy(cfg.Publish.QueuePolicy)
+	queue := bridge.NewQueuedPublisher(pub,
+		bridge.WithQueueSize(cfg.Publish.QueueSize),
+		bridge.WithPublishTimeout(cfg.Publish.Timeout),
+		bridge.WithOverflowPolicy(policy),
+	)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer cancel()
+
+	hub := newEventHub()
+	workers := newDeviceWorkers()
+	hub.addListener(workers.onEvent)
+	for _, dev := range cfg.Devices {
+		workers.start(ctx, newDeviceWorker(dev, newDeviceSettings(cfg, dev), queue, hub))
+	}
+	rpc := newRpcServer(queue, workers)
+	if err := rpc.start(cfg.Topics.Prefix); err != nil {
+		log.Errorf("unable to start rpc server: %v", err)
+	}
+	logLevel := newLogLevel(queue, workers, level)
+	if err := logLevel.start(cfg.Topics.Prefix); err != nil {
+		log.Errorf("unable to listen log level changes: %v", err)
+	}
+	status := newBridgeStatus(queue, workers, start)
+	status.configure(cfg)
+
+	if cfg.Http.Listen != "" {
+		healthz, _ := health.New(
+			health.WithChecks(health.Config{
+				Name:      "chromecast",
+				Timeout:   5 * time.Second,
+				SkipOnErr: false,
+				Check: func(ctx context.Context) error {
+					for _, w := range workers.list() {
+						if err := w.check(ctx); err != nil {
+							log.WithField("device", w.cfg.Name).Warnf("unable to check chromecast status: %v", err)
+							return fmt.Errorf("device %v: %w", w.cfg.Name, err)
+						}
+					}
+					return nil
+				},
+			}),
+		)
+		http.Handle("/status", healthz.Handler())
+		http.Handle("/metrics", metricsHandler(queue, spool, workers))
+		http.Handle("/events", sseHandler(hub))
+		http.Handle("/ws", wsHandler(hub))
+		registerWebHandlers(http.DefaultServeMux, workers)
+		http.Handle("/api/log_level", logLevel.handler())
+		log.Debug("run status handler")
+		go func() {
+			log.Fatal(http.ListenAndServe(cfg.Http.Listen, nil))
+		}()
+	}
+
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		queue.Run(ctx)
+	}()
+	go status.run(ctx)
+	if spool != nil {
+		go spool.Run(ctx)
+	}
+	go func() {
+		reconnection := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-connected:
+				if p, ok := mqttPub.(*bridge.MqttPublisher); ok {
+					if err := p.Resubscribe(); err != nil {
+						log.Errorf("unable to restore subscriptions: %v", err)
+					}
+				}
+				if spool != nil {
+					if err := spool.Flush(ctx); err != nil {
+						log.Errorf("unable to replay spooled messages: %v", err)
+					}
+				}
+				// Retained state may have been lost by the broker
+				status.publishInfo()
+				if reconnection {
+					workers.publishHomieLost(will)
+				}
+				reconnection = true
+				workers.refresh(ctx)
+			}
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	log.Debug("listen chromecast events")
+	for {
+		select {
+		case <-ctx.Done():
+			workers.wait()
+			<-queueDone
+			// Publish last states of stopped devices
+			flushCtx, cancelFlush := context.WithTimeout(context.Background(), cfg.Publish.Timeout)
+			queue.Flush(flushCtx)
+			cancelFlush()
+			return
+		case <-hup:
+			if configFile == "" {
+				log.Warn("SIGHUP received but no config file to reload")
+				continue
+			}
+			cfg = reloadConfig(ctx, cfg, configFile, workers, queue, hub, rpc, logLevel, status)
+		}
+	}
+}
+
+// reloadConfig applies configFile on running bridge, only devices added, removed or changed are restarted. Current
+// configuration is kept if configFile is invalid.
+func reloadConfig(ctx context.Context, current *config.Config, configFile string, workers *deviceWorkers,
+	queue *bridge.QueuedPublisher, hub *eventHub, rpc *rpcServer, logLevel *logLevel,
+	status *bridgeStatus) *config.Config {
+	logr := log.WithField("config", configFile)
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		logr.Errorf("invalid config file, keep current configuration:\n%v", err)
+		return current
+	}
+	logr.Info("reload configuration")
+
+	if cfg.Mqtt != current.Mqtt {
+		logr.Warn("mqtt connection changes need a restart, ignore them")
+		cfg.Mqtt = current.Mqtt
+	}
+	if cfg.Http != current.Http {
+		logr.Warn("http changes need a restart, ignore them")
+		cfg.Http = current.Http
+	}
+	if cfg.Tracing != current.Tracing {
+		logr.Warn("tracing changes need a restart, ignore them")
+		cfg.Tracing = current.Tracing
+	}
+	if cfg.Publish.SpoolDir != current.Publish.SpoolDir || cfg.Publish.SpoolMaxSize != current.Publish.SpoolMaxSize {
+		logr.Warn("spool changes need a restart, ignore them")
+		cfg.Publish.SpoolDir = current.Publish.SpoolDir
+		cfg.Publish.SpoolMaxSize = current.Publish.SpoolMaxSize
+	}
+
+	level, _ := log.ParseLevel(cfg.Log.Level)
+	logLevel.configure(level)
+	setLogFormat(cfg.Log.Format)
+	policy, _ := bridge.ParseOverflowPolicy(cfg.Publish.QueuePolicy)
+	queue.Reconfigure(
+		bridge.WithQueueSize(cfg.Publish.QueueSize),
+		bridge.WithPublishTimeout(cfg.Publish.Timeout),
+		bridge.WithOverflowPolicy(policy),
+	)
+
+	devices := make(map[string]config.Device)
+	for _, dev := range cfg.Devices {
+		devices[dev.Name] = dev
+	}
+	for _, w := range workers.list() {
+		dev, ok := devices[w.cfg.Name]
+		switch {
+		case !ok:
+			logr.WithField("device", w.cfg.Name).Info("device removed, stop it")
+		case !w.sameConfig(dev, newDeviceSettings(cfg, dev)):
+			logr.WithField("device", w.cfg.Name).Info("device changed, restart it")
+		default:
+			delete(devices, w.cfg.Name)
+			continue
+		}
+		workers.stop(w.cfg.Name)
+		hub.forget(w.cfg.Name)
+		if !ok {
+			rpc.forget(w.cfg.Name)
+		}
+	}
+	for _, dev := range cfg.Devices {
+		if _, ok := devices[dev.Name]; !ok {
+			continue
+		}
+		logr.WithField("device", dev.Name).Info("start device")
+		workers.start(ctx, newDeviceWorker(dev, newDeviceSettings(cfg, dev), queue, hub))
+	}
+	if err := rpc.start(cfg.Topics.Prefix); err != nil {
+		logr.Errorf("unable to restart rpc server: %v", err)
+	}
+	if err := logLevel.start(cfg.Topics.Prefix); err != nil {
+		logr.Errorf("unable to listen log level changes: %v", err)
+	}
+	status.configure(cfg)
+	return cfg
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/cyrilix/chromecast2mqt/castsim"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func simulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var addr, name, uuid, model, script string
+	var mdns, debug bool
+	fs.StringVar(&addr, "addr", "127.0.0.1:8009", "Listen address of the simulated device")
+	fs.StringVar(&name, "name", "Simulator", "Name of the simulated device")
+	fs.StringVar(&uuid, "uuid", "00000000-0000-0000-0000-000000000000", "Uuid of the simulated device")
+	fs.StringVar(&model, "model", "Chromecast", "Model of the simulated device")
+	fs.StringVar(&script, "script", "", "Json lines file of events to emit after start")
+	fs.BoolVar(&mdns, "mdns", false, "Advertise simulated device on network")
+	fs.BoolVar(&debug, "debug", false, "Display debug logs")
+	_ = fs.Parse(args)
+	initLogs(debug, os.Stdout)
+
+	var steps []castsim.Step
+	if script != "" {
+		var err error
+		if steps, err = castsim.LoadScript(script); err != nil {
+			log.Fatalf("unable to load script: %v", err)
+		}
+	}
+
+	server := castsim.NewServer(
+		castsim.WithAddress(addr),
+		castsim.WithDevice(name, uuid, model),
+		castsim.WithMdns(mdns),
+	)
+	if err := server.Start(); err != nil {
+		log.Fatalf("unable to start simulator: %v", err)
+	}
+	defer server.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+
+	if len(steps) > 0 {
+		go func() {
+			if err := server.Play(ctx, steps); err != nil {
+				log.Errorf("unable to play script: %v", err)
+				return
+			}
+			log.Info("script done")
+		}()
+	}
+	<-ctx.Done()
+	log.Info("exit simulator")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval    = 15 * time.Second
+	subscriberBufferSize = 16
+)
+
+type event struct {
+	Type   string       `json:"type"`
+	Device string       `json:"device"`
+	Time   time.Time    `json:"time"`
+	Data   bridge.Event `json:"data"`
+}
+
+// eventHub dispatches bridge events to http stream subscribers and keeps
+// the last event of each type and device to send a snapshot to new subscribers.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan event]struct{}
+	listeners   []func(event)
+	snapshot    map[string]event
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[chan event]struct{}),
+		snapshot:    make(map[string]event),
+	}
+}
+
+// forward publishes all events of device until events is closed
+func (h *eventHub) forward(device string, events <-chan bridge.Event) {
+	for evt := range events {
+		h.publish(device, evt)
+	}
+}
+
+func (h *eventHub) publish(device string, data bridge.Event) {
+	evt := event{
+		Type:   data.EventType(),
+		Device: device,
+		Time:   time.Now(),
+		Data:   data,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.snapshot[evt.Device+"/"+evt.Type] = evt
+	for _, l := range h.listeners {
+		l(evt)
+	}
+	for sub := range h.subscribers {
+		select {
+		case sub <- evt:
+		default:
+			log.WithField("type", evt.Type).Warn("stream subscriber too slow, drop event")
+		}
+	}
+}
+
+// forget removes the snapshot of a device no longer bridged
+func (h *eventHub) forget(device string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, evt := range h.snapshot {
+		if evt.Device == device {
+			delete(h.snapshot, key)
+		}
+	}
+}
+
+// addListener registers a function called synchronously on each event, unlike
+// subscribers, listeners never miss an event.
+func (h *eventHub) addListener(l func(event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, l)
+}
+
+func (h *eventHub) subscribe() (chan event, []event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := make(chan event, subscriberBufferSize)
+	h.subscribers[sub] = struct{}{}
+
+	snapshot := make([]event, 0, len(h.snapshot))
+	for _, evt := range h.snapshot {
+		snapshot = append(snapshot, evt)
+	}
+	return sub, snapshot
+}
+
+func (h *eventHub) unsubscribe(sub chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, sub)
+}
+
+func sseHandler(hub *eventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		sub, snapshot := hub.subscribe()
+		defer hub.unsubscribe(sub)
+
+		logs := log.WithField("remote", r.RemoteAddr)
+		logs.Debug("new sse subscriber")
+
+		writeEvent := func(evt event) error {
+			content, err := json.Marshal(evt)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, content); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		for _, evt := range snapshot {
+			if err := writeEvent(evt); err != nil {
+				logs.Debugf("unable to write sse snapshot: %v", err)
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				logs.Debug("sse subscriber disconnected")
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					logs.Debugf("unable to write sse heartbeat: %v", err)
+					return
+				}
+				flusher.Flush()
+			case evt := <-sub:
+				if err := writeEvent(evt); err != nil {
+					logs.Debugf("unable to write sse event: %v", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+func wsHandler(hub *eventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Warnf("unable to upgrade websocket connection: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		sub, snapshot := hub.subscribe()
+		defer hub.unsubscribe(sub)
+
+		logs := log.WithField("remote", r.RemoteAddr)
+		logs.Debug("new websocket subscriber")
+
+		// Read loop is only used to handle control messages and detect
+		// client disconnection
+		done := make(chan struct{})
+		conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+		})
+		go func() {
+			defer close(done)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for _, evt := range snapshot {
+			if err := conn.WriteJSON(evt); err != nil {
+				logs.Debugf("unable to write websocket snapshot: %v", err)
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-done:
+				logs.Debug("websocket subscriber disconnected")
+				return
+			case <-heartbeat.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					logs.Debugf("unable to write websocket heartbeat: %v", err)
+					return
+				}
+			case evt := <-sub:
+				if err := conn.WriteJSON(evt); err != nil {
+					logs.Debugf("unable to write websocket event: %v", err)
+					return
+				}
+			}
+		}
+	}
+}
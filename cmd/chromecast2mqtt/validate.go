@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/config"
+	"os"
+)
+
+func validateConfig(args []string) {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configFile := fs.String("config", os.Getenv("CHROMECAST2MQTT_CONFIG"), "Yaml config file, use CHROMECAST2MQTT_CONFIG env if arg not set")
+	envNames := fs.Bool("env", false, "List environment variables overriding config options")
+	_ = fs.Parse(args)
+
+	if *envNames {
+		for _, name := range config.EnvNames() {
+			fmt.Println(name)
+		}
+		return
+	}
+	if *configFile == "" && fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+	if *configFile == "" {
+		fmt.Fprintln(os.Stderr, "config file is mandatory")
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		errs, ok := err.(config.Errors)
+		if !ok {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, e := range errs {
+			switch {
+			case e.Line == 0:
+				fmt.Fprintf(os.Stderr, "%s: %s: %s\n", *configFile, e.Path, e.Message)
+			case e.Path == "":
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", *configFile, e.Line, e.Message)
+			default:
+				fmt.Fprintf(os.Stderr, "%s:%d: %s: %s\n", *configFile, e.Line, e.Path, e.Message)
+			}
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s: valid configuration, %d device(s)\n", *configFile, len(cfg.Devices))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	castdns "github.com/vishen/go-chromecast/dns"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxRecentMessages = 50
+
+//go:embed web
+var webContent embed.FS
+
+type deviceView struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	UUID        string            `json:"uuid,omitempty"`
+	Address     string            `json:"address"`
+	Port        int               `json:"port"`
+	Connected   bool              `json:"connected"`
+	LastError   string            `json:"last_error,omitempty"`
+	LastSeen    time.Time         `json:"last_seen"`
+	Application *cast.Application `json:"application,omitempty"`
+	Media       *cast.Media       `json:"media,omitempty"`
+	Volume      int               `json:"volume"`
+	Muted       bool              `json:"muted"`
+	// Errors counts device errors by type since start, they are kept across config reloads
+	Errors map[string]uint64 `json:"errors,omitempty"`
+	// Messages counts cast messages received since start, LastMessage is the time of the last one
+	Messages    uint64    `json:"messages"`
+	LastMessage time.Time `json:"last_message"`
+}
+
+// messageView is a raw message of a device
+type messageView struct {
+	Device string `json:"device"`
+	bridge.RawMessage
+}
+
+// deviceState aggregates hub events to serve the current state of the device
+// to the web ui.
+type deviceState struct {
+	mu       sync.Mutex
+	device   deviceView
+	messages []messageView
+}
+
+func newDeviceState(id string) *deviceState {
+	return &deviceState{
+		device: deviceView{
+			ID: id,
+		},
+		messages: make([]messageView, 0, maxRecentMessages),
+	}
+}
+
+// setEntry updates the device found on network
+func (s *deviceState) setEntry(entry castdns.CastDNSEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.device.Name = entry.GetName()
+	s.device.UUID = entry.GetUUID()
+	s.device.Address = entry.GetAddr()
+	s.device.Port = entry.GetPort()
+	s.device.Connected = true
+	s.device.LastError = ""
+}
+
+func (s *deviceState) onEvent(evt event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch data := evt.Data.(type) {
+	case bridge.ConnectionChanged:
+		s.device.Connected = data.Connected
+		s.device.LastError = data.Error
+		return
+	case bridge.RawMessage:
+		if len(s.messages) == maxRecentMessages {
+			s.messages = s.messages[1:]
+		}
+		s.messages = append(s.messages, messageView{Device: s.device.ID, RawMessage: data})
+	case bridge.ReceiverStatusChanged:
+		s.device.Application = nil
+		for i := range data.Applications {
+			s.device.Application = &data.Applications[i]
+		}
+		s.device.Volume = int(100 * data.Volume.Level)
+		s.device.Muted = data.Volume.Muted
+	case bridge.MediaStatusChanged:
+		s.device.Media = nil
+		for i := range data.Media {
+			s.device.Media = &data.Media[i]
+		}
+	}
+	s.device.LastSeen = evt.Time
+}
+
+func (s *deviceState) view() (deviceView, []messageView) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]messageView, len(s.messages))
+	copy(messages, s.messages)
+	return s.device, messages
+}
+
+func registerWebHandlers(mux *http.ServeMux, workers *deviceWorkers) {
+	static, err := fs.Sub(webContent, "web")
+	if err != nil {
+		log.Fatalf("unable to load embedded web content: %v", err)
+	}
+	mux.Handle("/", http.FileServer(http.FS(static)))
+
+	mux.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		devices := make([]deviceView, 0)
+		for _, worker := range workers.list() {
+			device, _ := worker.view()
+			devices = append(devices, device)
+		}
+		writeJSON(w, devices)
+	})
+	mux.HandleFunc("/api/messages", func(w http.ResponseWriter, r *http.Request) {
+		messages := make([]messageView, 0)
+		for _, worker := range workers.list() {
+			if device := r.URL.Query().Get("device"); device != "" && device != worker.cfg.Name {
+				continue
+			}
+			_, msgs := worker.view()
+			messages = append(messages, msgs...)
+		}
+		sort.SliceStable(messages, func(i, j int) bool {
+			return messages[i].Time.Before(messages[j].Time)
+		})
+		writeJSON(w, messages)
+	})
+	mux.HandleFunc("/api/control", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkWriteRequest(w, r) {
+			return
+		}
+		var req bridge.ControlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		worker, err := workers.get(r.URL.Query().Get("device"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		player, _ := worker.connected()
+		if player == nil {
+			http.Error(w, "device not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		logc := log.WithFields(log.Fields{
+			"device": worker.cfg.Name,
+			"action": req.Action,
+			"value":  req.Value,
+		})
+		logc.Info("web control request")
+		if err := bridge.Control(player, req); err != nil {
+			logc.Errorf("unable to apply control request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// checkWriteRequest rejects requests changing the bridge that may come from a page of another site, the error is
+// written to w. Forms of other sites can't send json, fetch from other sites sends their origin.
+func checkWriteRequest(w http.ResponseWriter, r *http.Request) bool {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross origin request", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// sameOrigin returns false if the request comes from a page of another host, requests without Origin header don't come
+// from a browser
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("unable to write json response: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+'use strict';
+
+const maxMessages = 50;
+
+async function refreshDevices() {
+    const response = await fetch('api/devices');
+    if (!response.ok) {
+        return;
+    }
+    renderDevices(await response.json());
+}
+
+async function loadMessages() {
+    const response = await fetch('api/messages');
+    if (!response.ok) {
+        return;
+    }
+    const messages = await response.json();
+    messages.forEach(addMessage);
+}
+
+async function control(device, action, value) {
+    const response = await fetch(`api/control?device=${encodeURIComponent(device)}`, {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({action: action, value: value || 0}),
+    });
+    if (!response.ok) {
+        alert(`${action} failed: ${await response.text()}`);
+    }
+}
+
+function renderDevices(devices) {
+    const container = document.getElementById('devices');
+    const template = document.getElementById('device-template');
+    container.replaceChildren();
+
+    devices.forEach(device => {
+        const node = template.content.cloneNode(true);
+        const media = device.media || {};
+        const metadata = (media.media || {}).metadata || {};
+        const images = metadata.images || [];
+
+        node.querySelector('.device-address').textContent = `${device.id}: ${device.name || 'device'} (${device.address}:${device.port})`;
+        const connection = node.querySelector('.device-connection');
+        connection.textContent = device.connected ? 'connected' : `disconnected ${device.last_error || ''}`;
+        connection.classList.add(device.connected ? 'ok' : 'ko');
+        node.querySelector('.device-last-seen').textContent = new Date(device.last_seen).toLocaleTimeString();
+
+        node.querySelector('.app').textContent = device.application ? device.application.displayName : 'no application';
+        node.querySelector('.title').textContent = metadata.title || '';
+        node.querySelector('.artist').textContent = metadata.artist || metadata.subtitle || '';
+        node.querySelector('.player-state').textContent = media.playerState || '';
+        if (images.length > 0) {
+            const artwork = node.querySelector('.artwork');
+            artwork.src = images[0].url;
+            artwork.hidden = false;
+        }
+
+        node.querySelectorAll('button[data-action]').forEach(button => {
+            button.addEventListener('click', () => control(device.id, button.dataset.action));
+        });
+        const mute = node.querySelector('.mute-toggle');
+        mute.textContent = device.muted ? 'Unmute' : 'Mute';
+        mute.addEventListener('click', () => control(device.id, device.muted ? 'unmute' : 'mute'));
+
+        const volume = node.querySelector('.volume');
+        volume.value = device.volume;
+        node.querySelector('.volume-value').textContent = device.volume;
+        volume.addEventListener('change', () => control(device.id, 'volume', parseInt(volume.value, 10)));
+
+        container.appendChild(node);
+    });
+}
+
+function addMessage(message) {
+    const body = document.querySelector('#messages tbody');
+    // The last message of each device is both loaded and sent in the events snapshot
+    const key = [message.device, message.time, message.namespace, message.payload].join('|');
+    if (Array.from(body.children).some(row => row.dataset.key === key)) {
+        return;
+    }
+    const row = document.createElement('tr');
+    row.dataset.key = key;
+    [
+        new Date(message.time).toLocaleTimeString(),
+        message.device,
+        message.namespace,
+        message.source,
+        message.destination,
+        message.payload,
+    ].forEach((value, i) => {
+        const cell = document.createElement('td');
+        cell.textContent = value;
+        if (i === 5) {
+            cell.classList.add('payload');
+        }
+        row.appendChild(cell);
+    });
+    body.prepend(row);
+    while (body.children.length > maxMessages) {
+        body.removeChild(body.lastChild);
+    }
+}
+
+function listen() {
+    const status = document.getElementById('stream-status');
+    const source = new EventSource('events');
+    source.onopen = () => {
+        status.textContent = 'live';
+        status.className = 'badge ok';
+    };
+    source.onerror = () => {
+        status.textContent = 'disconnected';
+        status.className = 'badge ko';
+    };
+    ['receiver_status', 'media_status', 'connection'].forEach(type => {
+        source.addEventListener(type, refreshDevices);
+    });
+    source.addEventListener('raw_message', e => {
+        const evt = JSON.parse(e.data);
+        addMessage({...evt.data, device: evt.device});
+    });
+}
+
+refreshDevices();
+loadMessages().then(listen);
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestControlHandler_Checks(t *testing.T) {
+	mux := http.NewServeMux()
+	registerWebHandlers(mux, newDeviceWorkers())
+
+	tests := []struct {
+		name        string
+		contentType string
+		origin      string
+		status      int
+	}{
+		{name: "form", contentType: "application/x-www-form-urlencoded", status: http.StatusUnsupportedMediaType},
+		{name: "no content type", status: http.StatusUnsupportedMediaType},
+		{name: "cross origin", contentType: "application/json", origin: "http://evil.example", status: http.StatusForbidden},
+		// Unknown device once checks passed
+		{name: "same origin", contentType: "application/json; charset=utf-8", origin: "http://bridge.local:8080",
+			status: http.StatusBadRequest},
+		{name: "no origin", contentType: "application/json", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://bridge.local:8080/api/control?device=tv",
+				strings.NewReader(`{"action": "play"}`))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, expected %d: %v", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestLogLevelHandler_Checks(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	handler := newLogLevel(bridge.NewWriterPublisher(io.Discard), newDeviceWorkers(), log.InfoLevel).handler()
+
+	tests := []struct {
+		name        string
+		contentType string
+		origin      string
+		status      int
+	}{
+		{name: "text form", contentType: "text/plain", status: http.StatusUnsupportedMediaType},
+		{name: "no content type", status: http.StatusUnsupportedMediaType},
+		{name: "cross origin", contentType: "application/json", origin: "http://evil.example", status: http.StatusForbidden},
+		{name: "same origin", contentType: "application/json", origin: "http://bridge.local:8080", status: http.StatusOK},
+		{name: "no origin", contentType: "application/json", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log.SetLevel(log.InfoLevel)
+			req := httptest.NewRequest(http.MethodPost, "http://bridge.local:8080/api/log_level",
+				strings.NewReader(`{"level": "warning"}`))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, expected %d: %v", rec.Code, tt.status, rec.Body.String())
+			}
+			if changed := log.GetLevel() == log.WarnLevel; changed != (tt.status == http.StatusOK) {
+				t.Errorf("level %v after request", log.GetLevel())
+			}
+		})
+	}
+}
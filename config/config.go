@@ -0,0 +1,576 @@
+// Package config loads the bridge configuration from a yaml file, each option can be overridden by an environment
+// variable.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cyrilix/chromecast2mqt/bridge"
+	"github.com/cyrilix/chromecast2mqt/tracing"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBroker       = "tcp://127.0.0.1:1883"
+	DefaultClientId     = "chromecast2mqtt"
+	DefaultTopicPrefix  = "chromecast"
+	DefaultPort         = 8009
+	DefaultDnsTimeout   = 10 * time.Second
+	DefaultPollInterval = 10 * time.Minute
+	DefaultHeartbeat    = time.Minute
+
+	// SchemaDefault publishes values to device topics
+	SchemaDefault = "default"
+	// SchemaHomie publishes devices following the Homie 4 convention
+	SchemaHomie = "homie"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Config is the configuration of the serve command
+type Config struct {
+	Mqtt    Mqtt     `yaml:"mqtt"`
+	Devices []Device `yaml:"devices"`
+	Topics  Topics   `yaml:"topics"`
+	Payload Payload  `yaml:"payload"`
+	Publish Publish  `yaml:"publish"`
+	Http    Http     `yaml:"http"`
+	Log     Log      `yaml:"log"`
+	Tracing Tracing  `yaml:"tracing"`
+}
+
+type Mqtt struct {
+	Broker   string `yaml:"broker"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	ClientId string `yaml:"client_id"`
+	Qos      int    `yaml:"qos"`
+	Retain   bool   `yaml:"retain"`
+	Clean    bool   `yaml:"clean"`
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Version of the protocol, 3 for 3.1.1 or 5
+	Version int `yaml:"version"`
+	// SessionExpiry is the duration the broker keeps the session after disconnection, MQTT v5 only
+	SessionExpiry time.Duration `yaml:"session_expiry"`
+	// MessageExpiry is the lifetime of events not retained, MQTT v5 only
+	MessageExpiry time.Duration `yaml:"message_expiry"`
+}
+
+// Device selects a cast device, Address or one of CastName, UUID and Model, or nothing to use the first device found
+type Device struct {
+	// Name identifies the device in topics, logs and web ui
+	Name     string `yaml:"name"`
+	Address  string `yaml:"address"`
+	Port     int    `yaml:"port"`
+	CastName string `yaml:"cast_name"`
+	UUID     string `yaml:"uuid"`
+	Model    string `yaml:"model"`
+	// Room is only used by topic templates
+	Room         string        `yaml:"room"`
+	Iface        string        `yaml:"iface"`
+	DnsTimeout   time.Duration `yaml:"dns_timeout"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Topic template of the device, topics.template or <topics.prefix>/<name> if empty
+	Topic      string `yaml:"topic"`
+	PublishRaw bool   `yaml:"publish_raw"`
+	Record     string `yaml:"record"`
+}
+
+type Topics struct {
+	Prefix string `yaml:"prefix"`
+	// Template of all device topics, see bridge.TopicTemplate
+	Template string `yaml:"template"`
+	// Schema of published values, default or homie
+	Schema string `yaml:"schema"`
+	// HomieBase is the base topic of homie devices
+	HomieBase string `yaml:"homie_base"`
+}
+
+// Schema is a format of published values
+type Schema struct {
+	// Subtopic inserted between device topic and value topic, ex: <topic>/<subtopic>/volume
+	Subtopic string `yaml:"subtopic"`
+	Boolean  string `yaml:"boolean"`
+	Volume   string `yaml:"volume"`
+	// JSON wraps values in a json object with unit and timestamp
+	JSON bool `yaml:"json"`
+}
+
+// Payload is the default schema of published values, Schemas are published in addition, for example during a
+// migration
+type Payload struct {
+	Schema  `yaml:",inline"`
+	Schemas []Schema `yaml:"schemas"`
+}
+
+type Publish struct {
+	QueueSize    int           `yaml:"queue_size"`
+	Timeout      time.Duration `yaml:"timeout"`
+	QueuePolicy  string        `yaml:"queue_policy"`
+	SpoolDir     string        `yaml:"spool_dir"`
+	SpoolMaxSize int64         `yaml:"spool_max_size"`
+	// HeartbeatInterval is the interval between two publications of <topics.prefix>/bridge/heartbeat
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+}
+
+type Http struct {
+	// Listen address of the http server, disabled if empty
+	Listen string `yaml:"listen"`
+}
+
+type Log struct {
+	Level string `yaml:"level"`
+	// Format of log lines: text or json
+	Format string `yaml:"format"`
+}
+
+// Tracing exports spans of cast messages and mqtt commands
+type Tracing struct {
+	// Exporter of spans: none, stdout or otlp
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the traces url of an OTLP/HTTP collector
+	Endpoint string `yaml:"endpoint"`
+}
+
+// Default returns a configuration without device
+func Default() Config {
+	return Config{
+		Mqtt: Mqtt{
+			Broker:   DefaultBroker,
+			ClientId: DefaultClientId,
+			Version:  3,
+		},
+		Topics: Topics{
+			Prefix:    DefaultTopicPrefix,
+			Schema:    SchemaDefault,
+			HomieBase: bridge.DefaultHomieBase,
+		},
+		Payload: Payload{
+			Schema: Schema{
+				Boolean: string(bridge.BooleanOnOff),
+				Volume:  string(bridge.VolumePercent),
+			},
+		},
+		Publish: Publish{
+			QueueSize:         256,
+			Timeout:           5 * time.Second,
+			QueuePolicy:       "drop-oldest",
+			SpoolMaxSize:      10 * 1024 * 1024,
+			HeartbeatInterval: DefaultHeartbeat,
+		},
+		Http: Http{
+			Listen: ":8080",
+		},
+		Log: Log{
+			Level:  "info",
+			Format: LogFormatText,
+		},
+		Tracing: Tracing{
+			Exporter: tracing.ExporterNone,
+			Endpoint: tracing.DefaultEndpoint,
+		},
+	}
+}
+
+// DeviceTopic returns the topic template of device
+func (c *Config) DeviceTopic(device Device) string {
+	if device.Topic != "" {
+		return device.Topic
+	}
+	if c.Topics.Template != "" {
+		return c.Topics.Template
+	}
+	return c.Topics.Prefix + "/" + device.Name
+}
+
+// PayloadFormats returns the default schema followed by additional ones
+func (c *Config) PayloadFormats() []bridge.PayloadFormat {
+	formats := make([]bridge.PayloadFormat, 0, len(c.Payload.Schemas)+1)
+	for _, s := range append([]Schema{c.Payload.Schema}, c.Payload.Schemas...) {
+		formats = append(formats, bridge.PayloadFormat{
+			Subtopic: s.Subtopic,
+			Boolean:  bridge.BooleanFormat(s.Boolean),
+			Volume:   bridge.VolumeFormat(s.Volume),
+			JSON:     s.JSON,
+		})
+	}
+	return formats
+}
+
+// FieldError is an invalid option, Line is 0 when the option isn't set by the config file
+type FieldError struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (e FieldError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Message)
+}
+
+// Errors is returned by Load when the configuration is invalid
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Load reads the yaml file at path, applies environment overrides and validates the result. An empty path only
+// uses defaults and environment.
+func Load(path string) (*Config, error) {
+	var content []byte
+	if path != "" {
+		var err error
+		content, err = os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read config file %v", path)
+		}
+	}
+	return Parse(content, os.LookupEnv)
+}
+
+var yamlLineError = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Parse decodes a yaml configuration, lookupEnv provides environment overrides
+func Parse(content []byte, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+	lines := make(map[string]int)
+
+	if len(bytes.TrimSpace(content)) > 0 {
+		var root yaml.Node
+		if err := yaml.Unmarshal(content, &root); err != nil {
+			return nil, toErrors(err)
+		}
+		indexLines(&root, "", lines)
+
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil {
+			return nil, toErrors(err)
+		}
+	}
+
+	if err := applyEnv(&cfg, lookupEnv); err != nil {
+		return nil, err
+	}
+	cfg.applyDeviceDefaults()
+
+	if errs := cfg.validate(lines); len(errs) > 0 {
+		return nil, errs
+	}
+	return &cfg, nil
+}
+
+// Validate applies device defaults and checks a configuration not built by Parse
+func (c *Config) Validate() error {
+	c.applyDeviceDefaults()
+	if errs := c.validate(nil); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func toErrors(err error) Errors {
+	var msgs []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+
+	errs := make(Errors, 0, len(msgs))
+	for _, msg := range msgs {
+		fieldErr := FieldError{Message: msg}
+		if m := yamlLineError.FindStringSubmatch(msg); m != nil {
+			fieldErr.Line, _ = strconv.Atoi(m[1])
+			fieldErr.Message = m[2]
+		}
+		errs = append(errs, fieldErr)
+	}
+	return errs
+}
+
+// indexLines records the line of each option of node, keyed by its path (ex: devices[0].name)
+func indexLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			indexLines(n, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			lines[key] = node.Content[i].Line
+			indexLines(node.Content[i+1], key, lines)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			key := fmt.Sprintf("%s[%d]", path, i)
+			lines[key] = n.Line
+			indexLines(n, key, lines)
+		}
+	}
+}
+
+func (c *Config) applyDeviceDefaults() {
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		if d.Port == 0 && d.Address != "" {
+			d.Port = DefaultPort
+		}
+		if d.DnsTimeout == 0 {
+			d.DnsTimeout = DefaultDnsTimeout
+		}
+		if d.PollInterval == 0 {
+			d.PollInterval = DefaultPollInterval
+		}
+	}
+}
+
+var deviceName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateTopicCollisions checks topics of devices known from the configuration: topics with an empty level or used
+// by several devices. Devices whose topics depend on discovery are checked when they connect.
+func (c *Config) validateTopicCollisions(add func(path, format string, args ...interface{})) {
+	owners := make(map[string]string)
+	names := make(map[string]bool)
+	for i, d := range c.Devices {
+		path := fmt.Sprintf("devices[%d]", i)
+		tmpl, err := bridge.ParseTopicTemplate(c.DeviceTopic(d))
+		if err != nil || names[d.Name] {
+			// Invalid template and duplicated name are already reported
+			continue
+		}
+		names[d.Name] = true
+		data, unknown := staticTopicData(d)
+		known := true
+		for _, placeholder := range unknown {
+			if tmpl.Uses(placeholder) {
+				known = false
+			}
+		}
+		if !known {
+			continue
+		}
+		topics, err := tmpl.Func(data)
+		if err != nil {
+			add(path+".name", "%v", err)
+			continue
+		}
+		topic := topics(bridge.CollisionField)
+		if owner, ok := owners[topic]; ok {
+			add(path+".name", "topic %q is already used by device %q", topic, owner)
+			continue
+		}
+		owners[topic] = d.Name
+	}
+}
+
+// staticTopicData returns the topic placeholders of device as they are set on connection, and the placeholders only
+// known after discovery
+func staticTopicData(d Device) (bridge.TopicData, []string) {
+	data := bridge.TopicData{ID: d.Name, Room: d.Room, Name: d.CastName, UUID: d.UUID, Model: d.Model}
+	if d.Address != "" {
+		// Device set by address isn't discovered, its name is the name in configuration
+		data.Name, data.UUID, data.Address = d.Name, "", d.Address
+		return data, nil
+	}
+	var unknown []string
+	if d.CastName == "" {
+		unknown = append(unknown, "Name")
+	}
+	if d.UUID == "" {
+		unknown = append(unknown, "UUID")
+	}
+	if d.Model == "" {
+		unknown = append(unknown, "Model")
+	}
+	return data, append(unknown, "Address")
+}
+
+func (c *Config) validate(lines map[string]int) Errors {
+	errs := make(Errors, 0)
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Path: path, Line: lines[path], Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Mqtt.Broker == "" {
+		add("mqtt.broker", "broker is mandatory")
+	}
+	if c.Mqtt.Qos < 0 || c.Mqtt.Qos > 2 {
+		add("mqtt.qos", "invalid qos %d, must be 0, 1 or 2", c.Mqtt.Qos)
+	}
+	certs := 0
+	for _, f := range []string{c.Mqtt.CAFile, c.Mqtt.CertFile, c.Mqtt.KeyFile} {
+		if f != "" {
+			certs += 1
+		}
+	}
+	if certs != 0 && certs != 3 {
+		add("mqtt", "ca_file, cert_file and key_file must be set together")
+	}
+	switch c.Mqtt.Version {
+	case 3:
+		if c.Mqtt.SessionExpiry != 0 {
+			add("mqtt.session_expiry", "needs mqtt version 5")
+		}
+		if c.Mqtt.MessageExpiry != 0 {
+			add("mqtt.message_expiry", "needs mqtt version 5")
+		}
+	case 5:
+		if c.Mqtt.SessionExpiry < 0 {
+			add("mqtt.session_expiry", "must be positive")
+		}
+		if c.Mqtt.MessageExpiry < 0 {
+			add("mqtt.message_expiry", "must be positive")
+		}
+	default:
+		add("mqtt.version", "invalid version %d, must be 3 or 5", c.Mqtt.Version)
+	}
+
+	if len(c.Devices) == 0 {
+		add("devices", "at least one device is mandatory")
+	}
+	names := make(map[string]bool)
+	for i, d := range c.Devices {
+		path := fmt.Sprintf("devices[%d]", i)
+		switch {
+		case d.Name == "":
+			add(path+".name", "name is mandatory")
+		case !deviceName.MatchString(d.Name):
+			add(path+".name", "invalid name %q, only letters, digits, '-' and '_' are allowed", d.Name)
+		case names[d.Name]:
+			add(path+".name", "duplicated device name %q", d.Name)
+		}
+		names[d.Name] = true
+		if d.Port < 0 || d.Port > 65535 {
+			add(path+".port", "invalid port %d", d.Port)
+		}
+		if d.Port != 0 && d.Address == "" {
+			add(path+".port", "port needs an address")
+		}
+		if d.DnsTimeout < 0 {
+			add(path+".dns_timeout", "must be positive")
+		}
+		if d.PollInterval < 0 {
+			add(path+".poll_interval", "must be positive")
+		}
+		if d.Topic != "" {
+			if _, err := bridge.ParseTopicTemplate(d.Topic); err != nil {
+				add(path+".topic", "%v", err)
+			}
+		}
+	}
+
+	if strings.ContainsAny(c.Topics.Prefix, "+#") {
+		add("topics.prefix", "topic can't contain wildcards")
+	}
+	if c.Topics.Template != "" {
+		if _, err := bridge.ParseTopicTemplate(c.Topics.Template); err != nil {
+			add("topics.template", "%v", err)
+		}
+	}
+	c.validateTopicCollisions(add)
+	switch c.Topics.Schema {
+	case SchemaDefault:
+	case SchemaHomie:
+		if c.Topics.HomieBase == "" || strings.ContainsAny(c.Topics.HomieBase, "+#") {
+			add("topics.homie_base", "invalid base topic %q", c.Topics.HomieBase)
+		}
+		ids := make(map[string]string)
+		for i, d := range c.Devices {
+			id := bridge.HomieID(d.Name)
+			if id == "" {
+				add(fmt.Sprintf("devices[%d].name", i), "name %q isn't a valid homie id", d.Name)
+				continue
+			}
+			if other, ok := ids[id]; ok && d.Name != other {
+				add(fmt.Sprintf("devices[%d].name", i), "homie id %q is already used by device %q", id, other)
+			}
+			ids[id] = d.Name
+		}
+	default:
+		add("topics.schema", "invalid schema %q, must be %s or %s", c.Topics.Schema, SchemaDefault, SchemaHomie)
+	}
+	subtopics := make(map[string]bool)
+	for i, schema := range append([]Schema{c.Payload.Schema}, c.Payload.Schemas...) {
+		path := "payload"
+		if i > 0 {
+			path = fmt.Sprintf("payload.schemas[%d]", i-1)
+		}
+		if _, err := bridge.ParseBooleanFormat(schema.Boolean); err != nil {
+			add(path+".boolean", "%v", err)
+		}
+		if _, err := bridge.ParseVolumeFormat(schema.Volume); err != nil {
+			add(path+".volume", "%v", err)
+		}
+		if strings.ContainsAny(schema.Subtopic, "+#") {
+			add(path+".subtopic", "topic can't contain wildcards")
+		}
+		if subtopics[schema.Subtopic] {
+			add(path+".subtopic", "duplicated subtopic %q", schema.Subtopic)
+		}
+		subtopics[schema.Subtopic] = true
+	}
+
+	if c.Publish.QueueSize < 1 {
+		add("publish.queue_size", "must be at least 1")
+	}
+	if c.Publish.Timeout <= 0 {
+		add("publish.timeout", "must be positive")
+	}
+	if c.Publish.HeartbeatInterval <= 0 {
+		add("publish.heartbeat_interval", "must be positive")
+	}
+	if _, err := bridge.ParseOverflowPolicy(c.Publish.QueuePolicy); err != nil {
+		add("publish.queue_policy", "%v", err)
+	}
+	if c.Publish.SpoolMaxSize <= 0 {
+		add("publish.spool_max_size", "must be positive")
+	}
+
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		add("log.level", "%v", err)
+	}
+	if c.Log.Format != LogFormatText && c.Log.Format != LogFormatJSON {
+		add("log.format", "must be %v or %v", LogFormatText, LogFormatJSON)
+	}
+	if err := tracing.ValidateExporter(c.Tracing.Exporter); err != nil {
+		add("tracing.exporter", "%v", err)
+	}
+	if c.Tracing.Exporter == tracing.ExporterOTLP {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || u.Host == "" {
+			add("tracing.endpoint", "invalid url %q", c.Tracing.Endpoint)
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Line < errs[j].Line
+	})
+	return errs
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func noEnv(string) (string, bool) {
+	return "", false
+}
+
+func TestParse(t *testing.T) {
+	content := `
+mqtt:
+  broker: tcp://broker:1883
+  version: 5
+  session_expiry: 1h
+devices:
+  - name: living-room
+    address: 192.168.1.10
+  - name: kitchen
+    cast_name: Kitchen speaker
+    topic: home/{{.Room}}/{{.Name}}
+    room: kitchen
+    dns_timeout: 500ms
+payload:
+  boolean: true_false
+  schemas:
+    - subtopic: json
+      boolean: on_off
+      volume: ratio
+      json: true
+`
+	cfg, err := Parse([]byte(content), noEnv)
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+	if cfg.Mqtt.Broker != "tcp://broker:1883" || cfg.Mqtt.Version != 5 || cfg.Mqtt.SessionExpiry != time.Hour {
+		t.Errorf("unexpected mqtt config %+v", cfg.Mqtt)
+	}
+	if cfg.Mqtt.ClientId != DefaultClientId || cfg.Topics.Prefix != DefaultTopicPrefix {
+		t.Errorf("defaults not applied: %+v %+v", cfg.Mqtt, cfg.Topics)
+	}
+	if len(cfg.Devices) != 2 {
+		t.Fatalf("unexpected devices %+v", cfg.Devices)
+	}
+	// Device defaults
+	if d := cfg.Devices[0]; d.Port != DefaultPort || d.DnsTimeout != DefaultDnsTimeout || d.PollInterval != DefaultPollInterval {
+		t.Errorf("device defaults not applied: %+v", d)
+	}
+	// Sub-second timeouts are kept
+	if d := cfg.Devices[1]; d.DnsTimeout != 500*time.Millisecond {
+		t.Errorf("unexpected dns timeout %v", d.DnsTimeout)
+	}
+	if topic := cfg.DeviceTopic(cfg.Devices[0]); topic != "chromecast/living-room" {
+		t.Errorf("unexpected topic %q", topic)
+	}
+	if topic := cfg.DeviceTopic(cfg.Devices[1]); topic != "home/{{.Room}}/{{.Name}}" {
+		t.Errorf("unexpected topic %q", topic)
+	}
+	formats := cfg.PayloadFormats()
+	if len(formats) != 2 || formats[0].Boolean != "true_false" || formats[1].Subtopic != "json" || !formats[1].JSON {
+		t.Errorf("unexpected payload formats %+v", formats)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errors  []string
+	}{
+		{
+			name: "validation",
+			content: `mqtt:
+  qos: 3
+  session_expiry: 1h
+devices:
+  - name: living room
+    dns_timeout: -1s
+  - name: kitchen
+    port: 8009
+topics:
+  template: home/{{.Room
+payload:
+  volume: dbm
+publish:
+  queue_policy: drop-newest
+`,
+			errors: []string{
+				"line 2: mqtt.qos: invalid qos 3, must be 0, 1 or 2",
+				"line 3: mqtt.session_expiry: needs mqtt version 5",
+				`line 5: devices[0].name: invalid name "living room", only letters, digits, '-' and '_' are allowed`,
+				"line 6: devices[0].dns_timeout: must be positive",
+				"line 8: devices[1].port: port needs an address",
+				"line 10: topics.template: invalid topic template",
+				"line 12: payload.volume: invalid volume format \"dbm\"",
+				"line 14: publish.queue_policy: invalid overflow policy \"drop-newest\"",
+			},
+		},
+		{
+			name:    "duplicated device",
+			content: "devices:\n  - name: tv\n  - name: tv\n",
+			errors:  []string{`line 3: devices[1].name: duplicated device name "tv"`},
+		},
+		{
+			name:    "no device",
+			content: "mqtt:\n  broker: tcp://broker:1883\n",
+			errors:  []string{"devices: at least one device is mandatory"},
+		},
+		{
+			name:    "unknown option",
+			content: "devices:\n  - name: tv\n    adress: 192.168.1.10\n",
+			errors:  []string{"line 3: field adress not found"},
+		},
+		{
+			name:    "invalid type",
+			content: "devices:\n  - name: tv\n    port: http\n",
+			errors:  []string{"line 3: cannot unmarshal"},
+		},
+		{
+			name:    "invalid yaml",
+			content: "devices:\n  - name: tv\n name: other\n",
+			errors:  []string{"line 2: did not find expected key"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.content), noEnv)
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(errs) != len(tt.errors) {
+				t.Errorf("%d errors, expected %d:\n%v", len(errs), len(tt.errors), errs)
+			}
+			for i, expected := range tt.errors {
+				if i < len(errs) && !strings.HasPrefix(errs[i].Error(), expected) {
+					t.Errorf("error %q, expected %q", errs[i].Error(), expected)
+				}
+			}
+		})
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	tests := []struct {
+		err      FieldError
+		expected string
+	}{
+		{FieldError{Path: "mqtt.qos", Line: 3, Message: "invalid"}, "line 3: mqtt.qos: invalid"},
+		{FieldError{Path: "mqtt.qos", Message: "invalid"}, "mqtt.qos: invalid"},
+		{FieldError{Line: 3, Message: "invalid"}, "line 3: invalid"},
+	}
+	for _, tt := range tests {
+		if msg := tt.err.Error(); msg != tt.expected {
+			t.Errorf("error %q, expected %q", msg, tt.expected)
+		}
+	}
+	errs := Errors{tests[0].err, tests[1].err}
+	if msg := errs.Error(); msg != "line 3: mqtt.qos: invalid\nmqtt.qos: invalid" {
+		t.Errorf("unexpected errors %q", msg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Devices = []Device{{Name: "tv", Address: "192.168.1.10"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	if cfg.Devices[0].Port != DefaultPort {
+		t.Errorf("device defaults not applied: %+v", cfg.Devices[0])
+	}
+
+	cfg.Topics.Schema = SchemaHomie
+	cfg.Devices = append(cfg.Devices, Device{Name: "TV"})
+	err := cfg.Validate()
+	if errs, ok := err.(Errors); !ok || len(errs) != 1 || errs[0].Path != "devices[1].name" {
+		t.Errorf("homie id collision not reported: %v", err)
+	}
+}
+
+func TestValidate_Topics(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []Device
+		path    string
+	}{
+		{"distinct", []Device{
+			{Name: "salon", CastName: "Télé du Salon", Room: "Living Room"},
+			{Name: "kitchen", CastName: "Kitchen/Speaker", Room: "Kitchen"},
+		}, ""},
+		{"discovered name", []Device{
+			{Name: "tv1", Room: "Living Room"},
+			{Name: "tv2", Room: "Living Room"},
+		}, ""},
+		{"collision", []Device{
+			{Name: "tv1", CastName: "Living Room", Room: "Home"},
+			{Name: "tv2", CastName: "living-room", Room: "Home"},
+		}, "devices[1].name"},
+		{"address", []Device{
+			{Name: "living_room", Address: "192.168.1.10", Room: "Home"},
+			{Name: "tv", CastName: "Living Room", Room: "Home"},
+		}, ""},
+		{"empty level", []Device{
+			{Name: "lounge", CastName: "Гостиная", Room: "Home"},
+		}, "devices[0].name"},
+		{"empty room", []Device{
+			{Name: "tv", CastName: "TV"},
+		}, "devices[0].name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Topics.Template = "home/{{.Room}}/{{.Name}}"
+			cfg.Devices = tt.devices
+			err := cfg.Validate()
+			if tt.path == "" {
+				if err != nil {
+					t.Errorf("invalid config: %v", err)
+				}
+				return
+			}
+			if errs, ok := err.(Errors); !ok || len(errs) != 1 || errs[0].Path != tt.path {
+				t.Errorf("topic error not reported on %v: %v", tt.path, err)
+			}
+		})
+	}
+}
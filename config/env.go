@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefixes environment variables overriding options, an option is named after its yaml path in upper
+// case, ex: CHROMECAST2MQTT_MQTT_BROKER or CHROMECAST2MQTT_DEVICES_0_ADDRESS
+const EnvPrefix = "CHROMECAST2MQTT"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// EnvNames lists environment variables of all options, devices are listed with index 0
+func EnvNames() []string {
+	names := make([]string, 0)
+	collectEnvNames(reflect.TypeOf(Config{}), EnvPrefix, &names)
+	return names
+}
+
+func collectEnvNames(t reflect.Type, name string, names *[]string) {
+	switch {
+	case t.Kind() == reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			collectEnvNames(t.Field(i).Type, fieldEnvName(name, t.Field(i)), names)
+		}
+	case t.Kind() == reflect.Slice:
+		collectEnvNames(t.Elem(), name+"_0", names)
+	default:
+		*names = append(*names, name)
+	}
+}
+
+// fieldEnvName returns the name of field f of struct name, inlined fields are named as fields of their parent
+func fieldEnvName(name string, f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("yaml"), ",")
+	for _, flag := range tag[1:] {
+		if flag == "inline" {
+			return name
+		}
+	}
+	key := tag[0]
+	if key == "" {
+		key = f.Name
+	}
+	return name + "_" + strings.ToUpper(key)
+}
+
+func applyEnv(cfg *Config, lookupEnv func(string) (string, bool)) error {
+	errs := make(Errors, 0)
+	applyEnvValue(reflect.ValueOf(cfg).Elem(), EnvPrefix, lookupEnv, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func applyEnvValue(v reflect.Value, name string, lookupEnv func(string) (string, bool), errs *Errors) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			applyEnvValue(v.Field(i), fieldEnvName(name, v.Type().Field(i)), lookupEnv, errs)
+		}
+		return
+	case reflect.Slice:
+		// Items may be added by environment after those of the file
+		for i := 0; ; i++ {
+			itemName := fmt.Sprintf("%s_%d", name, i)
+			if i >= v.Len() {
+				if !hasEnv(v.Type().Elem(), itemName, lookupEnv) {
+					return
+				}
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			applyEnvValue(v.Index(i), itemName, lookupEnv, errs)
+		}
+	}
+
+	value, ok := lookupEnv(name)
+	if !ok {
+		return
+	}
+	if err := setValue(v, value); err != nil {
+		*errs = append(*errs, FieldError{Path: name, Message: err.Error()})
+	}
+}
+
+func hasEnv(t reflect.Type, name string, lookupEnv func(string) (string, bool)) bool {
+	names := make([]string, 0)
+	collectEnvNames(t, name, &names)
+	for _, n := range names {
+		if _, ok := lookupEnv(n); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func setValue(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %v", value, err)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		v.SetInt(i)
+	default:
+		return fmt.Errorf("unsupported option type %v", v.Type())
+	}
+	return nil
+}
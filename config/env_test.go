@@ -0,0 +1,99 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func lookupMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func TestParse_Env(t *testing.T) {
+	content := `
+mqtt:
+  broker: tcp://broker:1883
+devices:
+  - name: tv
+    address: 192.168.1.10
+`
+	cfg, err := Parse([]byte(content), lookupMap(map[string]string{
+		"CHROMECAST2MQTT_MQTT_BROKER":            "ssl://other:8883",
+		"CHROMECAST2MQTT_MQTT_QOS":               "1",
+		"CHROMECAST2MQTT_MQTT_RETAIN":            "true",
+		"CHROMECAST2MQTT_PUBLISH_TIMEOUT":        "2s",
+		"CHROMECAST2MQTT_PUBLISH_SPOOL_MAX_SIZE": "2048",
+		"CHROMECAST2MQTT_DEVICES_0_PORT":         "8010",
+		// Device added by environment
+		"CHROMECAST2MQTT_DEVICES_1_NAME":    "kitchen",
+		"CHROMECAST2MQTT_DEVICES_1_ADDRESS": "192.168.1.11",
+		// Inlined schema of payload
+		"CHROMECAST2MQTT_PAYLOAD_BOOLEAN":            "one_zero",
+		"CHROMECAST2MQTT_PAYLOAD_SCHEMAS_0_SUBTOPIC": "json",
+		"CHROMECAST2MQTT_PAYLOAD_SCHEMAS_0_BOOLEAN":  "on_off",
+		"CHROMECAST2MQTT_PAYLOAD_SCHEMAS_0_VOLUME":   "percent",
+	}))
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+	if cfg.Mqtt.Broker != "ssl://other:8883" || cfg.Mqtt.Qos != 1 || !cfg.Mqtt.Retain {
+		t.Errorf("mqtt not overridden: %+v", cfg.Mqtt)
+	}
+	if cfg.Publish.Timeout != 2*time.Second || cfg.Publish.SpoolMaxSize != 2048 {
+		t.Errorf("publish not overridden: %+v", cfg.Publish)
+	}
+	if len(cfg.Devices) != 2 || cfg.Devices[0].Port != 8010 || cfg.Devices[1].Name != "kitchen" ||
+		cfg.Devices[1].Port != DefaultPort {
+		t.Errorf("devices not overridden: %+v", cfg.Devices)
+	}
+	if cfg.Payload.Boolean != "one_zero" || len(cfg.Payload.Schemas) != 1 || cfg.Payload.Schemas[0].Subtopic != "json" {
+		t.Errorf("payload not overridden: %+v", cfg.Payload)
+	}
+}
+
+func TestParse_EnvErrors(t *testing.T) {
+	_, err := Parse(nil, lookupMap(map[string]string{
+		"CHROMECAST2MQTT_DEVICES_0_NAME":        "tv",
+		"CHROMECAST2MQTT_MQTT_QOS":              "one",
+		"CHROMECAST2MQTT_MQTT_RETAIN":           "yes",
+		"CHROMECAST2MQTT_DEVICES_0_DNS_TIMEOUT": "10",
+	}))
+	if err == nil {
+		t.Fatalf("invalid environment accepted")
+	}
+	msg := err.Error()
+	for _, expected := range []string{
+		`CHROMECAST2MQTT_MQTT_QOS: invalid integer "one"`,
+		`CHROMECAST2MQTT_MQTT_RETAIN: invalid boolean "yes"`,
+		`CHROMECAST2MQTT_DEVICES_0_DNS_TIMEOUT: invalid duration "10"`,
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q not reported in:\n%v", expected, msg)
+		}
+	}
+}
+
+func TestEnvNames(t *testing.T) {
+	names := make(map[string]bool)
+	for _, n := range EnvNames() {
+		names[n] = true
+	}
+	for _, expected := range []string{
+		"CHROMECAST2MQTT_MQTT_BROKER",
+		"CHROMECAST2MQTT_DEVICES_0_DNS_TIMEOUT",
+		"CHROMECAST2MQTT_PAYLOAD_BOOLEAN",
+		"CHROMECAST2MQTT_PAYLOAD_SCHEMAS_0_SUBTOPIC",
+		"CHROMECAST2MQTT_TRACING_ENDPOINT",
+	} {
+		if !names[expected] {
+			t.Errorf("%v not listed", expected)
+		}
+	}
+	if names["CHROMECAST2MQTT_PAYLOAD_SCHEMA_BOOLEAN"] {
+		t.Errorf("inlined schema listed with its field name")
+	}
+}
@@ -0,0 +1,297 @@
+package mediaplayer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/buger/jsonparser"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishen/go-chromecast/cast"
+	"github.com/vishen/go-chromecast/cast/proto"
+	"sync"
+	"time"
+)
+
+const (
+	DestinationReceiver = "receiver-0"
+
+	NamespaceConnection = "urn:x-cast:com.google.cast.tp.connection"
+	NamespaceHeartbeat  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	NamespaceReceiver   = "urn:x-cast:com.google.cast.receiver"
+	NamespaceMedia      = "urn:x-cast:com.google.cast.media"
+
+	channelSender = "sender-chromecast2mqtt"
+
+	defaultHeartbeatInterval = 5 * time.Second
+	// missedHeartbeats is the number of heartbeat intervals without message from the device before the channel fails
+	missedHeartbeats = 3
+)
+
+// RawPayload is a free json payload to send on any namespace, requestId field is set on send
+type RawPayload map[string]interface{}
+
+func (p RawPayload) SetRequestId(id int) {
+	p["requestId"] = id
+}
+
+func (p RawPayload) RequestID() int {
+	id, _ := p["requestId"].(int)
+	return id
+}
+
+type ChannelOption func(*Channel)
+
+// WithHeartbeatInterval sets the interval between two PING sent to the device
+func WithHeartbeatInterval(interval time.Duration) ChannelOption {
+	return func(c *Channel) {
+		c.heartbeat = interval
+	}
+}
+
+// Channel is a dedicated cast connection used to exchange messages on arbitrary namespaces and
+// destinations, application.Application doesn't expose its own connection. The device is pinged periodically, Done
+// is closed when it stops answering or a message can't be sent.
+type Channel struct {
+	conn      *cast.Connection
+	recv      chan *api.CastMessage
+	heartbeat time.Duration
+	done      chan struct{}
+
+	mu        sync.Mutex
+	requestID int
+	pending   map[int]chan *api.CastMessage
+	connected map[string]bool
+	lastSeen  time.Time
+	err       error
+}
+
+func NewChannel(addr string, port int, opts ...ChannelOption) (*Channel, error) {
+	c := Channel{
+		recv:      make(chan *api.CastMessage, 5),
+		heartbeat: defaultHeartbeatInterval,
+		done:      make(chan struct{}),
+		pending:   make(map[int]chan *api.CastMessage),
+		connected: make(map[string]bool),
+		lastSeen:  time.Now(),
+	}
+	for _, o := range opts {
+		o(&c)
+	}
+	c.conn = cast.NewConnection(c.recv)
+	if err := c.conn.Start(addr, port); err != nil {
+		return nil, errors.Wrapf(err, "unable to start cast channel to %s:%d", addr, port)
+	}
+	go c.dispatch()
+
+	if err := c.connect(DestinationReceiver); err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	go c.ping()
+	return &c, nil
+}
+
+// Done is closed when the channel fails or is closed
+func (c *Channel) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the failure of the channel, nil if it isn't failed or was closed
+func (c *Channel) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// fail closes done, err is kept if it is the first failure. mu must be held.
+func (c *Channel) fail(err error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	close(c.done)
+}
+
+// ping sends PING to the device until done, the channel fails if the device doesn't send anything during
+// missedHeartbeats intervals
+func (c *Channel) ping() {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		if silence := time.Since(c.lastSeen); silence > missedHeartbeats*c.heartbeat {
+			c.fail(errors.Errorf("no message from device since %v", silence.Round(time.Millisecond)))
+			c.mu.Unlock()
+			return
+		}
+		header := cast.PayloadHeader{Type: "PING"}
+		err := c.conn.Send(0, &header, channelSender, DestinationReceiver, NamespaceHeartbeat)
+		if err != nil {
+			c.fail(errors.Wrap(err, "unable to send heartbeat"))
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Channel) dispatch() {
+	for msg := range c.recv {
+		c.mu.Lock()
+		c.lastSeen = time.Now()
+		c.mu.Unlock()
+		switch msg.GetNamespace() {
+		case NamespaceConnection:
+			if msgType, _ := jsonparser.GetString([]byte(msg.GetPayloadUtf8()), "type"); msgType == "CLOSE" {
+				c.disconnected(msg.GetSourceId())
+			}
+			continue
+		case NamespaceReceiver:
+			c.forgetTransports([]byte(msg.GetPayloadUtf8()))
+		}
+		requestID, err := jsonparser.GetInt([]byte(msg.GetPayloadUtf8()), "requestId")
+		if err != nil || requestID == 0 {
+			// Broadcast messages are already received by the main application connection
+			continue
+		}
+		c.mu.Lock()
+		reply, ok := c.pending[int(requestID)]
+		delete(c.pending, int(requestID))
+		c.mu.Unlock()
+		if ok {
+			reply <- msg
+		}
+	}
+}
+
+// disconnected forgets destination closed by the device, next message to it connects again
+func (c *Channel) disconnected(destination string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected[destination] {
+		log.WithField("destination", destination).Debug("cast destination closed")
+		delete(c.connected, destination)
+	}
+}
+
+// forgetTransports forgets destinations not in the applications of a receiver status, their transports are gone
+func (c *Channel) forgetTransports(payload []byte) {
+	if msgType, _ := jsonparser.GetString(payload, "type"); msgType != "RECEIVER_STATUS" {
+		return
+	}
+	transports := map[string]bool{DestinationReceiver: true}
+	_, err := jsonparser.ArrayEach(payload, func(value []byte, _ jsonparser.ValueType, _ int, _ error) {
+		if id, err := jsonparser.GetString(value, "transportId"); err == nil {
+			transports[id] = true
+		}
+	}, "status", "applications")
+	if err != nil && err != jsonparser.KeyPathNotFoundError {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for destination := range c.connected {
+		if !transports[destination] {
+			log.WithField("destination", destination).Debug("cast transport gone")
+			delete(c.connected, destination)
+		}
+	}
+}
+
+func (c *Channel) connect(destination string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected[destination] {
+		return nil
+	}
+	header := cast.ConnectHeader
+	if err := c.conn.Send(0, &header, channelSender, destination, NamespaceConnection); err != nil {
+		err = errors.Wrapf(err, "unable to connect to destination %q", destination)
+		c.fail(err)
+		return err
+	}
+	c.connected[destination] = true
+	return nil
+}
+
+// Send writes payload to destination on namespace and returns the request id of the message
+func (c *Channel) Send(namespace, destination string, payload cast.Payload) (int, error) {
+	requestID, _, err := c.send(namespace, destination, payload, false)
+	return requestID, err
+}
+
+// SendAndWait writes payload to destination on namespace and waits for the reply with the same request id
+func (c *Channel) SendAndWait(ctx context.Context, namespace, destination string, payload cast.Payload) (*api.CastMessage, error) {
+	requestID, reply, err := c.send(namespace, destination, payload, true)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, requestID)
+		c.mu.Unlock()
+		return nil, errors.Wrapf(ctx.Err(), "no reply for request %d", requestID)
+	}
+}
+
+func (c *Channel) send(namespace, destination string, payload cast.Payload, wait bool) (int, chan *api.CastMessage, error) {
+	if err := c.connect(destination); err != nil {
+		return 0, nil, err
+	}
+
+	// Lock is kept during write to not interleave concurrent messages on connection
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requestID += 1
+	requestID := c.requestID
+	var reply chan *api.CastMessage
+	if wait {
+		reply = make(chan *api.CastMessage, 1)
+		c.pending[requestID] = reply
+	}
+
+	payload.SetRequestId(requestID)
+	if err := c.conn.Send(requestID, payload, channelSender, destination, namespace); err != nil {
+		delete(c.pending, requestID)
+		err = errors.Wrapf(err, "unable to send message to %q on namespace %q", destination, namespace)
+		c.fail(err)
+		return 0, nil, err
+	}
+	log.WithFields(log.Fields{
+		"namespace":   namespace,
+		"destination": destination,
+		"request_id":  requestID,
+	}).Debug("cast message sent")
+	return requestID, reply, nil
+}
+
+func (c *Channel) Close() error {
+	c.mu.Lock()
+	c.fail(nil)
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// ParseRawPayload decodes a json object to send with Channel
+func ParseRawPayload(content []byte) (RawPayload, error) {
+	var payload RawPayload
+	if err := json.Unmarshal(content, &payload); err != nil {
+		return nil, errors.Wrap(err, "payload must be a json object")
+	}
+	if payload == nil {
+		payload = RawPayload{}
+	}
+	return payload, nil
+}
@@ -0,0 +1,113 @@
+package mediaplayer
+
+import (
+	"github.com/cyrilix/chromecast2mqt/castsim"
+	"github.com/vishen/go-chromecast/cast"
+	"testing"
+	"time"
+)
+
+func startSimulator(t *testing.T) *castsim.Server {
+	t.Helper()
+	server := castsim.NewServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start simulator: %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return server
+}
+
+// waitConnected waits for the connection state of destination
+func waitConnected(t *testing.T, c *Channel, destination string, expected bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		connected := c.connected[destination]
+		c.mu.Unlock()
+		if connected == expected {
+			return
+		}
+	}
+	t.Fatalf("destination %v connected: %v expected", destination, expected)
+}
+
+func TestChannel_Heartbeat(t *testing.T) {
+	server := startSimulator(t)
+	c, err := NewChannel(server.Addr(), server.Port(), WithHeartbeatInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unable to open channel: %v", err)
+	}
+	defer c.Close()
+
+	// Device answers PING
+	select {
+	case <-c.Done():
+		t.Fatalf("channel failed: %v", c.Err())
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	_ = server.Close()
+	select {
+	case <-c.Done():
+		if c.Err() == nil {
+			t.Errorf("no error on channel failure")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lost device not detected")
+	}
+}
+
+func TestChannel_Close(t *testing.T) {
+	server := startSimulator(t)
+	c, err := NewChannel(server.Addr(), server.Port())
+	if err != nil {
+		t.Fatalf("unable to open channel: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("unable to close channel: %v", err)
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Errorf("done not closed")
+	}
+	if err := c.Err(); err != nil {
+		t.Errorf("unexpected error of closed channel: %v", err)
+	}
+}
+
+func TestChannel_ForgetTransports(t *testing.T) {
+	server := startSimulator(t)
+	if err := server.SetApplication(cast.Application{AppId: "CC1AD845", TransportId: "web-1"}); err != nil {
+		t.Fatalf("unable to set application: %v", err)
+	}
+	c, err := NewChannel(server.Addr(), server.Port())
+	if err != nil {
+		t.Fatalf("unable to open channel: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Send(NamespaceMedia, "web-1", RawPayload{"type": "GET_STATUS"}); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	waitConnected(t, c, "web-1", true)
+
+	// Transport closed by the device
+	if err := server.Broadcast(castsim.NamespaceConnection, cast.PayloadHeader{Type: "CLOSE"}); err != nil {
+		t.Fatalf("unable to broadcast: %v", err)
+	}
+	waitConnected(t, c, "web-1", false)
+
+	// Application stopped
+	if _, err := c.Send(NamespaceMedia, "web-1", RawPayload{"type": "GET_STATUS"}); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	waitConnected(t, c, "web-1", true)
+	status := cast.ReceiverStatusResponse{PayloadHeader: cast.PayloadHeader{Type: "RECEIVER_STATUS"}}
+	status.Status.Applications = []cast.Application{}
+	if err := server.Broadcast(castsim.NamespaceReceiver, status); err != nil {
+		t.Fatalf("unable to broadcast: %v", err)
+	}
+	waitConnected(t, c, "web-1", false)
+	waitConnected(t, c, DestinationReceiver, true)
+}
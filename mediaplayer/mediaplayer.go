@@ -18,11 +18,6 @@ import (
 	"time"
 )
 
-func init() {
-	log.SetOutput(os.Stdout)
-	log.SetLevel(log.DebugLevel)
-}
-
 var (
 	cache = storage.NewStorage()
 )
@@ -53,15 +48,15 @@ func (e CachedDNSEntry) GetPort() int {
 type ApplicationOption func(*ApplicationOptions)
 
 type ApplicationOptions struct {
-	deviceName        string
-	deviceUuid        string
-	device            string
-	disableCache      bool
-	addr              string
-	port              int
-	ifaceName         string
-	dnsTimeoutSeconds int64
-	useFirstDevice    bool
+	deviceName     string
+	deviceUuid     string
+	device         string
+	disableCache   bool
+	addr           string
+	port           int
+	ifaceName      string
+	dnsTimeout     time.Duration
+	useFirstDevice bool
 }
 
 func WithAddress(addr string) ApplicationOption {
@@ -75,28 +70,75 @@ func WithPort(port int) ApplicationOption {
 	}
 }
 
+// WithDeviceName selects the discovered device with this friendly name
+func WithDeviceName(name string) ApplicationOption {
+	return func(o *ApplicationOptions) {
+		o.deviceName = name
+		o.useFirstDevice = false
+	}
+}
+
+// WithDeviceUuid selects the discovered device with this uuid
+func WithDeviceUuid(uuid string) ApplicationOption {
+	return func(o *ApplicationOptions) {
+		o.deviceUuid = uuid
+		o.useFirstDevice = false
+	}
+}
+
+// WithDevice selects the discovered device with this device type (ex: "Chromecast", "Google Home Mini")
+func WithDevice(device string) ApplicationOption {
+	return func(o *ApplicationOptions) {
+		o.device = device
+		o.useFirstDevice = false
+	}
+}
+
+func WithIface(ifaceName string) ApplicationOption {
+	return func(o *ApplicationOptions) {
+		o.ifaceName = ifaceName
+	}
+}
+
+// WithDnsTimeout limits the duration of the device discovery
+func WithDnsTimeout(timeout time.Duration) ApplicationOption {
+	return func(o *ApplicationOptions) {
+		o.dnsTimeout = timeout
+	}
+}
+
 var defaultApplicationOptions = ApplicationOptions{
-	deviceName:        "",
-	deviceUuid:        "",
-	device:            "",
-	disableCache:      true,
-	addr:              "",
-	port:              -1,
-	ifaceName:         "",
-	dnsTimeoutSeconds: 10,
-	useFirstDevice:    true,
+	deviceName:     "",
+	deviceUuid:     "",
+	device:         "",
+	disableCache:   true,
+	addr:           "",
+	port:           -1,
+	ifaceName:      "",
+	dnsTimeout:     10 * time.Second,
+	useFirstDevice: true,
 }
 
 func NewApplication(opts ...ApplicationOption) (*application.Application, error) {
+	entry, err := FindDevice(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return connectApplication(entry, opts...)
+}
+
+// FindDevice resolves the cast device to use from options, with network discovery if no address is set
+func FindDevice(opts ...ApplicationOption) (castdns.CastDNSEntry, error) {
+	return FindDeviceContext(context.Background(), opts...)
+}
+
+// FindDeviceContext is FindDevice with a network discovery stopped when ctx is done
+func FindDeviceContext(ctx context.Context, opts ...ApplicationOption) (castdns.CastDNSEntry, error) {
 	options := defaultApplicationOptions
 	for _, o := range opts {
 		o(&options)
 	}
 
-	applicationOptions := []application.ApplicationOption{
-		application.WithCacheDisabled(options.disableCache),
-	}
-
 	// If we need to look on a specific network interface for mdns or
 	// for finding a network ip to host from, ensure that the network
 	// interface exists.
@@ -106,7 +148,6 @@ func NewApplication(opts ...ApplicationOption) (*application.Application, error)
 		if iface, err = net.InterfaceByName(options.ifaceName); err != nil {
 			return nil, errors.Wrap(err, fmt.Sprintf("unable to find interface %q", options.ifaceName))
 		}
-		applicationOptions = append(applicationOptions, application.WithIface(iface))
 	}
 
 	var entry castdns.CastDNSEntry
@@ -121,7 +162,7 @@ func NewApplication(opts ...ApplicationOption) (*application.Application, error)
 		}
 		if !found {
 			var err error
-			if entry, err = findCastDNS(iface, &options); err != nil {
+			if entry, err = findCastDNS(ctx, iface, &options); err != nil {
 				return nil, errors.Wrap(err, "unable to find cast dns entry")
 			}
 		}
@@ -151,6 +192,26 @@ func NewApplication(opts ...ApplicationOption) (*application.Application, error)
 			Port: options.port,
 		}
 	}
+	return entry, nil
+}
+
+func connectApplication(entry castdns.CastDNSEntry, opts ...ApplicationOption) (*application.Application, error) {
+	options := defaultApplicationOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	applicationOptions := []application.ApplicationOption{
+		application.WithCacheDisabled(options.disableCache),
+	}
+	if options.ifaceName != "" {
+		iface, err := net.InterfaceByName(options.ifaceName)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("unable to find interface %q", options.ifaceName))
+		}
+		applicationOptions = append(applicationOptions, application.WithIface(iface))
+	}
+
 	app := application.NewApplication(applicationOptions...)
 	if err := app.Start(entry.GetAddr(), entry.GetPort()); err != nil {
 		// NOTE: currently we delete the dns cache every time we get
@@ -180,8 +241,33 @@ func findCachedCastDNS(deviceName, deviceUuid string) castdns.CastDNSEntry {
 	return CachedDNSEntry{}
 }
 
-func findCastDNS(iface *net.Interface, options *ApplicationOptions) (castdns.CastDNSEntry, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(options.dnsTimeoutSeconds))
+// DiscoverDevices lists all cast devices found on network before timeout, sorted by name
+func DiscoverDevices(ifaceName string, timeout time.Duration) ([]castdns.CastEntry, error) {
+	var iface *net.Interface
+	if ifaceName != "" {
+		var err error
+		if iface, err = net.InterfaceByName(ifaceName); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("unable to find interface %q", ifaceName))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	castEntryChan, err := castdns.DiscoverCastDNSEntries(ctx, iface)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to discover cast dns entries")
+	}
+
+	entries := make([]castdns.CastEntry, 0)
+	for entry := range castEntryChan {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeviceName < entries[j].DeviceName })
+	return entries, nil
+}
+
+func findCastDNS(ctx context.Context, iface *net.Interface, options *ApplicationOptions) (castdns.CastDNSEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, options.dnsTimeout)
 	defer cancel()
 	castEntryChan, err := castdns.DiscoverCastDNSEntries(ctx, iface)
 	if err != nil {
@@ -199,6 +285,9 @@ func findCastDNS(iface *net.Interface, options *ApplicationOptions) (castdns.Cas
 	if len(foundEntries) == 0 {
 		return castdns.CastEntry{}, fmt.Errorf("no cast devices found on network")
 	}
+	if options.deviceName != "" || options.deviceUuid != "" || options.device != "" {
+		return castdns.CastEntry{}, fmt.Errorf("no cast device found on network with name=%q uuid=%q device=%q", options.deviceName, options.deviceUuid, options.device)
+	}
 
 	// Always return entries in deterministic order.
 	sort.Slice(foundEntries, func(i, j int) bool { return foundEntries[i].DeviceName < foundEntries[j].DeviceName })
@@ -0,0 +1,5 @@
+//go:build !race
+
+package mediaplayer
+
+const raceEnabled = false
@@ -0,0 +1,209 @@
+package mediaplayer
+
+import (
+	"context"
+	"fmt"
+	"github.com/vishen/go-chromecast/application"
+	"github.com/vishen/go-chromecast/cast"
+	"github.com/vishen/go-chromecast/cast/proto"
+	castdns "github.com/vishen/go-chromecast/dns"
+	"strings"
+	"sync"
+)
+
+// MessageFunc receives device events
+type MessageFunc func(msg *api.CastMessage)
+
+// Player is a media renderer device. Events and status use cast protocol types, renderers other than cast devices
+// translate their state to RECEIVER_STATUS and MEDIA_STATUS messages.
+type Player interface {
+	// Status returns the last known running application, media and volume, each may be nil
+	Status() (*cast.Application, *cast.Media, *cast.Volume)
+	// Update requests the current status of the device
+	Update() error
+	// OnMessage registers f to receive all messages from the device
+	OnMessage(f MessageFunc)
+
+	// SetVolume sets volume level between 0 and 1
+	SetVolume(level float32) error
+	SetMuted(muted bool) error
+
+	Play() error
+	Pause() error
+	Stop() error
+	Next() error
+	Previous() error
+	// Seek moves current media to position in seconds
+	Seek(position float32) error
+	// Load plays the media at url, contentType is guessed if empty
+	Load(url, contentType string) error
+
+	// SetDebug logs all cast messages exchanged with the device
+	SetDebug(debug bool)
+
+	// Close disconnects from the device without stopping the running application
+	Close() error
+}
+
+// castApp is the part of go-chromecast application used by castPlayer
+type castApp interface {
+	Status() (*cast.Application, *cast.Media, *cast.Volume)
+	Update() error
+	AddMessageFunc(f application.CastMessageFunc)
+	SetVolume(value float32) error
+	SetMuted(value bool) error
+	Unpause() error
+	Pause() error
+	StopMedia() error
+	Next() error
+	Previous() error
+	SeekToTime(value float32) error
+	Load(filenameOrUrl, contentType string, transcode, detach, forceDetach bool) error
+	SetDebug(debug bool)
+	Close(stopMedia bool) error
+}
+
+// castPlayer implements Player with go-chromecast application
+type castPlayer struct {
+	// mu serializes calls to app, go-chromecast shares its request id and pending requests without lock
+	mu  sync.Mutex
+	app castApp
+}
+
+// NewCastPlayer wraps an already started go-chromecast application
+func NewCastPlayer(app *application.Application) Player {
+	return &castPlayer{app: app}
+}
+
+// NewPlayer finds the device from options and connects to it
+func NewPlayer(opts ...ApplicationOption) (Player, error) {
+	entry, err := FindDevice(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return Connect(entry, opts...)
+}
+
+// Connect starts a player on a device previously resolved by FindDevice
+func Connect(entry castdns.CastDNSEntry, opts ...ApplicationOption) (Player, error) {
+	app, err := connectApplication(entry, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewCastPlayer(app), nil
+}
+
+// ConnectContext is Connect returning when ctx is done, a connection established later is closed
+func ConnectContext(ctx context.Context, entry castdns.CastDNSEntry, opts ...ApplicationOption) (Player, error) {
+	type result struct {
+		player Player
+		err    error
+	}
+	// Buffered so the connection doesn't block once abandoned
+	connected := make(chan result, 1)
+	go func() {
+		player, err := Connect(entry, opts...)
+		connected <- result{player: player, err: err}
+	}()
+	select {
+	case r := <-connected:
+		return r.player, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-connected; r.err == nil {
+				_ = r.player.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (p *castPlayer) Status() (*cast.Application, *cast.Media, *cast.Volume) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Status()
+}
+
+func (p *castPlayer) Update() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Update()
+}
+
+// OnMessage doesn't start media tracking of go-chromecast, its finished channel is never read and blocks the
+// reception of messages when the application changes
+func (p *castPlayer) OnMessage(f MessageFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.app.AddMessageFunc(application.CastMessageFunc(f))
+}
+
+func (p *castPlayer) SetVolume(level float32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.SetVolume(level)
+}
+
+func (p *castPlayer) SetMuted(muted bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.SetMuted(muted)
+}
+
+func (p *castPlayer) Play() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Unpause()
+}
+
+func (p *castPlayer) Pause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Pause()
+}
+
+func (p *castPlayer) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.StopMedia()
+}
+
+func (p *castPlayer) Next() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Next()
+}
+
+func (p *castPlayer) Previous() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Previous()
+}
+
+func (p *castPlayer) Seek(position float32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.SeekToTime(position)
+}
+
+func (p *castPlayer) Load(url, contentType string) error {
+	// Local files would need to be served by this process until the end of the media
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("invalid content id %q, only http(s) urls can be loaded", url)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Load(url, contentType, false, true, false)
+}
+
+func (p *castPlayer) SetDebug(debug bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.app.SetDebug(debug)
+}
+
+func (p *castPlayer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.app.Close(false)
+}
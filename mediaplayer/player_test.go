@@ -0,0 +1,132 @@
+package mediaplayer
+
+import (
+	"context"
+	"errors"
+	"github.com/cyrilix/chromecast2mqt/castsim"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// exclusiveApp fails the test if its methods are called concurrently
+type exclusiveApp struct {
+	castApp
+	t      *testing.T
+	active int32
+}
+
+func (a *exclusiveApp) enter() func() {
+	if atomic.AddInt32(&a.active, 1) > 1 {
+		a.t.Errorf("concurrent call to cast application")
+	}
+	// Widen the window of overlapping calls
+	time.Sleep(time.Millisecond)
+	return func() { atomic.AddInt32(&a.active, -1) }
+}
+
+func (a *exclusiveApp) Update() error {
+	defer a.enter()()
+	return a.castApp.Update()
+}
+
+func (a *exclusiveApp) SetVolume(value float32) error {
+	defer a.enter()()
+	return a.castApp.SetVolume(value)
+}
+
+func (a *exclusiveApp) SetMuted(value bool) error {
+	defer a.enter()()
+	return a.castApp.SetMuted(value)
+}
+
+func (a *exclusiveApp) SetDebug(debug bool) {
+	defer a.enter()()
+	a.castApp.SetDebug(debug)
+}
+
+func TestCastPlayer_Concurrent(t *testing.T) {
+	if raceEnabled {
+		// application.recvMessages reads pending requests without lock while sendAndWait registers them, the race
+		// detector reports it even with a single caller
+		t.Skip("go-chromecast is not race free")
+	}
+
+	server := castsim.NewServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start simulator: %v", err)
+	}
+	defer server.Close()
+
+	app, err := connectApplication(CachedDNSEntry{Addr: server.Addr(), Port: server.Port()})
+	if err != nil {
+		t.Fatalf("unable to connect to simulator: %v", err)
+	}
+	player := &castPlayer{app: &exclusiveApp{castApp: app, t: t}}
+	defer player.Close()
+
+	calls := []func() error{
+		player.Update,
+		func() error { return player.SetVolume(0.3) },
+		func() error { return player.SetMuted(true) },
+		func() error {
+			player.SetDebug(false)
+			return nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10*len(calls))
+	for i := 0; i < 10; i++ {
+		for _, call := range calls {
+			wg.Add(1)
+			go func(call func() error) {
+				defer wg.Done()
+				errs <- call()
+			}(call)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent call failed: %v", err)
+		}
+	}
+
+	if _, _, volume := player.Status(); volume == nil {
+		t.Errorf("volume status not received")
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	// Device accepting connections without answering
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	addr := l.Addr().(*net.TCPAddr)
+	start := time.Now()
+	_, err = ConnectContext(ctx, CachedDNSEntry{Addr: addr.IP.String(), Port: addr.Port})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error %v, deadline exceeded expected", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection returned after %v", elapsed)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package mediaplayer
+
+// raceEnabled is true when tests are built with the race detector
+const raceEnabled = true
@@ -0,0 +1,377 @@
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func decodeConnect(p *packet) (*connectPacket, error) {
+	r := p.reader()
+	name, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	version, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if name != "MQTT" || version != protocolVersion {
+		return nil, fmt.Errorf("unsupported protocol %v %d", name, version)
+	}
+	flags, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	keepAlive, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	c := connectPacket{cleanStart: flags&0x02 != 0, keepAlive: time.Duration(keepAlive) * time.Second}
+	if c.properties, err = r.properties(); err != nil {
+		return nil, err
+	}
+	if c.clientID, err = r.string(); err != nil {
+		return nil, err
+	}
+	if flags&0x04 != 0 {
+		c.will = &Publish{QoS: (flags >> 3) & 0x03, Retain: flags&0x20 != 0}
+		if c.will.Properties, err = r.properties(); err != nil {
+			return nil, err
+		}
+		if c.will.Topic, err = r.string(); err != nil {
+			return nil, err
+		}
+		if c.will.Payload, err = r.binary(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&0x80 != 0 {
+		if c.username, err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if c.password, err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+func connackPacket(sessionPresent bool, reason byte, props *Properties) *packet {
+	var buf bytes.Buffer
+	flags := byte(0)
+	if sessionPresent {
+		flags = 0x01
+	}
+	buf.WriteByte(flags)
+	buf.WriteByte(reason)
+	var raw bytes.Buffer
+	if props.AssignedClientID != "" {
+		raw.WriteByte(propAssignedClientID)
+		writeString(&raw, props.AssignedClientID)
+	}
+	if props.ServerKeepAlive != nil {
+		raw.WriteByte(propServerKeepAlive)
+		writeUint16(&raw, *props.ServerKeepAlive)
+	}
+	if props.ReceiveMaximum > 0 {
+		raw.WriteByte(propReceiveMaximum)
+		writeUint16(&raw, props.ReceiveMaximum)
+	}
+	if props.MaximumQoS != nil {
+		raw.WriteByte(propMaximumQoS)
+		raw.WriteByte(*props.MaximumQoS)
+	}
+	if props.RetainAvailable != nil {
+		raw.WriteByte(propRetainAvailable)
+		raw.WriteByte(*props.RetainAvailable)
+	}
+	writeVariableByteInteger(&buf, raw.Len())
+	buf.Write(raw.Bytes())
+	return &packet{typ: packetConnack, body: buf.Bytes()}
+}
+
+func decodeSubscribe(p *packet) (uint16, string, byte, error) {
+	r := p.reader()
+	id, err := r.uint16()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if _, err := r.properties(); err != nil {
+		return 0, "", 0, err
+	}
+	filter, err := r.string()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	options, err := r.byte()
+	return id, filter, options & 0x03, err
+}
+
+func decodeUnsubscribe(p *packet) (uint16, []string, error) {
+	r := p.reader()
+	id, err := r.uint16()
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := r.properties(); err != nil {
+		return 0, nil, err
+	}
+	filters := make([]string, 0)
+	for r.buf.Len() > 0 {
+		f, err := r.string()
+		if err != nil {
+			return 0, nil, err
+		}
+		filters = append(filters, f)
+	}
+	return id, filters, nil
+}
+
+// testBroker is an MQTT v5 broker for a single client session, it records packets received from the client
+type testBroker struct {
+	t *testing.T
+	l net.Listener
+	// connack are the properties sent on connection
+	connack Properties
+
+	mu   sync.Mutex
+	conn net.Conn
+	subs map[string]byte
+	// sessionPresent is sent on connection
+	sessionPresent bool
+	// hold are the types of packets not acknowledged
+	hold map[byte]bool
+	// pending are QoS 2 messages received and not yet released
+	pending map[uint16]*Publish
+
+	connects   chan *connectPacket
+	subscribed chan string
+	published  chan *Publish
+	// releases are the packet ids of PUBREL received
+	releases chan uint16
+	// acks are the acknowledgements of messages sent to the client
+	acks chan *packet
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	b := testBroker{
+		t:          t,
+		l:          l,
+		subs:       make(map[string]byte),
+		pending:    make(map[uint16]*Publish),
+		hold:       make(map[byte]bool),
+		connects:   make(chan *connectPacket, 10),
+		subscribed: make(chan string, 10),
+		published:  make(chan *Publish, 100),
+		releases:   make(chan uint16, 10),
+		acks:       make(chan *packet, 100),
+	}
+	go b.accept()
+	t.Cleanup(b.close)
+	return &b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *testBroker) accept() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conn = conn
+		b.mu.Unlock()
+		go b.serve(conn)
+	}
+}
+
+func (b *testBroker) close() {
+	_ = b.l.Close()
+	b.drop()
+}
+
+// resume sets the session present flag of next connections and the types of packets not acknowledged
+func (b *testBroker) resume(sessionPresent bool, hold ...byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessionPresent = sessionPresent
+	b.hold = make(map[byte]bool)
+	for _, typ := range hold {
+		b.hold[typ] = true
+	}
+}
+
+// drop closes the connection of the client
+func (b *testBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		_ = b.conn.Close()
+		b.conn = nil
+	}
+}
+
+func (b *testBroker) write(p *packet) {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		b.t.Errorf("client not connected")
+		return
+	}
+	if _, err := conn.Write(p.bytes()); err != nil {
+		b.t.Errorf("unable to write packet %d: %v", p.typ, err)
+	}
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		if err := b.handle(conn, p); err != nil {
+			b.t.Errorf("broker: %v", err)
+			return
+		}
+	}
+}
+
+func (b *testBroker) handle(conn net.Conn, p *packet) error {
+	b.mu.Lock()
+	hold, sessionPresent := b.hold[p.typ], b.sessionPresent
+	b.mu.Unlock()
+	reply := func(p *packet) error {
+		if hold {
+			return nil
+		}
+		_, err := conn.Write(p.bytes())
+		return err
+	}
+	switch p.typ {
+	case packetConnect:
+		c, err := decodeConnect(p)
+		if err != nil {
+			return fmt.Errorf("invalid connect: %v", err)
+		}
+		b.connects <- c
+		return reply(connackPacket(sessionPresent, 0, &b.connack))
+	case packetPublish:
+		m, err := decodePublish(p)
+		if err != nil {
+			return fmt.Errorf("invalid publish: %v", err)
+		}
+		switch m.QoS {
+		case 0:
+			b.published <- m
+		case 1:
+			b.published <- m
+			return reply(ackPacket(packetPuback, m.packetID, 0))
+		case 2:
+			b.mu.Lock()
+			b.pending[m.packetID] = m
+			b.mu.Unlock()
+			return reply(ackPacket(packetPubrec, m.packetID, 0))
+		}
+	case packetPubrel:
+		a, err := decodeAck(p)
+		if err != nil {
+			return fmt.Errorf("invalid pubrel: %v", err)
+		}
+		b.releases <- a.packetID
+		b.mu.Lock()
+		m, ok := b.pending[a.packetID]
+		delete(b.pending, a.packetID)
+		b.mu.Unlock()
+		if ok {
+			b.published <- m
+		}
+		return reply(ackPacket(packetPubcomp, a.packetID, 0))
+	case packetPuback, packetPubrec, packetPubcomp:
+		b.acks <- p
+	case packetSubscribe:
+		id, filter, qos, err := decodeSubscribe(p)
+		if err != nil {
+			return fmt.Errorf("invalid subscribe: %v", err)
+		}
+		b.mu.Lock()
+		b.subs[filter] = qos
+		b.mu.Unlock()
+		b.subscribed <- filter
+		var body bytes.Buffer
+		writeUint16(&body, id)
+		(*Properties)(nil).encode(&body)
+		body.WriteByte(qos)
+		return reply(&packet{typ: packetSuback, body: body.Bytes()})
+	case packetUnsubscribe:
+		id, filters, err := decodeUnsubscribe(p)
+		if err != nil {
+			return fmt.Errorf("invalid unsubscribe: %v", err)
+		}
+		var body bytes.Buffer
+		writeUint16(&body, id)
+		(*Properties)(nil).encode(&body)
+		b.mu.Lock()
+		for _, f := range filters {
+			delete(b.subs, f)
+			body.WriteByte(0)
+		}
+		b.mu.Unlock()
+		return reply(&packet{typ: packetUnsuback, body: body.Bytes()})
+	case packetPingreq:
+		return reply(&packet{typ: packetPingresp})
+	case packetDisconnect:
+		return nil
+	default:
+		return fmt.Errorf("unexpected packet type %d", p.typ)
+	}
+	return nil
+}
+
+// ack waits for the acknowledgement of a message sent to the client
+func (b *testBroker) ack(typ byte) *ack {
+	b.t.Helper()
+	select {
+	case p := <-b.acks:
+		if p.typ != typ {
+			b.t.Fatalf("ack type %d received, %d expected", p.typ, typ)
+		}
+		a, err := decodeAck(p)
+		if err != nil {
+			b.t.Fatalf("invalid ack: %v", err)
+		}
+		return a
+	case <-time.After(5 * time.Second):
+		b.t.Fatalf("no ack %d received", typ)
+	}
+	return nil
+}
+
+// waitFor returns the next value of ch
+func waitFor[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %v received", what)
+	}
+	var zero T
+	return zero
+}
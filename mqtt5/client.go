@@ -0,0 +1,779 @@
+// Package mqtt5 is a minimal MQTT v5 client, it supports the properties used by the bridge: response topic,
+// correlation data, user properties, message and session expiry.
+package mqtt5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeepAlive      = 30 * time.Second
+	defaultConnectTimeout = 30 * time.Second
+	writeTimeout          = 10 * time.Second
+	maxReconnectDelay     = time.Minute
+	// reasonFailure is the lowest reason code of errors, lower codes are successes
+	reasonFailure = 0x80
+	// reasonPacketIDNotFound is sent in PUBREL of an unknown PUBREC
+	reasonPacketIDNotFound = 0x92
+)
+
+var ErrNotConnected = errors.New("mqtt client not connected")
+
+// ClientOptions configure the connection to the broker
+type ClientOptions struct {
+	// Broker url, ex: tcp://127.0.0.1:1883 or ssl://broker:8883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// CleanStart discards the session kept by the broker on connection
+	CleanStart bool
+	// SessionExpiry is the duration the broker keeps the session after disconnection
+	SessionExpiry  time.Duration
+	KeepAlive      time.Duration
+	ConnectTimeout time.Duration
+	TLSConfig      *tls.Config
+	// Will is published by the broker when the connection is lost without disconnection, nil if none
+	Will *Publish
+	// OnConnect is called after each connection and reconnection
+	OnConnect func()
+	// OnConnectionLost is called when the connection is lost, the client reconnects automatically
+	OnConnectionLost func(err error)
+}
+
+// MessageHandler receives messages of a subscription in order of reception. Each subscription has its own
+// goroutine, a slow handler doesn't delay other subscriptions nor acknowledgements.
+type MessageHandler func(msg *Publish)
+
+type subscription struct {
+	qos        byte
+	dispatcher *dispatcher
+}
+
+// dispatcher calls the handler of a subscription with its messages one after another, messages wait in an
+// unbounded queue so the read loop is never blocked by the handler
+type dispatcher struct {
+	handler MessageHandler
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	queue   []*Publish
+	stopped bool
+}
+
+func newDispatcher(handler MessageHandler) *dispatcher {
+	d := dispatcher{handler: handler, wake: make(chan struct{}, 1)}
+	go d.run()
+	return &d
+}
+
+func (d *dispatcher) push(m *Publish) {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.queue = append(d.queue, m)
+	d.mu.Unlock()
+	d.signal()
+}
+
+func (d *dispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop discards pending messages, the message being handled is completed
+func (d *dispatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.queue = nil
+	d.mu.Unlock()
+	d.signal()
+}
+
+// next pops the oldest message, nil if the queue is empty or the dispatcher stopped
+func (d *dispatcher) next() *Publish {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped || len(d.queue) == 0 {
+		return nil
+	}
+	m := d.queue[0]
+	d.queue[0] = nil
+	d.queue = d.queue[1:]
+	return m
+}
+
+func (d *dispatcher) run() {
+	for range d.wake {
+		for m := d.next(); m != nil; m = d.next() {
+			d.handler(m)
+		}
+		d.mu.Lock()
+		stopped := d.stopped
+		d.mu.Unlock()
+		if stopped {
+			return
+		}
+	}
+}
+
+// outgoing is a QoS 1 or 2 message sent and not acknowledged yet
+type outgoing struct {
+	msg Publish
+	// seq is the order of sending
+	seq uint64
+	// released is true once PUBREC of a QoS 2 message is received, PUBREL is then sent instead of the message
+	released bool
+}
+
+// Client is an MQTT v5 client reconnecting automatically until Disconnect. QoS 1 and 2 messages not acknowledged are
+// sent again when the broker resumes the session on reconnection.
+type Client struct {
+	opts ClientOptions
+
+	mu              sync.Mutex
+	conn            net.Conn
+	connected       bool
+	stopped         bool
+	keepAlive       time.Duration
+	maxQoS          byte
+	retainAvailable bool
+	inflight        chan struct{}
+	nextID          uint16
+	pending         map[uint16]chan *ack
+	seq             uint64
+	outgoing        map[uint16]*outgoing
+	received        map[uint16]bool
+	subs            map[string]subscription
+
+	writeMu sync.Mutex
+}
+
+func NewClient(opts ClientOptions) *Client {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = defaultConnectTimeout
+	}
+	return &Client{
+		opts:     opts,
+		pending:  make(map[uint16]chan *ack),
+		outgoing: make(map[uint16]*outgoing),
+		received: make(map[uint16]bool),
+		subs:     make(map[string]subscription),
+	}
+}
+
+// Connect establishes the first connection, the client then reconnects when the connection is lost
+func (c *Client) Connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+	defer cancel()
+	return c.connect(ctx)
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(c.opts.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url %q: %v", c.opts.Broker, err)
+	}
+	secure := false
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts", "tcps":
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if secure {
+		dialer := tls.Dialer{Config: c.opts.TLSConfig}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to connect to broker %v: %v", c.opts.Broker, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	connect := connectPacket{
+		clientID:   c.opts.ClientID,
+		username:   c.opts.Username,
+		password:   c.opts.Password,
+		cleanStart: c.opts.CleanStart,
+		keepAlive:  c.opts.KeepAlive,
+		properties: &Properties{SessionExpiry: c.opts.SessionExpiry},
+		will:       c.opts.Will,
+	}
+	if _, err := conn.Write(connect.packet().bytes()); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("unable to send connect packet: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("unable to read connack packet: %v", err)
+	}
+	if p.typ != packetConnack {
+		_ = conn.Close()
+		return fmt.Errorf("unexpected packet type %d, connack expected", p.typ)
+	}
+	ack, err := decodeConnack(p)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("invalid connack packet: %v", err)
+	}
+	if ack.reason >= reasonFailure {
+		_ = conn.Close()
+		return fmt.Errorf("connection refused by broker, reason 0x%02x %v", ack.reason, ack.properties.ReasonString)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// Messages of the resumed session are sent before new ones
+	for _, p := range c.resumeSession(ack.sessionPresent) {
+		if err := c.write(conn, p); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("unable to resend unacknowledged messages: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.connected = true
+	c.keepAlive = c.opts.KeepAlive
+	if ack.properties.ServerKeepAlive != nil {
+		c.keepAlive = time.Duration(*ack.properties.ServerKeepAlive) * time.Second
+	}
+	c.maxQoS = 2
+	if ack.properties.MaximumQoS != nil {
+		c.maxQoS = *ack.properties.MaximumQoS
+	}
+	c.retainAvailable = ack.properties.RetainAvailable == nil || *ack.properties.RetainAvailable == 1
+	receiveMaximum := ack.properties.ReceiveMaximum
+	if receiveMaximum == 0 {
+		receiveMaximum = 65535
+	}
+	c.inflight = make(chan struct{}, receiveMaximum)
+	for i := 0; i < len(c.outgoing) && i < cap(c.inflight); i++ {
+		c.inflight <- struct{}{}
+	}
+	keepAlive := c.keepAlive
+	subs := make(map[string]subscription, len(c.subs))
+	for filter, sub := range c.subs {
+		subs[filter] = sub
+	}
+	c.mu.Unlock()
+
+	go c.readLoop(conn, r, keepAlive)
+	if keepAlive > 0 {
+		go c.pingLoop(conn, keepAlive)
+	}
+	if !ack.sessionPresent && len(subs) > 0 {
+		go c.resubscribe(subs)
+	}
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect()
+	}
+	return nil
+}
+
+// resumeSession returns the packets to send again if the broker kept the session, in order of sending: PUBLISH with
+// dup flag or PUBREL of released messages. Otherwise the session is discarded and waiting publishes fail.
+func (c *Client) resumeSession(present bool) []*packet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !present {
+		for id := range c.outgoing {
+			if ch, ok := c.pending[id]; ok {
+				close(ch)
+				delete(c.pending, id)
+			}
+		}
+		c.outgoing = make(map[uint16]*outgoing)
+		c.received = make(map[uint16]bool)
+		return nil
+	}
+
+	messages := make([]*outgoing, 0, len(c.outgoing))
+	for _, o := range c.outgoing {
+		messages = append(messages, o)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].seq < messages[j].seq
+	})
+	packets := make([]*packet, 0, len(messages))
+	for _, o := range messages {
+		if o.released {
+			packets = append(packets, ackPacket(packetPubrel, o.msg.packetID, 0))
+			continue
+		}
+		msg := o.msg
+		msg.dup = true
+		packets = append(packets, msg.packet())
+	}
+	return packets
+}
+
+// resubscribe restores subscriptions not kept by the broker
+func (c *Client) resubscribe(subs map[string]subscription) {
+	for filter, sub := range subs {
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+		_ = c.subscribe(ctx, filter, sub.qos)
+		cancel()
+	}
+}
+
+func (c *Client) readLoop(conn net.Conn, r *bufio.Reader, keepAlive time.Duration) {
+	for {
+		if keepAlive > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		p, err := readPacket(r)
+		if err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+		if err := c.handle(conn, p); err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+	}
+}
+
+func (c *Client) handle(conn net.Conn, p *packet) error {
+	switch p.typ {
+	case packetPublish:
+		m, err := decodePublish(p)
+		if err != nil {
+			return fmt.Errorf("invalid publish packet: %v", err)
+		}
+		switch m.QoS {
+		case 0:
+			c.deliver(m)
+		case 1:
+			c.deliver(m)
+			return c.write(conn, ackPacket(packetPuback, m.packetID, 0))
+		case 2:
+			c.mu.Lock()
+			duplicate := c.received[m.packetID]
+			c.received[m.packetID] = true
+			c.mu.Unlock()
+			if !duplicate {
+				c.deliver(m)
+			}
+			return c.write(conn, ackPacket(packetPubrec, m.packetID, 0))
+		}
+	case packetPubrel:
+		a, err := decodeAck(p)
+		if err != nil {
+			return fmt.Errorf("invalid pubrel packet: %v", err)
+		}
+		c.mu.Lock()
+		delete(c.received, a.packetID)
+		c.mu.Unlock()
+		return c.write(conn, ackPacket(packetPubcomp, a.packetID, 0))
+	case packetPubrec:
+		a, err := decodeAck(p)
+		if err != nil {
+			return fmt.Errorf("invalid pubrec packet: %v", err)
+		}
+		c.mu.Lock()
+		o, ok := c.outgoing[a.packetID]
+		if ok && a.reasons[0] < reasonFailure {
+			o.released = true
+		}
+		c.mu.Unlock()
+		switch {
+		case !ok:
+			return c.write(conn, ackPacket(packetPubrel, a.packetID, reasonPacketIDNotFound))
+		case a.reasons[0] >= reasonFailure:
+			c.complete(a)
+			return nil
+		}
+		return c.write(conn, ackPacket(packetPubrel, a.packetID, 0))
+	case packetPuback, packetPubcomp:
+		a, err := decodeAck(p)
+		if err != nil {
+			return fmt.Errorf("invalid ack packet type %d: %v", p.typ, err)
+		}
+		c.complete(a)
+	case packetSuback, packetUnsuback:
+		a, err := decodeAck(p)
+		if err != nil {
+			return fmt.Errorf("invalid ack packet type %d: %v", p.typ, err)
+		}
+		c.notify(a)
+	case packetPingresp:
+	case packetDisconnect:
+		reason, msg := decodeDisconnect(p)
+		return fmt.Errorf("disconnected by broker, reason 0x%02x %v", reason, msg)
+	default:
+		return fmt.Errorf("unexpected packet type %d", p.typ)
+	}
+	return nil
+}
+
+// complete removes an acknowledged message from the session
+func (c *Client) complete(a *ack) {
+	c.mu.Lock()
+	if _, ok := c.outgoing[a.packetID]; ok {
+		delete(c.outgoing, a.packetID)
+		select {
+		case <-c.inflight:
+		default:
+		}
+	}
+	c.mu.Unlock()
+	c.notify(a)
+}
+
+// notify sends a to the operation waiting for it, if any
+func (c *Client) notify(a *ack) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.pending[a.packetID]; ok {
+		select {
+		case ch <- a:
+		default:
+		}
+	}
+}
+
+func (c *Client) deliver(m *Publish) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for filter, sub := range c.subs {
+		if Match(filter, m.Topic) {
+			sub.dispatcher.push(m)
+		}
+	}
+}
+
+func (c *Client) pingLoop(conn net.Conn, keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		current := c.conn == conn
+		c.mu.Unlock()
+		if !current {
+			return
+		}
+		if err := c.write(conn, &packet{typ: packetPingreq}); err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+	}
+}
+
+func (c *Client) connectionLost(conn net.Conn, err error) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+	c.conn = nil
+	c.connected = false
+	for id, ch := range c.pending {
+		if _, ok := c.outgoing[id]; ok && !c.stopped {
+			// Acknowledgement is waited after the session is resumed
+			continue
+		}
+		close(ch)
+		delete(c.pending, id)
+	}
+	stopped := c.stopped
+	c.mu.Unlock()
+
+	_ = conn.Close()
+	if stopped {
+		return
+	}
+	if c.opts.OnConnectionLost != nil {
+		c.opts.OnConnectionLost(err)
+	}
+	go c.reconnect()
+}
+
+func (c *Client) reconnect() {
+	delay := time.Second
+	for {
+		time.Sleep(delay)
+		c.mu.Lock()
+		stopped := c.stopped
+		c.mu.Unlock()
+		if stopped {
+			return
+		}
+		if err := c.Connect(context.Background()); err == nil {
+			return
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (c *Client) write(conn net.Conn, p *packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := conn.Write(p.bytes())
+	return err
+}
+
+// current returns the connection, ErrNotConnected if the client is disconnected
+func (c *Client) current() (net.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return nil, ErrNotConnected
+	}
+	return c.conn, nil
+}
+
+// register allocates a packet id and the channel of its acknowledgements, msg is kept in the session until its
+// acknowledgement if not nil
+func (c *Client) register(msg *Publish) (uint16, chan *ack, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < 65535; i++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		_, waiting := c.pending[c.nextID]
+		_, sent := c.outgoing[c.nextID]
+		if !waiting && !sent {
+			ch := make(chan *ack, 1)
+			c.pending[c.nextID] = ch
+			if msg != nil {
+				msg.packetID = c.nextID
+				c.seq++
+				c.outgoing[c.nextID] = &outgoing{msg: *msg, seq: c.seq}
+			}
+			return c.nextID, ch, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("no packet id available")
+}
+
+func (c *Client) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func wait(ctx context.Context, ch chan *ack) (*ack, error) {
+	select {
+	case a, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("connection lost before acknowledgement")
+		}
+		return a, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func checkReason(a *ack, operation string) error {
+	if a.reasons[0] < reasonFailure {
+		return nil
+	}
+	msg := ""
+	if a.properties != nil {
+		msg = a.properties.ReasonString
+	}
+	return fmt.Errorf("%v refused by broker, reason 0x%02x %v", operation, a.reasons[0], msg)
+}
+
+// Publish sends m and waits for its acknowledgement if QoS is 1 or 2. QoS and retain flag are downgraded to the
+// broker capabilities. A QoS 1 or 2 message not acknowledged when ctx is done is kept in the session, it is sent again
+// if the broker resumes the session on reconnection.
+func (c *Client) Publish(ctx context.Context, m *Publish) error {
+	c.mu.Lock()
+	conn, inflight := c.conn, c.inflight
+	msg := *m
+	if msg.QoS > c.maxQoS {
+		msg.QoS = c.maxQoS
+	}
+	msg.Retain = msg.Retain && c.retainAvailable
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	if msg.QoS == 0 {
+		return c.write(conn, msg.packet())
+	}
+
+	// Slot is released with the acknowledgement, see complete
+	select {
+	case inflight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	id, ch, err := c.register(&msg)
+	if err != nil {
+		<-inflight
+		return err
+	}
+	defer c.unregister(id)
+	// On write failure the connection is lost, the message is sent again if the session is resumed
+	_ = c.write(conn, msg.packet())
+	a, err := wait(ctx, ch)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement of publish to %v: %v", msg.Topic, err)
+	}
+	return checkReason(a, "publish")
+}
+
+// Subscribe registers handler for filter. When the client is disconnected, the subscription is sent on next
+// connection.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos byte, handler MessageHandler) error {
+	sub := subscription{qos: qos, dispatcher: newDispatcher(handler)}
+	c.mu.Lock()
+	if previous, ok := c.subs[filter]; ok {
+		previous.dispatcher.stop()
+	}
+	c.subs[filter] = sub
+	c.mu.Unlock()
+
+	err := c.subscribe(ctx, filter, qos)
+	if errors.Is(err, ErrNotConnected) {
+		return nil
+	}
+	if err != nil {
+		c.mu.Lock()
+		if c.subs[filter] == sub {
+			delete(c.subs, filter)
+		}
+		c.mu.Unlock()
+		sub.dispatcher.stop()
+	}
+	return err
+}
+
+func (c *Client) subscribe(ctx context.Context, filter string, qos byte) error {
+	conn, err := c.current()
+	if err != nil {
+		return err
+	}
+	id, ch, err := c.register(nil)
+	if err != nil {
+		return err
+	}
+	defer c.unregister(id)
+	if err := c.write(conn, subscribePacket(id, filter, qos)); err != nil {
+		return fmt.Errorf("unable to send subscribe packet: %v", err)
+	}
+	a, err := wait(ctx, ch)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement of subscription to %v: %v", filter, err)
+	}
+	return checkReason(a, "subscription to "+filter)
+}
+
+// Unsubscribe removes subscriptions of filters
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	c.mu.Lock()
+	for _, f := range filters {
+		if sub, ok := c.subs[f]; ok {
+			sub.dispatcher.stop()
+			delete(c.subs, f)
+		}
+	}
+	c.mu.Unlock()
+
+	conn, err := c.current()
+	if err != nil {
+		return nil
+	}
+	id, ch, err := c.register(nil)
+	if err != nil {
+		return err
+	}
+	defer c.unregister(id)
+	if err := c.write(conn, unsubscribePacket(id, filters)); err != nil {
+		return fmt.Errorf("unable to send unsubscribe packet: %v", err)
+	}
+	a, err := wait(ctx, ch)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement of unsubscription from %v: %v", filters, err)
+	}
+	for _, reason := range a.reasons {
+		if reason >= reasonFailure {
+			return fmt.Errorf("unsubscription from %v refused by broker, reason 0x%02x", filters, reason)
+		}
+	}
+	return nil
+}
+
+// IsConnected returns true if the connection to the broker is established
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// Disconnect closes the connection, stops reconnections and handlers of subscriptions
+func (c *Client) Disconnect() {
+	c.mu.Lock()
+	c.stopped = true
+	conn := c.conn
+	for _, sub := range c.subs {
+		sub.dispatcher.stop()
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	_ = c.write(conn, disconnectPacket(0))
+	c.connectionLost(conn, nil)
+}
+
+// Match returns true if topic matches filter, filter may contain + and # wildcards
+func Match(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
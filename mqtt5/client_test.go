@@ -0,0 +1,324 @@
+package mqtt5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func connectClient(t *testing.T, b *testBroker, opts ClientOptions) *Client {
+	t.Helper()
+	opts.Broker = b.url()
+	if opts.ClientID == "" {
+		opts.ClientID = "test"
+	}
+	c := NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	t.Cleanup(c.Disconnect)
+	waitFor(t, b.connects, "connect")
+	return c
+}
+
+func TestClient_Connect(t *testing.T) {
+	b := newTestBroker(t)
+	opts := ClientOptions{
+		Broker:        b.url(),
+		ClientID:      "bridge",
+		Username:      "user",
+		Password:      "secret",
+		CleanStart:    true,
+		SessionExpiry: time.Hour,
+		KeepAlive:     20 * time.Second,
+		Will:          &Publish{Topic: "homie/tv/$state", Payload: []byte("lost"), QoS: 1, Retain: true},
+	}
+	c := NewClient(opts)
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer c.Disconnect()
+
+	connect := waitFor(t, b.connects, "connect")
+	if connect.clientID != "bridge" || connect.username != "user" || connect.password != "secret" ||
+		!connect.cleanStart || connect.keepAlive != 20*time.Second || connect.properties.SessionExpiry != time.Hour {
+		t.Errorf("unexpected connect %+v", connect)
+	}
+	will := connect.will
+	if will == nil || will.Topic != "homie/tv/$state" || string(will.Payload) != "lost" || will.QoS != 1 || !will.Retain {
+		t.Errorf("unexpected will %+v", will)
+	}
+	if !c.IsConnected() {
+		t.Errorf("client not connected")
+	}
+}
+
+func TestClient_PublishQoS(t *testing.T) {
+	b := newTestBroker(t)
+	c := connectClient(t, b, ClientOptions{})
+
+	for qos := byte(0); qos <= 2; qos++ {
+		m := Publish{Topic: "chromecast/tv/volume", Payload: []byte{'0' + qos}, QoS: qos, Retain: true}
+		if err := c.Publish(context.Background(), &m); err != nil {
+			t.Fatalf("unable to publish with qos %d: %v", qos, err)
+		}
+		published := waitFor(t, b.published, "publish")
+		if published.QoS != qos || !published.Retain || string(published.Payload) != string(m.Payload) {
+			t.Errorf("publish %+v received as %+v", m, published)
+		}
+	}
+	select {
+	case m := <-b.published:
+		t.Errorf("unexpected publish %+v", m)
+	default:
+	}
+}
+
+func TestClient_PublishDowngrade(t *testing.T) {
+	b := newTestBroker(t)
+	qos, retain := byte(1), byte(0)
+	b.connack = Properties{MaximumQoS: &qos, RetainAvailable: &retain}
+	c := connectClient(t, b, ClientOptions{})
+
+	if err := c.Publish(context.Background(), &Publish{Topic: "a", QoS: 2, Retain: true}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+	published := waitFor(t, b.published, "publish")
+	if published.QoS != 1 || published.Retain {
+		t.Errorf("publish not downgraded: %+v", published)
+	}
+}
+
+func TestClient_ReceiveQoS2(t *testing.T) {
+	b := newTestBroker(t)
+	c := connectClient(t, b, ClientOptions{})
+
+	received := make(chan *Publish, 10)
+	if err := c.Subscribe(context.Background(), "chromecast/+/cast/send", 2, func(m *Publish) {
+		received <- m
+	}); err != nil {
+		t.Fatalf("unable to subscribe: %v", err)
+	}
+	waitFor(t, b.subscribed, "subscribe")
+
+	m := Publish{Topic: "chromecast/tv/cast/send", Payload: []byte("play"), QoS: 2, packetID: 9,
+		Properties: &Properties{ResponseTopic: "response", CorrelationData: []byte("1")}}
+	b.write(m.packet())
+	if a := b.ack(packetPubrec); a.packetID != 9 {
+		t.Errorf("pubrec of packet %d", a.packetID)
+	}
+	// Redelivery before release must not be delivered again
+	m.dup = true
+	b.write(m.packet())
+	b.ack(packetPubrec)
+	b.write(ackPacket(packetPubrel, 9, 0))
+	if a := b.ack(packetPubcomp); a.packetID != 9 {
+		t.Errorf("pubcomp of packet %d", a.packetID)
+	}
+
+	msg := waitFor(t, received, "message")
+	if string(msg.Payload) != "play" || msg.Properties.ResponseTopic != "response" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	select {
+	case m := <-received:
+		t.Errorf("message delivered twice: %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Packet id can be used again once released
+	m.dup = false
+	m.Payload = []byte("pause")
+	b.write(m.packet())
+	b.ack(packetPubrec)
+	if msg := waitFor(t, received, "message"); string(msg.Payload) != "pause" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	b := newTestBroker(t)
+	connected := make(chan struct{}, 10)
+	lost := make(chan error, 10)
+	c := connectClient(t, b, ClientOptions{
+		OnConnect:        func() { connected <- struct{}{} },
+		OnConnectionLost: func(err error) { lost <- err },
+	})
+	waitFor(t, connected, "connection")
+	if err := c.Subscribe(context.Background(), "chromecast/#", 1, func(*Publish) {}); err != nil {
+		t.Fatalf("unable to subscribe: %v", err)
+	}
+	waitFor(t, b.subscribed, "subscribe")
+
+	b.drop()
+	waitFor(t, lost, "connection lost")
+	if err := c.Publish(context.Background(), &Publish{Topic: "a"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("unexpected publish error while disconnected: %v", err)
+	}
+
+	waitFor(t, b.connects, "reconnection")
+	waitFor(t, connected, "reconnection")
+	// Session isn't kept by the broker, subscription is restored
+	if filter := waitFor(t, b.subscribed, "subscribe"); filter != "chromecast/#" {
+		t.Errorf("unexpected subscription %q", filter)
+	}
+	if err := c.Publish(context.Background(), &Publish{Topic: "a", QoS: 1}); err != nil {
+		t.Errorf("unable to publish after reconnection: %v", err)
+	}
+	waitFor(t, b.published, "publish")
+}
+
+func TestClient_Disconnect(t *testing.T) {
+	b := newTestBroker(t)
+	connected := make(chan struct{}, 10)
+	c := connectClient(t, b, ClientOptions{OnConnect: func() { connected <- struct{}{} }})
+	waitFor(t, connected, "connection")
+
+	c.Disconnect()
+	if c.IsConnected() {
+		t.Errorf("client still connected")
+	}
+	select {
+	case <-b.connects:
+		t.Errorf("client reconnected after disconnection")
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"+/+/cast/send", "chromecast/tv/cast/send", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, tt := range tests {
+		if match := Match(tt.filter, tt.topic); match != tt.match {
+			t.Errorf("Match(%q, %q) = %v", tt.filter, tt.topic, match)
+		}
+	}
+}
+
+func TestClient_DeliverInOrder(t *testing.T) {
+	b := newTestBroker(t)
+	c := connectClient(t, b, ClientOptions{})
+
+	received := make(chan string, 100)
+	release := make(chan struct{})
+	if err := c.Subscribe(context.Background(), "rpc/+", 1, func(m *Publish) {
+		<-release
+		received <- string(m.Payload)
+	}); err != nil {
+		t.Fatalf("unable to subscribe: %v", err)
+	}
+	waitFor(t, b.subscribed, "subscribe")
+
+	for i := 0; i < 50; i++ {
+		m := Publish{Topic: "rpc/tv", Payload: []byte(fmt.Sprint(i)), QoS: 1, packetID: uint16(i + 1)}
+		b.write(m.packet())
+	}
+	// A blocked handler doesn't delay acknowledgements
+	for i := 0; i < 50; i++ {
+		b.ack(packetPuback)
+	}
+	close(release)
+	for i := 0; i < 50; i++ {
+		if payload := waitFor(t, received, "message"); payload != fmt.Sprint(i) {
+			t.Fatalf("message %v received at position %d", payload, i)
+		}
+	}
+}
+
+// publishAsync publishes m and returns the channel of the result
+func publishAsync(c *Client, m *Publish) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- c.Publish(ctx, m)
+	}()
+	return done
+}
+
+func TestClient_ResumeSession(t *testing.T) {
+	b := newTestBroker(t)
+	c := connectClient(t, b, ClientOptions{SessionExpiry: time.Hour})
+
+	b.resume(true, packetPublish)
+	done := publishAsync(c, &Publish{Topic: "chromecast/tv/volume", Payload: []byte("10"), QoS: 1})
+	first := waitFor(t, b.published, "publish")
+	if first.dup {
+		t.Errorf("first publish with dup flag")
+	}
+
+	b.resume(true)
+	b.drop()
+	waitFor(t, b.connects, "reconnection")
+	resent := waitFor(t, b.published, "publish")
+	if !resent.dup || resent.packetID != first.packetID || string(resent.Payload) != "10" {
+		t.Errorf("unexpected resent message %+v", resent)
+	}
+	if err := waitFor(t, done, "publish result"); err != nil {
+		t.Errorf("unable to publish: %v", err)
+	}
+}
+
+func TestClient_ResumeSessionReleased(t *testing.T) {
+	b := newTestBroker(t)
+	c := connectClient(t, b, ClientOptions{SessionExpiry: time.Hour})
+
+	// PUBREC is received, PUBCOMP is lost
+	b.resume(true, packetPubrel)
+	done := publishAsync(c, &Publish{Topic: "chromecast/tv/cast/message", Payload: []byte("1"), QoS: 2})
+	waitFor(t, b.published, "publish")
+	id := waitFor(t, b.releases, "release")
+
+	b.resume(true)
+	b.drop()
+	waitFor(t, b.connects, "reconnection")
+	// Only PUBREL is sent again, the message isn't published twice
+	if resent := waitFor(t, b.releases, "release"); resent != id {
+		t.Errorf("release of packet %d, %d expected", resent, id)
+	}
+	if err := waitFor(t, done, "publish result"); err != nil {
+		t.Errorf("unable to publish: %v", err)
+	}
+	select {
+	case m := <-b.published:
+		t.Errorf("message published twice: %+v", m)
+	default:
+	}
+}
+
+func TestClient_SessionDiscarded(t *testing.T) {
+	b := newTestBroker(t)
+	c := connectClient(t, b, ClientOptions{})
+
+	b.resume(false, packetPublish)
+	done := publishAsync(c, &Publish{Topic: "chromecast/tv/volume", Payload: []byte("10"), QoS: 1})
+	waitFor(t, b.published, "publish")
+
+	b.resume(false)
+	b.drop()
+	waitFor(t, b.connects, "reconnection")
+	if err := waitFor(t, done, "publish result"); err == nil {
+		t.Errorf("publish of discarded session succeeded")
+	}
+	select {
+	case m := <-b.published:
+		t.Errorf("message of discarded session sent again: %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
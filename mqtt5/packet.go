@@ -0,0 +1,553 @@
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	packetConnect     byte = 1
+	packetConnack     byte = 2
+	packetPublish     byte = 3
+	packetPuback      byte = 4
+	packetPubrec      byte = 5
+	packetPubrel      byte = 6
+	packetPubcomp     byte = 7
+	packetSubscribe   byte = 8
+	packetSuback      byte = 9
+	packetUnsubscribe byte = 10
+	packetUnsuback    byte = 11
+	packetPingreq     byte = 12
+	packetPingresp    byte = 13
+	packetDisconnect  byte = 14
+	packetAuth        byte = 15
+)
+
+const protocolVersion = 5
+
+// Property identifiers
+const (
+	propPayloadFormat        byte = 0x01
+	propMessageExpiry        byte = 0x02
+	propContentType          byte = 0x03
+	propResponseTopic        byte = 0x08
+	propCorrelationData      byte = 0x09
+	propSubscriptionID       byte = 0x0B
+	propSessionExpiry        byte = 0x11
+	propAssignedClientID     byte = 0x12
+	propServerKeepAlive      byte = 0x13
+	propAuthMethod           byte = 0x15
+	propAuthData             byte = 0x16
+	propRequestProblemInfo   byte = 0x17
+	propWillDelay            byte = 0x18
+	propRequestResponseInfo  byte = 0x19
+	propResponseInfo         byte = 0x1A
+	propServerReference      byte = 0x1C
+	propReasonString         byte = 0x1F
+	propReceiveMaximum       byte = 0x21
+	propTopicAliasMaximum    byte = 0x22
+	propTopicAlias           byte = 0x23
+	propMaximumQoS           byte = 0x24
+	propRetainAvailable      byte = 0x25
+	propUserProperty         byte = 0x26
+	propMaximumPacketSize    byte = 0x27
+	propWildcardSubAvailable byte = 0x28
+	propSubIDAvailable       byte = 0x29
+	propSharedSubAvailable   byte = 0x2A
+)
+
+const maxVariableByteIntegerSize = 4
+
+// UserProperty is a key/value pair sent with a packet
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties of a packet, only those used by the client are decoded, others are skipped
+type Properties struct {
+	// MessageExpiry of a publish, 0 if the message doesn't expire
+	MessageExpiry   time.Duration
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  []UserProperty
+
+	// SessionExpiry of a connect, 0 to end the session on disconnection
+	SessionExpiry    time.Duration
+	AssignedClientID string
+	ServerKeepAlive  *uint16
+	ReasonString     string
+	ReceiveMaximum   uint16
+	TopicAlias       uint16
+	MaximumQoS       *byte
+	RetainAvailable  *byte
+}
+
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func writeVariableByteInteger(buf *bytes.Buffer, n int) {
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if n == 0 {
+			return
+		}
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeBinary(buf, []byte(s))
+}
+
+func writeBinary(buf *bytes.Buffer, b []byte) {
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+func writeUint16(buf *bytes.Buffer, n uint16) {
+	_ = binary.Write(buf, binary.BigEndian, n)
+}
+
+func writeUint32(buf *bytes.Buffer, n uint32) {
+	_ = binary.Write(buf, binary.BigEndian, n)
+}
+
+func (p *Properties) encode(buf *bytes.Buffer) {
+	var props bytes.Buffer
+	if p != nil {
+		if p.MessageExpiry > 0 {
+			props.WriteByte(propMessageExpiry)
+			writeUint32(&props, uint32(p.MessageExpiry/time.Second))
+		}
+		if p.ContentType != "" {
+			props.WriteByte(propContentType)
+			writeString(&props, p.ContentType)
+		}
+		if p.ResponseTopic != "" {
+			props.WriteByte(propResponseTopic)
+			writeString(&props, p.ResponseTopic)
+		}
+		if p.CorrelationData != nil {
+			props.WriteByte(propCorrelationData)
+			writeBinary(&props, p.CorrelationData)
+		}
+		if p.SessionExpiry > 0 {
+			props.WriteByte(propSessionExpiry)
+			writeUint32(&props, uint32(p.SessionExpiry/time.Second))
+		}
+		if p.ReceiveMaximum > 0 {
+			props.WriteByte(propReceiveMaximum)
+			writeUint16(&props, p.ReceiveMaximum)
+		}
+		for _, u := range p.UserProperties {
+			props.WriteByte(propUserProperty)
+			writeString(&props, u.Key)
+			writeString(&props, u.Value)
+		}
+	}
+	writeVariableByteInteger(buf, props.Len())
+	buf.Write(props.Bytes())
+}
+
+// reader decodes the body of a packet
+type reader struct {
+	buf *bytes.Reader
+}
+
+func (r *reader) byte() (byte, error) {
+	return r.buf.ReadByte()
+}
+
+func (r *reader) uint16() (uint16, error) {
+	var n uint16
+	err := binary.Read(r.buf, binary.BigEndian, &n)
+	return n, err
+}
+
+func (r *reader) uint32() (uint32, error) {
+	var n uint32
+	err := binary.Read(r.buf, binary.BigEndian, &n)
+	return n, err
+}
+
+func (r *reader) binary() ([]byte, error) {
+	n, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.buf, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (r *reader) string() (string, error) {
+	b, err := r.binary()
+	return string(b), err
+}
+
+func (r *reader) variableByteInteger() (int, error) {
+	return readVariableByteInteger(r.buf)
+}
+
+func readVariableByteInteger(r io.ByteReader) (int, error) {
+	n, mult := 0, 1
+	for i := 0; i < maxVariableByteIntegerSize; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(b&127) * mult
+		if b&128 == 0 {
+			return n, nil
+		}
+		mult *= 128
+	}
+	return 0, fmt.Errorf("malformed variable byte integer")
+}
+
+func (r *reader) properties() (*Properties, error) {
+	length, err := r.variableByteInteger()
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(r.buf, raw); err != nil {
+		return nil, err
+	}
+	pr := reader{buf: bytes.NewReader(raw)}
+	var p Properties
+	for pr.buf.Len() > 0 {
+		id, _ := pr.byte()
+		if err := pr.property(id, &p); err != nil {
+			return nil, fmt.Errorf("invalid property 0x%02x: %v", id, err)
+		}
+	}
+	return &p, nil
+}
+
+func (r *reader) property(id byte, p *Properties) error {
+	var err error
+	switch id {
+	case propMessageExpiry, propSessionExpiry:
+		var n uint32
+		if n, err = r.uint32(); err == nil {
+			d := time.Duration(n) * time.Second
+			if id == propMessageExpiry {
+				p.MessageExpiry = d
+			} else {
+				p.SessionExpiry = d
+			}
+		}
+	case propWillDelay, propMaximumPacketSize:
+		_, err = r.uint32()
+	case propContentType:
+		p.ContentType, err = r.string()
+	case propResponseTopic:
+		p.ResponseTopic, err = r.string()
+	case propAssignedClientID:
+		p.AssignedClientID, err = r.string()
+	case propReasonString:
+		p.ReasonString, err = r.string()
+	case propAuthMethod, propResponseInfo, propServerReference:
+		_, err = r.string()
+	case propCorrelationData:
+		p.CorrelationData, err = r.binary()
+	case propAuthData:
+		_, err = r.binary()
+	case propServerKeepAlive:
+		var n uint16
+		if n, err = r.uint16(); err == nil {
+			p.ServerKeepAlive = &n
+		}
+	case propReceiveMaximum:
+		p.ReceiveMaximum, err = r.uint16()
+	case propTopicAlias:
+		p.TopicAlias, err = r.uint16()
+	case propTopicAliasMaximum:
+		_, err = r.uint16()
+	case propMaximumQoS, propRetainAvailable:
+		var b byte
+		if b, err = r.byte(); err == nil {
+			if id == propMaximumQoS {
+				p.MaximumQoS = &b
+			} else {
+				p.RetainAvailable = &b
+			}
+		}
+	case propPayloadFormat, propRequestProblemInfo, propRequestResponseInfo, propWildcardSubAvailable,
+		propSubIDAvailable, propSharedSubAvailable:
+		_, err = r.byte()
+	case propSubscriptionID:
+		_, err = r.variableByteInteger()
+	case propUserProperty:
+		var u UserProperty
+		if u.Key, err = r.string(); err == nil {
+			u.Value, err = r.string()
+		}
+		p.UserProperties = append(p.UserProperties, u)
+	default:
+		return fmt.Errorf("unknown property")
+	}
+	return err
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readVariableByteInteger(r)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{typ: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func (p *packet) reader() *reader {
+	return &reader{buf: bytes.NewReader(p.body)}
+}
+
+func (p *packet) bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(p.typ<<4 | p.flags)
+	writeVariableByteInteger(&buf, len(p.body))
+	buf.Write(p.body)
+	return buf.Bytes()
+}
+
+// Publish is an application message
+type Publish struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Properties *Properties
+
+	packetID uint16
+	dup      bool
+}
+
+func (m *Publish) packet() *packet {
+	var buf bytes.Buffer
+	writeString(&buf, m.Topic)
+	if m.QoS > 0 {
+		writeUint16(&buf, m.packetID)
+	}
+	m.Properties.encode(&buf)
+	buf.Write(m.Payload)
+
+	flags := m.QoS << 1
+	if m.Retain {
+		flags |= 0x01
+	}
+	if m.dup {
+		flags |= 0x08
+	}
+	return &packet{typ: packetPublish, flags: flags, body: buf.Bytes()}
+}
+
+func decodePublish(p *packet) (*Publish, error) {
+	m := Publish{
+		QoS:    (p.flags >> 1) & 0x03,
+		Retain: p.flags&0x01 != 0,
+		dup:    p.flags&0x08 != 0,
+	}
+	r := p.reader()
+	var err error
+	if m.Topic, err = r.string(); err != nil {
+		return nil, err
+	}
+	if m.QoS > 0 {
+		if m.packetID, err = r.uint16(); err != nil {
+			return nil, err
+		}
+	}
+	if m.Properties, err = r.properties(); err != nil {
+		return nil, err
+	}
+	m.Payload = make([]byte, r.buf.Len())
+	_, _ = r.buf.Read(m.Payload)
+	return &m, nil
+}
+
+// ack is a PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK or UNSUBACK packet
+type ack struct {
+	packetID uint16
+	// reasons has one code per topic filter for SUBACK and UNSUBACK
+	reasons    []byte
+	properties *Properties
+}
+
+func ackPacket(typ byte, packetID uint16, reason byte) *packet {
+	var buf bytes.Buffer
+	writeUint16(&buf, packetID)
+	if reason != 0 {
+		buf.WriteByte(reason)
+	}
+	flags := byte(0)
+	if typ == packetPubrel {
+		flags = 0x02
+	}
+	return &packet{typ: typ, flags: flags, body: buf.Bytes()}
+}
+
+func decodeAck(p *packet) (*ack, error) {
+	r := p.reader()
+	var a ack
+	var err error
+	if a.packetID, err = r.uint16(); err != nil {
+		return nil, err
+	}
+	switch p.typ {
+	case packetSuback, packetUnsuback:
+		if a.properties, err = r.properties(); err != nil {
+			return nil, err
+		}
+		a.reasons = make([]byte, r.buf.Len())
+		_, _ = r.buf.Read(a.reasons)
+	default:
+		// Reason code and properties may be omitted on success
+		if r.buf.Len() == 0 {
+			a.reasons = []byte{0}
+			return &a, nil
+		}
+		reason, _ := r.byte()
+		a.reasons = []byte{reason}
+		if r.buf.Len() > 0 {
+			if a.properties, err = r.properties(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &a, nil
+}
+
+type connectPacket struct {
+	clientID   string
+	username   string
+	password   string
+	cleanStart bool
+	keepAlive  time.Duration
+	properties *Properties
+	// will is published by the broker when the connection is lost, nil if none
+	will *Publish
+}
+
+func (c *connectPacket) packet() *packet {
+	var buf bytes.Buffer
+	writeString(&buf, "MQTT")
+	buf.WriteByte(protocolVersion)
+	flags := byte(0)
+	if c.username != "" {
+		flags |= 0x80
+	}
+	if c.password != "" {
+		flags |= 0x40
+	}
+	if c.cleanStart {
+		flags |= 0x02
+	}
+	if c.will != nil {
+		flags |= 0x04 | c.will.QoS<<3
+		if c.will.Retain {
+			flags |= 0x20
+		}
+	}
+	buf.WriteByte(flags)
+	writeUint16(&buf, uint16(c.keepAlive/time.Second))
+	c.properties.encode(&buf)
+	writeString(&buf, c.clientID)
+	if c.will != nil {
+		c.will.Properties.encode(&buf)
+		writeString(&buf, c.will.Topic)
+		writeBinary(&buf, c.will.Payload)
+	}
+	if c.username != "" {
+		writeString(&buf, c.username)
+	}
+	if c.password != "" {
+		writeString(&buf, c.password)
+	}
+	return &packet{typ: packetConnect, body: buf.Bytes()}
+}
+
+type connack struct {
+	sessionPresent bool
+	reason         byte
+	properties     *Properties
+}
+
+func decodeConnack(p *packet) (*connack, error) {
+	r := p.reader()
+	flags, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	reason, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	c := connack{sessionPresent: flags&0x01 != 0, reason: reason, properties: &Properties{}}
+	if r.buf.Len() > 0 {
+		if c.properties, err = r.properties(); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+func subscribePacket(packetID uint16, filter string, qos byte) *packet {
+	var buf bytes.Buffer
+	writeUint16(&buf, packetID)
+	(*Properties)(nil).encode(&buf)
+	writeString(&buf, filter)
+	buf.WriteByte(qos)
+	return &packet{typ: packetSubscribe, flags: 0x02, body: buf.Bytes()}
+}
+
+func unsubscribePacket(packetID uint16, filters []string) *packet {
+	var buf bytes.Buffer
+	writeUint16(&buf, packetID)
+	(*Properties)(nil).encode(&buf)
+	for _, f := range filters {
+		writeString(&buf, f)
+	}
+	return &packet{typ: packetUnsubscribe, flags: 0x02, body: buf.Bytes()}
+}
+
+func disconnectPacket(reason byte) *packet {
+	return &packet{typ: packetDisconnect, body: []byte{reason}}
+}
+
+// decodeDisconnect returns the reason of a DISCONNECT sent by the server
+func decodeDisconnect(p *packet) (byte, string) {
+	r := p.reader()
+	reason, err := r.byte()
+	if err != nil {
+		return 0, ""
+	}
+	props, err := r.properties()
+	if err != nil {
+		return reason, ""
+	}
+	return reason, props.ReasonString
+}
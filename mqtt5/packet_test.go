@@ -0,0 +1,291 @@
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// roundTrip encodes p and reads it back
+func roundTrip(t *testing.T, p *packet) *packet {
+	t.Helper()
+	decoded, err := readPacket(bufio.NewReader(bytes.NewReader(p.bytes())))
+	if err != nil {
+		t.Fatalf("unable to read packet: %v", err)
+	}
+	if decoded.typ != p.typ || decoded.flags != p.flags || !bytes.Equal(decoded.body, p.body) {
+		t.Fatalf("packet %+v decoded as %+v", p, decoded)
+	}
+	return decoded
+}
+
+func TestVariableByteInteger(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		var buf bytes.Buffer
+		writeVariableByteInteger(&buf, n)
+		decoded, err := readVariableByteInteger(&buf)
+		if err != nil {
+			t.Errorf("unable to decode %d: %v", n, err)
+		} else if decoded != n {
+			t.Errorf("%d decoded as %d", n, decoded)
+		}
+	}
+
+	if _, err := readVariableByteInteger(bytes.NewReader([]byte{0x80, 0x80, 0x80, 0x80, 0x01})); err == nil {
+		t.Errorf("variable byte integer of 5 bytes accepted")
+	}
+}
+
+func TestPublish_RoundTrip(t *testing.T) {
+	messages := []Publish{
+		{Topic: "chromecast/tv/volume", Payload: []byte("42"), Properties: &Properties{}},
+		{Topic: "chromecast/tv/state", Payload: []byte(`{"state":"PLAYING"}`), QoS: 1, Retain: true, packetID: 1,
+			Properties: &Properties{}},
+		{Topic: "chromecast/tv/cast/send", Payload: []byte{}, QoS: 2, packetID: 65535, dup: true,
+			Properties: &Properties{
+				MessageExpiry:   90 * time.Second,
+				ContentType:     "application/json",
+				ResponseTopic:   "client/response",
+				CorrelationData: []byte{0, 1, 2},
+				UserProperties:  []UserProperty{{Key: "device", Value: "tv"}, {Key: "device", Value: "again"}},
+			}},
+	}
+	for _, m := range messages {
+		p := roundTrip(t, m.packet())
+		decoded, err := decodePublish(p)
+		if err != nil {
+			t.Fatalf("unable to decode publish %+v: %v", m, err)
+		}
+		if !reflect.DeepEqual(*decoded, m) {
+			t.Errorf("publish %+v decoded as %+v", m, *decoded)
+		}
+	}
+}
+
+func TestAck_RoundTrip(t *testing.T) {
+	for _, typ := range []byte{packetPuback, packetPubrec, packetPubrel, packetPubcomp} {
+		for _, reason := range []byte{0, 0x10, 0x87} {
+			p := roundTrip(t, ackPacket(typ, 12, reason))
+			if typ == packetPubrel && p.flags != 0x02 {
+				t.Errorf("invalid pubrel flags 0x%02x", p.flags)
+			}
+			a, err := decodeAck(p)
+			if err != nil {
+				t.Fatalf("unable to decode ack %d: %v", typ, err)
+			}
+			if a.packetID != 12 || !bytes.Equal(a.reasons, []byte{reason}) {
+				t.Errorf("ack %d with reason 0x%02x decoded as %+v", typ, reason, a)
+			}
+		}
+	}
+
+	// Ack with reason string
+	var body bytes.Buffer
+	writeUint16(&body, 3)
+	body.WriteByte(0x97)
+	props := []byte{propReasonString, 0, 5, 'q', 'u', 'o', 't', 'a'}
+	writeVariableByteInteger(&body, len(props))
+	body.Write(props)
+	a, err := decodeAck(&packet{typ: packetPuback, body: body.Bytes()})
+	if err != nil {
+		t.Fatalf("unable to decode puback: %v", err)
+	}
+	if err := checkReason(a, "publish"); err == nil || err.Error() != "publish refused by broker, reason 0x97 quota" {
+		t.Errorf("unexpected reason error %v", err)
+	}
+
+	for _, typ := range []byte{packetSuback, packetUnsuback} {
+		var body bytes.Buffer
+		writeUint16(&body, 7)
+		(*Properties)(nil).encode(&body)
+		body.Write([]byte{0x01, 0x80})
+		a, err := decodeAck(&packet{typ: typ, body: body.Bytes()})
+		if err != nil {
+			t.Fatalf("unable to decode ack %d: %v", typ, err)
+		}
+		if a.packetID != 7 || !bytes.Equal(a.reasons, []byte{0x01, 0x80}) {
+			t.Errorf("ack %d decoded as %+v", typ, a)
+		}
+	}
+}
+
+func TestConnect_RoundTrip(t *testing.T) {
+	connects := []connectPacket{
+		{clientID: "bridge", keepAlive: 30 * time.Second, properties: &Properties{}},
+		{clientID: "bridge", username: "user", password: "secret", cleanStart: true, keepAlive: time.Minute,
+			properties: &Properties{SessionExpiry: time.Hour, ReceiveMaximum: 10},
+			will: &Publish{Topic: "homie/tv/$state", Payload: []byte("lost"), QoS: 1, Retain: true,
+				Properties: &Properties{ContentType: "text/plain"}}},
+	}
+	for _, c := range connects {
+		p := roundTrip(t, c.packet())
+		decoded, err := decodeConnect(p)
+		if err != nil {
+			t.Fatalf("unable to decode connect %+v: %v", c, err)
+		}
+		if !reflect.DeepEqual(*decoded, c) {
+			t.Errorf("connect %+v decoded as %+v", c, *decoded)
+		}
+	}
+}
+
+func TestConnack_Decode(t *testing.T) {
+	keepAlive, qos, retain := uint16(20), byte(1), byte(0)
+	p := connackPacket(true, 0, &Properties{
+		AssignedClientID: "auto-1",
+		ServerKeepAlive:  &keepAlive,
+		ReceiveMaximum:   5,
+		MaximumQoS:       &qos,
+		RetainAvailable:  &retain,
+	})
+	c, err := decodeConnack(roundTrip(t, p))
+	if err != nil {
+		t.Fatalf("unable to decode connack: %v", err)
+	}
+	if !c.sessionPresent || c.reason != 0 || c.properties.AssignedClientID != "auto-1" ||
+		*c.properties.ServerKeepAlive != 20 || c.properties.ReceiveMaximum != 5 || *c.properties.MaximumQoS != 1 ||
+		*c.properties.RetainAvailable != 0 {
+		t.Errorf("unexpected connack %+v, properties %+v", c, c.properties)
+	}
+
+	// Properties may be omitted
+	c, err = decodeConnack(&packet{typ: packetConnack, body: []byte{0, 0x86}})
+	if err != nil {
+		t.Fatalf("unable to decode connack: %v", err)
+	}
+	if c.sessionPresent || c.reason != 0x86 || c.properties == nil {
+		t.Errorf("unexpected connack %+v", c)
+	}
+}
+
+func TestSubscribe_RoundTrip(t *testing.T) {
+	p := roundTrip(t, subscribePacket(4, "chromecast/+/cast/send", 2))
+	id, filter, qos, err := decodeSubscribe(p)
+	if err != nil {
+		t.Fatalf("unable to decode subscribe: %v", err)
+	}
+	if p.flags != 0x02 || id != 4 || filter != "chromecast/+/cast/send" || qos != 2 {
+		t.Errorf("unexpected subscribe flags=0x%02x id=%d filter=%q qos=%d", p.flags, id, filter, qos)
+	}
+
+	p = roundTrip(t, unsubscribePacket(5, []string{"a/#", "b"}))
+	id, filters, err := decodeUnsubscribe(p)
+	if err != nil {
+		t.Fatalf("unable to decode unsubscribe: %v", err)
+	}
+	if p.flags != 0x02 || id != 5 || !reflect.DeepEqual(filters, []string{"a/#", "b"}) {
+		t.Errorf("unexpected unsubscribe flags=0x%02x id=%d filters=%v", p.flags, id, filters)
+	}
+}
+
+func TestDisconnect_RoundTrip(t *testing.T) {
+	reason, msg := decodeDisconnect(roundTrip(t, disconnectPacket(0)))
+	if reason != 0 || msg != "" {
+		t.Errorf("unexpected disconnect reason 0x%02x %q", reason, msg)
+	}
+
+	props := []byte{propReasonString, 0, 8, 's', 'h', 'u', 't', 't', 'i', 'n', 'g'}
+	body := append([]byte{0x8B, byte(len(props))}, props...)
+	reason, msg = decodeDisconnect(&packet{typ: packetDisconnect, body: body})
+	if reason != 0x8B || msg != "shutting" {
+		t.Errorf("unexpected disconnect reason 0x%02x %q", reason, msg)
+	}
+}
+
+func TestProperties_Decode(t *testing.T) {
+	u16 := func(n uint16) []byte { return []byte{byte(n >> 8), byte(n)} }
+	u32 := func(n uint32) []byte { return []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)} }
+	str := func(s string) []byte { return append(u16(uint16(len(s))), s...) }
+	keepAlive, qos, retain := uint16(15), byte(0), byte(1)
+
+	tests := []struct {
+		id       byte
+		value    []byte
+		expected Properties
+	}{
+		{propPayloadFormat, []byte{1}, Properties{}},
+		{propMessageExpiry, u32(60), Properties{MessageExpiry: time.Minute}},
+		{propContentType, str("text/plain"), Properties{ContentType: "text/plain"}},
+		{propResponseTopic, str("response"), Properties{ResponseTopic: "response"}},
+		{propCorrelationData, str("id"), Properties{CorrelationData: []byte("id")}},
+		{propSubscriptionID, []byte{0x80, 0x01}, Properties{}},
+		{propSessionExpiry, u32(3600), Properties{SessionExpiry: time.Hour}},
+		{propAssignedClientID, str("auto"), Properties{AssignedClientID: "auto"}},
+		{propServerKeepAlive, u16(15), Properties{ServerKeepAlive: &keepAlive}},
+		{propAuthMethod, str("SCRAM"), Properties{}},
+		{propAuthData, str("data"), Properties{}},
+		{propRequestProblemInfo, []byte{1}, Properties{}},
+		{propWillDelay, u32(10), Properties{}},
+		{propRequestResponseInfo, []byte{1}, Properties{}},
+		{propResponseInfo, str("info"), Properties{}},
+		{propServerReference, str("other"), Properties{}},
+		{propReasonString, str("reason"), Properties{ReasonString: "reason"}},
+		{propReceiveMaximum, u16(20), Properties{ReceiveMaximum: 20}},
+		{propTopicAliasMaximum, u16(10), Properties{}},
+		{propTopicAlias, u16(3), Properties{TopicAlias: 3}},
+		{propMaximumQoS, []byte{0}, Properties{MaximumQoS: &qos}},
+		{propRetainAvailable, []byte{1}, Properties{RetainAvailable: &retain}},
+		{propUserProperty, append(str("key"), str("value")...),
+			Properties{UserProperties: []UserProperty{{Key: "key", Value: "value"}}}},
+		{propMaximumPacketSize, u32(1024), Properties{}},
+		{propWildcardSubAvailable, []byte{1}, Properties{}},
+		{propSubIDAvailable, []byte{1}, Properties{}},
+		{propSharedSubAvailable, []byte{0}, Properties{}},
+	}
+	for _, tt := range tests {
+		// Property followed by another one to check its length
+		next := propReasonString
+		if tt.id == propReasonString {
+			next = propContentType
+		}
+		raw := append(append([]byte{tt.id}, tt.value...), next, 0, 1, 'x')
+		body := append([]byte{byte(len(raw))}, raw...)
+		r := reader{buf: bytes.NewReader(body)}
+		p, err := r.properties()
+		if err != nil {
+			t.Errorf("unable to decode property 0x%02x: %v", tt.id, err)
+			continue
+		}
+		if next == propReasonString {
+			tt.expected.ReasonString = "x"
+		} else {
+			tt.expected.ContentType = "x"
+		}
+		if !reflect.DeepEqual(*p, tt.expected) {
+			t.Errorf("property 0x%02x decoded as %+v, expected %+v", tt.id, *p, tt.expected)
+		}
+	}
+
+	r := reader{buf: bytes.NewReader([]byte{2, 0x7F, 0})}
+	if _, err := r.properties(); err == nil {
+		t.Errorf("unknown property accepted")
+	}
+	r = reader{buf: bytes.NewReader([]byte{3, propReceiveMaximum, 0})}
+	if _, err := r.properties(); err == nil {
+		t.Errorf("truncated properties accepted")
+	}
+}
+
+func TestProperties_RoundTrip(t *testing.T) {
+	props := Properties{
+		MessageExpiry:   time.Minute,
+		ContentType:     "application/json",
+		ResponseTopic:   "response",
+		CorrelationData: []byte{},
+		SessionExpiry:   time.Hour,
+		ReceiveMaximum:  100,
+		UserProperties:  []UserProperty{{Key: "a", Value: "1"}, {Key: "b", Value: ""}},
+	}
+	var buf bytes.Buffer
+	props.encode(&buf)
+	r := reader{buf: bytes.NewReader(buf.Bytes())}
+	decoded, err := r.properties()
+	if err != nil {
+		t.Fatalf("unable to decode properties: %v", err)
+	}
+	if !reflect.DeepEqual(*decoded, props) {
+		t.Errorf("properties %+v decoded as %+v", props, *decoded)
+	}
+}
@@ -0,0 +1,277 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const otlpTimeout = 10 * time.Second
+
+// OTLP status codes differ from codes.Code
+const (
+	otlpStatusUnset = 0
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+// Messages of the OTLP protobuf json encoding, ids are hex encoded and 64 bits integers are strings
+
+type otlpValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpValue `json:"values"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID                string         `json:"traceId"`
+	SpanID                 string         `json:"spanId"`
+	ParentSpanID           string         `json:"parentSpanId,omitempty"`
+	Name                   string         `json:"name"`
+	Kind                   int            `json:"kind"`
+	StartTimeUnixNano      string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano        string         `json:"endTimeUnixNano"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+	Events                 []otlpEvent    `json:"events,omitempty"`
+	DroppedEventsCount     int            `json:"droppedEventsCount,omitempty"`
+	Links                  []otlpLink     `json:"links,omitempty"`
+	DroppedLinksCount      int            `json:"droppedLinksCount,omitempty"`
+	Status                 otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope     otlpScope  `json:"scope"`
+	Spans     []otlpSpan `json:"spans"`
+	SchemaURL string     `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	SchemaURL  string           `json:"schemaUrl,omitempty"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLPExporter posts spans to the traces url of an OpenTelemetry collector, with the OTLP/HTTP json encoding
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: otlpTimeout},
+	}
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(newOTLPTracesRequest(spans))
+	if err != nil {
+		return fmt.Errorf("unable to marshal spans: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("invalid otlp request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to export spans to %v: %w", e.endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unable to export spans to %v: %v %s", e.endpoint, resp.Status, body)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown(context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// newOTLPTracesRequest groups spans by resource and instrumentation scope
+func newOTLPTracesRequest(spans []sdktrace.ReadOnlySpan) otlpTracesRequest {
+	var req otlpTracesRequest
+	resources := make(map[attribute.Distinct]int)
+	scopes := make(map[attribute.Distinct]map[instrumentation.Library]int)
+	for _, s := range spans {
+		res := s.Resource()
+		key := res.Equivalent()
+		r, ok := resources[key]
+		if !ok {
+			r = len(req.ResourceSpans)
+			resources[key] = r
+			scopes[key] = make(map[instrumentation.Library]int)
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource:  otlpResource{Attributes: otlpAttributes(res.Attributes())},
+				SchemaURL: res.SchemaURL(),
+			})
+		}
+		rs := &req.ResourceSpans[r]
+
+		lib := s.InstrumentationLibrary()
+		i, ok := scopes[key][lib]
+		if !ok {
+			i = len(rs.ScopeSpans)
+			scopes[key][lib] = i
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{
+				Scope:     otlpScope{Name: lib.Name, Version: lib.Version},
+				SchemaURL: lib.SchemaURL,
+			})
+		}
+		rs.ScopeSpans[i].Spans = append(rs.ScopeSpans[i].Spans, newOTLPSpan(s))
+	}
+	return req
+}
+
+func newOTLPSpan(s sdktrace.ReadOnlySpan) otlpSpan {
+	span := otlpSpan{
+		TraceID:                s.SpanContext().TraceID().String(),
+		SpanID:                 s.SpanContext().SpanID().String(),
+		Name:                   s.Name(),
+		Kind:                   int(s.SpanKind()),
+		StartTimeUnixNano:      unixNano(s.StartTime()),
+		EndTimeUnixNano:        unixNano(s.EndTime()),
+		Attributes:             otlpAttributes(s.Attributes()),
+		DroppedAttributesCount: s.DroppedAttributes(),
+		DroppedEventsCount:     s.DroppedEvents(),
+		DroppedLinksCount:      s.DroppedLinks(),
+		Status:                 otlpStatus{Message: s.Status().Description},
+	}
+	if s.Parent().IsValid() {
+		span.ParentSpanID = s.Parent().SpanID().String()
+	}
+	switch s.Status().Code {
+	case codes.Unset:
+		span.Status.Code = otlpStatusUnset
+	case codes.Ok:
+		span.Status.Code = otlpStatusOk
+	case codes.Error:
+		span.Status.Code = otlpStatusError
+	}
+	for _, evt := range s.Events() {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: unixNano(evt.Time),
+			Name:         evt.Name,
+			Attributes:   otlpAttributes(evt.Attributes),
+		})
+	}
+	for _, l := range s.Links() {
+		span.Links = append(span.Links, otlpLink{
+			TraceID:    l.SpanContext.TraceID().String(),
+			SpanID:     l.SpanContext.SpanID().String(),
+			Attributes: otlpAttributes(l.Attributes),
+		})
+	}
+	return span
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	values := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		values = append(values, otlpKeyValue{Key: string(a.Key), Value: newOTLPValue(a.Value)})
+	}
+	return values
+}
+
+func newOTLPValue(v attribute.Value) otlpValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return otlpValue{BoolValue: &b}
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		return otlpValue{IntValue: &i}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return otlpValue{DoubleValue: &f}
+	case attribute.BOOLSLICE:
+		values := make([]otlpValue, 0)
+		for _, b := range v.AsBoolSlice() {
+			values = append(values, newOTLPValue(attribute.BoolValue(b)))
+		}
+		return otlpValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.INT64SLICE:
+		values := make([]otlpValue, 0)
+		for _, i := range v.AsInt64Slice() {
+			values = append(values, newOTLPValue(attribute.Int64Value(i)))
+		}
+		return otlpValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.FLOAT64SLICE:
+		values := make([]otlpValue, 0)
+		for _, f := range v.AsFloat64Slice() {
+			values = append(values, newOTLPValue(attribute.Float64Value(f)))
+		}
+		return otlpValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.STRINGSLICE:
+		values := make([]otlpValue, 0)
+		for _, s := range v.AsStringSlice() {
+			values = append(values, newOTLPValue(attribute.StringValue(s)))
+		}
+		return otlpValue{ArrayValue: &otlpArrayValue{Values: values}}
+	default:
+		s := v.Emit()
+		return otlpValue{StringValue: &s}
+	}
+}
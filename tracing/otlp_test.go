@@ -0,0 +1,196 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// sequenceIDs generates predictable trace and span ids
+type sequenceIDs struct {
+	mu   sync.Mutex
+	next uint64
+}
+
+func (g *sequenceIDs) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.next++
+	var traceID trace.TraceID
+	binary.BigEndian.PutUint64(traceID[8:], g.next)
+	return traceID, g.spanID()
+}
+
+func (g *sequenceIDs) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.spanID()
+}
+
+func (g *sequenceIDs) spanID() trace.SpanID {
+	g.next++
+	var spanID trace.SpanID
+	binary.BigEndian.PutUint64(spanID[:], g.next)
+	return spanID
+}
+
+// recordSpans returns spans of each kind, status code and attribute type
+func recordSpans(t *testing.T) []sdktrace.ReadOnlySpan {
+	exp := &recordExporter{}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exp),
+		sdktrace.WithIDGenerator(&sequenceIDs{}),
+		sdktrace.WithResource(resource.NewWithAttributes("https://opentelemetry.io/schemas/1.10.0",
+			attribute.String("service.name", "chromecast2mqtt"))),
+	)
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ms int) trace.SpanEventOption {
+		return trace.WithTimestamp(start.Add(time.Duration(ms) * time.Millisecond))
+	}
+	tracer := provider.Tracer("github.com/cyrilix/chromecast2mqt/bridge", trace.WithInstrumentationVersion("1.0.0"))
+
+	ctx, command := tracer.Start(context.Background(), "mqtt.command", at(0), trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("string", "value"),
+			attribute.Bool("bool", true),
+			attribute.Int("int", 42),
+			attribute.Int64("int64", -1<<40),
+			attribute.Float64("float64", 0.25),
+			attribute.BoolSlice("bool_slice", []bool{true, false}),
+			attribute.IntSlice("int_slice", []int{1, 2}),
+			attribute.Int64Slice("int64_slice", []int64{3}),
+			attribute.Float64Slice("float64_slice", []float64{1.5, -2}),
+			attribute.StringSlice("string_slice", []string{"a", "b"}),
+		))
+	_, control := tracer.Start(ctx, "cast.control", at(1), trace.WithSpanKind(trace.SpanKindClient))
+	control.AddEvent("retry", trace.WithTimestamp(start.Add(2*time.Millisecond)),
+		trace.WithAttributes(attribute.Int("attempt", 2)))
+	control.SetStatus(codes.Error, "device not connected")
+	control.End(at(3))
+	_, publish := tracer.Start(ctx, "mqtt.publish", at(4), trace.WithSpanKind(trace.SpanKindProducer))
+	publish.SetStatus(codes.Ok, "")
+	publish.End(at(5))
+	command.End(at(6))
+
+	_, status := provider.Tracer("github.com/cyrilix/chromecast2mqt/cmd").Start(context.Background(), "http.status",
+		at(10), trace.WithSpanKind(trace.SpanKindServer))
+	status.End(at(11))
+	_, follow := tracer.Start(context.Background(), "bridge.follow_transport", at(20),
+		trace.WithLinks(trace.Link{
+			SpanContext: command.SpanContext(),
+			Attributes:  []attribute.KeyValue{attribute.String("link", "transport")},
+		}))
+	follow.End(at(21))
+
+	return exp.spans
+}
+
+type recordExporter struct {
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *recordExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestOTLPExporter_Golden(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	exp := NewOTLPExporter(server.URL)
+	if err := exp.ExportSpans(context.Background(), recordSpans(t)); err != nil {
+		t.Fatalf("unable to export spans: %v", err)
+	}
+	// Values of the OTLP specification, the golden file may be regenerated
+	var req otlpTracesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("invalid json exported: %v", err)
+	}
+	expectedSpans := map[string]struct{ kind, code int }{
+		"mqtt.command":            {kind: 5},
+		"cast.control":            {kind: 3, code: 2},
+		"mqtt.publish":            {kind: 4, code: 1},
+		"http.status":             {kind: 2},
+		"bridge.follow_transport": {kind: 1},
+	}
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				expected := expectedSpans[span.Name]
+				if span.Kind != expected.kind || span.Status.Code != expected.code {
+					t.Errorf("span %v has kind %d and status %d, expected %d and %d", span.Name, span.Kind,
+						span.Status.Code, expected.kind, expected.code)
+				}
+				delete(expectedSpans, span.Name)
+			}
+		}
+	}
+	if len(expectedSpans) > 0 {
+		t.Errorf("spans not exported: %v", expectedSpans)
+	}
+
+	var actual bytes.Buffer
+	if err := json.Indent(&actual, body, "", "  "); err != nil {
+		t.Fatalf("invalid json exported: %v", err)
+	}
+	actual.WriteByte('\n')
+
+	golden := filepath.Join("testdata", "otlp_traces.json")
+	if *update {
+		if err := os.WriteFile(golden, actual.Bytes(), 0644); err != nil {
+			t.Fatalf("unable to update golden file: %v", err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("unable to read golden file: %v", err)
+	}
+	if !bytes.Equal(actual.Bytes(), expected) {
+		t.Errorf("exported json differs from %v, run with -update to see the difference:\n%s", golden, actual.Bytes())
+	}
+}
+
+func TestOTLPExporter_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid spans", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	exp := NewOTLPExporter(server.URL)
+	if err := exp.ExportSpans(context.Background(), recordSpans(t)); err == nil {
+		t.Errorf("rejected export not reported")
+	}
+	if err := exp.ExportSpans(context.Background(), nil); err != nil {
+		t.Errorf("export of no span failed: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Package tracing exports spans of the bridge to stdout or to an OTLP/HTTP collector.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"os"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+
+	// DefaultEndpoint is the traces url of a local OpenTelemetry collector
+	DefaultEndpoint = "http://localhost:4318/v1/traces"
+)
+
+// ValidateExporter returns an error if exporter is unknown
+func ValidateExporter(exporter string) error {
+	switch exporter {
+	case ExporterNone, ExporterStdout, ExporterOTLP:
+		return nil
+	}
+	return fmt.Errorf("invalid exporter %q, must be %s, %s or %s", exporter, ExporterNone, ExporterStdout, ExporterOTLP)
+}
+
+// Setup registers the global tracer provider, spans are sent to exporter, endpoint is only used by otlp. The returned
+// function exports pending spans and stops the provider.
+func Setup(exporter, endpoint, version string) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exp = NewWriterExporter(os.Stdout)
+	case ExporterOTLP:
+		exp = NewOTLPExporter(endpoint)
+	default:
+		return nil, ValidateExporter(exporter)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override defaults
+	res, err := resource.New(context.Background(),
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String("chromecast2mqtt"),
+			semconv.ServiceVersionKey.String(version),
+		),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to build trace resource")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("tracing error: %v", err)
+	}))
+	log.WithFields(log.Fields{
+		"exporter": exporter,
+		"endpoint": endpoint,
+	}).Info("export traces")
+	return provider.Shutdown, nil
+}
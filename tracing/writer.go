@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"io"
+	"sync"
+	"time"
+)
+
+type writtenEvent struct {
+	Time       time.Time              `json:"time"`
+	Name       string                 `json:"name"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// writtenSpan is a span line of WriterExporter
+type writtenSpan struct {
+	TraceID      string    `json:"trace_id"`
+	SpanID       string    `json:"span_id"`
+	ParentSpanID string    `json:"parent_span_id,omitempty"`
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	// Duration is in milliseconds
+	Duration      float64                `json:"duration"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	Events        []writtenEvent         `json:"events,omitempty"`
+	Status        string                 `json:"status,omitempty"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+}
+
+// WriterExporter writes spans to out, one json line per span
+type WriterExporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewWriterExporter(out io.Writer) *WriterExporter {
+	return &WriterExporter{out: out}
+}
+
+func (e *WriterExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	encoder := json.NewEncoder(e.out)
+	for _, s := range spans {
+		line := writtenSpan{
+			TraceID:    s.SpanContext().TraceID().String(),
+			SpanID:     s.SpanContext().SpanID().String(),
+			Name:       s.Name(),
+			Kind:       s.SpanKind().String(),
+			Start:      s.StartTime(),
+			End:        s.EndTime(),
+			Duration:   float64(s.EndTime().Sub(s.StartTime()).Microseconds()) / 1000,
+			Attributes: attributeMap(s.Attributes()),
+		}
+		if s.Parent().IsValid() {
+			line.ParentSpanID = s.Parent().SpanID().String()
+		}
+		for _, evt := range s.Events() {
+			line.Events = append(line.Events, writtenEvent{
+				Time:       evt.Time,
+				Name:       evt.Name,
+				Attributes: attributeMap(evt.Attributes),
+			})
+		}
+		if s.Status().Code != codes.Unset {
+			line.Status = s.Status().Code.String()
+			line.StatusMessage = s.Status().Description
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *WriterExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func attributeMap(attrs []attribute.KeyValue) map[string]interface{} {
+	if len(attrs) == 0 {
+		return nil
+	}
+	values := make(map[string]interface{}, len(attrs))
+	for _, a := range attrs {
+		values[string(a.Key)] = a.Value.AsInterface()
+	}
+	return values
+}